@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const banFile = "banlist.dat"
+
+const banThreshold = 100 // 不良行为分数达到该值时封禁节点
+
+const defaultBanTime = 24 * time.Hour
+
+// 各种不良行为对应的分数
+const (
+	scoreMalformed     = 20  // 无法解码的消息
+	scoreUnknownCmd    = 10  // 未知的指令
+	scoreUnconnected   = 20  // 无法连接到本地链的区块头
+	scoreOversized     = 20  // 超出数量限制的消息
+	scoreInvalidHeader = 100 // 工作量证明或高度错误的区块头
+	scoreInvalidBlock  = 100 // 工作量证明或merkle根错误的区块
+	scoreFilterMisuse  = 100 // 超出大小限制的布隆过滤器，或者没有加载过滤器就添加数据
+)
+
+// 由对方节点引起的错误，score是对应的不良行为分数
+type peerError struct {
+	score  int
+	reason string
+}
+
+func (e *peerError) Error() string {
+	return e.reason
+}
+
+func misbehave(score int, format string, a ...interface{}) *peerError {
+	return &peerError{score, fmt.Sprintf(format, a...)}
+}
+
+// 封禁列表，持久化到file中。运行中的节点启动时读取一次，之后只在内存中查询，
+// 封禁时同时写回文件；命令行修改的封禁在节点下次启动时生效
+type BanList struct {
+	mu   sync.Mutex
+	file string
+	Bans map[string]int64 // 键-节点标识（见peerKey） 值-解封时间（unix秒）
+}
+
+// 读取封禁列表，文件不存在时返回空列表
+func LoadBanList(file string) (*BanList, error) {
+	bl := &BanList{file: file, Bans: make(map[string]int64)}
+
+	fileContent, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return bl, nil
+	}
+	if err != nil {
+		return bl, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(fileContent)).Decode(bl); err != nil {
+		return &BanList{file: file, Bans: make(map[string]int64)}, fmt.Errorf("corrupt ban list %s: %s", file, err)
+	}
+
+	// 删除已经过期的封禁
+	now := time.Now().Unix()
+	for addr, until := range bl.Bans {
+		if until <= now {
+			delete(bl.Bans, addr)
+		}
+	}
+	return bl, nil
+}
+
+func (bl *BanList) save() error {
+	var content bytes.Buffer
+
+	err := gob.NewEncoder(&content).Encode(bl)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(bl.file, content.Bytes(), 0600)
+}
+
+// 节点是否处于封禁期内
+func (bl *BanList) IsBanned(addr string) bool {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	until, ok := bl.Bans[addr]
+	return ok && until > time.Now().Unix()
+}
+
+// 封禁节点，duration为封禁时长
+func (bl *BanList) Ban(addr string, duration time.Duration) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.Bans[addr] = time.Now().Add(duration).Unix()
+	return bl.save()
+}
+
+// 解除对节点的封禁
+func (bl *BanList) Unban(addr string) error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	delete(bl.Bans, addr)
+	return bl.save()
+}
+
+// 解除所有封禁
+func (bl *BanList) Clear() error {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+
+	bl.Bans = make(map[string]int64)
+	return bl.save()
+}
+
+// 记录不良行为与封禁用的节点标识。对方在消息中声称的地址可以伪造，只能用连接确认过的身份：
+// TLS连接用对方证书公钥的指纹，与固定的公钥相同；明文TCP连接用对方声明的监听地址advertised，
+// 地址的主机必须就是连接的远端IP，否则只能用这一次连接的远端地址（每次连接端口都不同，不会牵连其他节点）；
+// 模拟网络中连接的远端地址就是对方的监听地址。不能只按IP记录，所有节点都在本机运行时会互相牵连
+func peerKey(conn net.Conn, advertised string) string {
+	if fingerprint := tlsFingerprint(conn); fingerprint != nil {
+		return fingerprintKey(fingerprint)
+	}
+	remote, ok := conn.RemoteAddr().(*net.TCPAddr)
+	if !ok {
+		return conn.RemoteAddr().String()
+	}
+	if advertisedBy(remote.IP, advertised) {
+		return advertised
+	}
+	return remote.String()
+}
+
+func fingerprintKey(fingerprint []byte) string {
+	return fmt.Sprintf("key:%x", fingerprint)
+}
+
+// 声明的监听地址的主机是否就是连接的远端
+func advertisedBy(ip net.IP, advertised string) bool {
+	host, _, err := net.SplitHostPort(advertised)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return ip.IsLoopback()
+	}
+	return ip.Equal(net.ParseIP(host))
+}
+
+// 节点的封禁列表，第一次使用时读取；文件损坏时忽略其中的封禁，不能让节点无法启动
+func (s *Server) banList() *BanList {
+	s.bansOnce.Do(func() {
+		bl, err := LoadBanList(s.banFile)
+		if err != nil {
+			fmt.Printf("ignoring ban list: %s\n", err)
+		}
+		s.bans = bl
+	})
+	return s.bans
+}
+
+// 本机的命令行以节点自己的地址发送消息，永远不封禁
+func (s *Server) isBanned(addr string) bool {
+	return addr != s.address && s.banList().IsBanned(addr)
+}
+
+// 记录节点的不良行为，addr为peerKey返回的节点标识，分数累计达到banThreshold时封禁该节点。
+// 之后向它发送消息时会发现它已被封禁，再将其从已知节点中移除
+func (s *Server) Misbehaving(addr string, score int, reason string) {
+	s.scoresMu.Lock()
+	s.scores[addr] += score
+	total := s.scores[addr]
+	if total >= banThreshold {
+		delete(s.scores, addr)
+	}
+	s.scoresMu.Unlock()
+
+	fmt.Printf("peer %s misbehaving (+%d = %d): %s\n", addr, score, total, reason)
+
+	if total >= banThreshold && addr != s.address {
+		fmt.Printf("ban peer %s for %s\n", addr, defaultBanTime)
+		if err := s.banList().Ban(addr, defaultBanTime); err != nil {
+			fmt.Printf("save ban list: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+// 本机两个TCP连接的两端
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	client, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, err := ln.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+func TestPeerKey(t *testing.T) {
+	_, conn := tcpPair(t)
+	remote := conn.RemoteAddr().String()
+
+	tests := []struct {
+		advertised string
+		want       string
+	}{
+		{"localhost:3001", "localhost:3001"},
+		{"127.0.0.1:3002", "127.0.0.1:3002"},
+		{"10.0.0.1:3001", remote}, // 声明的主机不是连接的远端
+		{"localhost", remote},
+		{"", remote},
+	}
+	for _, test := range tests {
+		if got := peerKey(conn, test.advertised); got != test.want {
+			t.Errorf("peerKey(%q) = %q, want %q", test.advertised, got, test.want)
+		}
+	}
+}
+
+func TestMisbehavingNeverBansLocal(t *testing.T) {
+	s := NewServer("localhost:3000", "", nil, tcpTransport{}, nil)
+	s.banFile = filepath.Join(t.TempDir(), "banlist.dat")
+
+	s.Misbehaving("localhost:3000", banThreshold, "test")
+	s.Misbehaving("localhost:3001", banThreshold, "test")
+	if s.isBanned("localhost:3000") {
+		t.Error("node banned its own address, which the local command line uses")
+	}
+	if !s.isBanned("localhost:3001") {
+		t.Error("misbehaving peer not banned")
+	}
+	if s.isBanned("localhost:3002") {
+		t.Error("ban spread to another node on the same host")
+	}
+}
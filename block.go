@@ -2,69 +2,75 @@ package main
 
 import (
 	"bytes"
-	"encoding/gob"
+	"crypto/sha256"
 	"fmt"
 	"strconv"
 	"time"
 )
 
-//定义区块结构体
-type Block struct {
+//区块头，区块hash是序列化的区块头做两次sha256，不依赖区块体，
+//所以可以只保存、只同步区块头，轻节点也只需要区块头
+type BlockHeader struct {
 	Version       int32  // 版本号
 	PrevBlockHash []byte // 上一个区块的hash
-	Merkleroot    []byte // merkle根
-	Hash          []byte // 当前区块的hash
+	Merkleroot    []byte // 交易id的merkle根
+	WitnessRoot   []byte // 交易见证hash的merkle根，承诺区块中的签名
 	Time          int32  // 当前区块时间戳
 	Bits          int32  // 难度值
 	Nonce         int32  //随机值
-	Transations   []*Transation
-	Height        int32 //区块高度
-}
-
-//序列化
-func (b *Block) Serialize() []byte {
 
-	var encoded bytes.Buffer
-
-	enc := gob.NewEncoder(&encoded)
-
-	err := enc.Encode(b)
-
-	checkErr(err)
+	Hash   []byte // 当前区块的hash，由以上字段计算，不参与序列化
+	Height int32  // 区块高度，不参与序列化与hash，由前一个区块头推出
+}
 
-	return encoded.Bytes()
+//定义区块结构体：区块头与交易
+type Block struct {
+	BlockHeader
+	Transations []*Transation
+}
 
+//序列化，编码格式见encoding.go
+func (b *Block) Serialize() []byte {
+	var e encoder
+	e.writeHeader(&b.BlockHeader)
+	e.writeBody(b.Transations)
+	return e.Bytes()
 }
 
 //反序列化
 func DeserializeBlock(d []byte) *Block {
-	var block Block
-
-	decode := gob.NewDecoder(bytes.NewReader(d))
-	err := decode.Decode(&block)
+	block, err := ParseBlock(d)
 	checkErr(err)
-	return &block
+	return block
+}
+
+//反序列化来自其他节点的数据，出错时返回错误而不是panic。高度不在编码中，由调用方设置
+func ParseBlock(d []byte) (*Block, error) {
+	dec := decoder{data: d}
+	block := &Block{BlockHeader: *dec.readHeader()}
+	block.Transations = dec.readBody()
+	if err := dec.finish(); err != nil {
+		return nil, fmt.Errorf("malformed block: %s", err)
+	}
+	return block, nil
 }
 
 //根据前一个hash增加区块
 func NewBlock(transations []*Transation, prevBlockHash []byte, height int32) *Block {
-
 	block := &Block{
-		2,
-		prevBlockHash,
-		[]byte{}, // TODO 根据交易的哈希来生成
-
-		[]byte{}, // 挖矿的时候产生
-		int32(time.Now().Unix()),
-		404454260,	// 实际比特币当中的难度会实时变化
-		0,
+		BlockHeader{
+			Version:       2,
+			PrevBlockHash: prevBlockHash,
+			Time:          int32(time.Now().Unix()),
+			Bits:          404454260, // 实际比特币当中的难度会实时变化
+			Height:        height,
+		},
 		transations,
-		height,
 	}
 
 	block.createMerkelTreeRoot(transations)
 
-	pow := NewProofofWork(block)
+	pow := NewProofofWork(&block.BlockHeader)
 
 	nonce, hash := pow.Run()
 
@@ -76,29 +82,7 @@ func NewBlock(transations []*Transation, prevBlockHash []byte, height int32) *Bl
 
 //创世区块
 func NewGensisBlock(transations []*Transation) *Block {
-	block := &Block{
-		2,
-		[]byte{},
-		[]byte{},
-		[]byte{},
-		int32(time.Now().Unix()),
-		404454260,
-		0,
-		transations,
-		0,
-	}
-
-	block.createMerkelTreeRoot(transations)
-
-	pow := NewProofofWork(block)
-
-	nonce, hash := pow.Run()
-
-	block.Nonce = nonce
-	block.Hash = hash
-
-	//block.String()
-	return block
+	return NewBlock(transations, []byte{}, 0)
 }
 
 //打印区块
@@ -106,6 +90,7 @@ func (b *Block) String() {
 	fmt.Printf("version:%s\n", strconv.FormatInt(int64(b.Version), 10))
 	fmt.Printf("Prev.BlockHash:%x\n", b.PrevBlockHash)
 	fmt.Printf("Prev.merkleroot:%x\n", b.Merkleroot)
+	fmt.Printf("witnessroot:%x\n", b.WitnessRoot)
 	fmt.Printf("cur.Hash:%x\n", b.Hash)
 	fmt.Printf("Time:%s\n", strconv.FormatInt(int64(b.Time), 10))
 	fmt.Printf("Bits:%s\n", strconv.FormatInt(int64(b.Bits), 10))
@@ -131,15 +116,99 @@ func (b *Block) String() {
 //	deBlock.String()
 //}
 
-func (b *Block) createMerkelTreeRoot(transations []*Transation) {
+//提取区块头
+func (b *Block) Header() *BlockHeader {
+	h := b.BlockHeader
+	return &h
+}
+
+//验证区块头的工作量证明
+func (h *BlockHeader) Validate() bool {
+	pow := NewProofofWork(h)
+
+	return pow.Validate()
+}
+
+//区块hash：序列化的区块头做两次sha256
+func (h *BlockHeader) computeHash() []byte {
+	first := sha256.Sum256(h.Serialize())
+	hash := sha256.Sum256(first[:])
+	return hash[:]
+}
+
+//序列化区块头
+func (h *BlockHeader) Serialize() []byte {
+	var e encoder
+	e.writeHeader(h)
+	return e.Bytes()
+}
+
+//反序列化来自其他节点的区块头，高度由调用方根据前一个区块头设置
+func ParseHeader(d []byte) (*BlockHeader, error) {
+	dec := decoder{data: d}
+	header := dec.readHeader()
+	if err := dec.finish(); err != nil {
+		return nil, fmt.Errorf("malformed header: %s", err)
+	}
+	return header, nil
+}
+
+//数据库中保存的区块头，带有高度
+func (h *BlockHeader) serializeWithHeight() []byte {
+	var e encoder
+	e.writeHeader(h)
+	e.writeInt32(h.Height)
+	return e.Bytes()
+}
+
+func deserializeHeaderWithHeight(d []byte) *BlockHeader {
+	dec := decoder{data: d}
+	header := dec.readHeader()
+	header.Height = dec.readInt32()
+	checkErr(dec.finish())
+	return header
+}
+
+//为区块中交易id为txID的交易生成默克尔证明
+func (b *Block) MerkleProof(txID []byte) (*MerkleProof, error) {
 	var tranHash [][]byte
+	index := -1
+
+	for i, tx := range b.Transations {
+		if bytes.Equal(tx.ID, txID) {
+			index = i
+		}
+		tranHash = append(tranHash, tx.ID)
+	}
+	if index < 0 {
+		return nil, fmt.Errorf("transation %x not in block %x", txID, b.Hash)
+	}
+
+	return NewMerkleProof(tranHash, index), nil
+}
+
+//默克尔根只覆盖交易id，不包含签名；见证默克尔根覆盖包括签名在内的见证hash
+func merkleRoots(transations []*Transation) ([]byte, []byte) {
+	var tranHash, witnessHash [][]byte
 
 	for _, tx := range transations {
+		tranHash = append(tranHash, tx.unsignedHash())
+		witnessHash = append(witnessHash, tx.WitnessHash())
+	}
 
-		tranHash = append(tranHash, tx.Hash())
+	return NewMerkleTree(tranHash).RootNode.Data, NewMerkleTree(witnessHash).RootNode.Data
+}
+
+//检查区块中的交易是否与区块头中的merkle根以及见证merkle根一致
+func (b *Block) ValidateMerkleRoot() bool {
+	if len(b.Transations) == 0 {
+		return false
 	}
+	root, witnessRoot := merkleRoots(b.Transations)
 
-	mTree := NewMerkleTree(tranHash)
+	return bytes.Equal(root, b.Merkleroot) && bytes.Equal(witnessRoot, b.WitnessRoot)
+}
 
-	b.Merkleroot = mTree.RootNode.Data
+func (b *Block) createMerkelTreeRoot(transations []*Transation) {
+	b.Merkleroot, b.WitnessRoot = merkleRoots(transations)
 }
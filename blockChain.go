@@ -8,14 +8,17 @@ import (
 	"fmt"
 	"github.com/boltdb/bolt"
 	"log"
+	"sync"
 )
 
 const dbFile = "blockchain.db"
-const blockBucket = "blocks"
+const blockBucket = "blocks"   // 区块体，以及最新区块的hash与数据库的版本
+const headerBucket = "headers" // 区块头与高度
 const genesisData = "ruok"
 
 type Blockchain struct {
-	tip []byte //最近的一个区块的hash值
+	mu  sync.RWMutex // 保护tip，节点的多个连接会同时读写
+	tip []byte       //最近的一个区块的hash值
 	db  *bolt.DB
 }
 
@@ -25,34 +28,28 @@ type BlockChainIterateor struct {
 }
 
 func (bc *Blockchain) MineBlock(transations []*Transation) *Block {
-	for _, tx := range transations {
-		if bc.VerifyTransation(tx) != true {
-			log.Panic("error:invalid transation")
-		} else {
-			fmt.Println("verify success")
-		}
-	}
-
 	var lasthash []byte
 	var lastheight int32
 	err := bc.db.View(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blockBucket))
-		lasthash = b.Get([]byte("l"))
-		blockdata := b.Get([]byte(lasthash))
-
-		block := DeserializeBlock(blockdata)
-
-		lastheight = block.Height
+		// bolt返回的切片只在事务中有效，事务结束后内存映射可能被重新映射
+		lasthash = append([]byte{}, b.Get([]byte("l"))...)
+		lastheight = getHeader(tx, lasthash).Height
 		return nil
 	})
 
 	checkErr(err)
 
+	// 与收到的区块使用同样的检查，挖矿之前就发现无效的交易
+	if err := bc.validateTransations(transations, lastheight+1, lasthash); err != nil {
+		log.Panic(err)
+	}
+
 	newBlock := NewBlock(transations, lasthash, lastheight+1)
 
 	err=bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blockBucket))
-		err := b.Put(newBlock.Hash, newBlock.Serialize())
+		err := putBlock(tx, newBlock)
 
 		checkErr(err)
 
@@ -60,7 +57,7 @@ func (bc *Blockchain) MineBlock(transations []*Transation) *Block {
 
 		checkErr(err)
 
-		bc.tip = newBlock.Hash
+		bc.setTip(newBlock.Hash)
 		return nil
 	})
 	checkErr(err)
@@ -68,13 +65,21 @@ func (bc *Blockchain) MineBlock(transations []*Transation) *Block {
 	return newBlock
 }
 
-//TODO 拆分成两个函数
 // 新建区块链，并且将区块链持久化
 func NewBlockchain(address string) *Blockchain {
+	return OpenBlockchain(dbFile, func() *Block {
+		transation := NewCoinbaseTX(address, genesisData)
+		return NewGensisBlock([]*Transation{transation})
+	})
+}
+
+// 打开file中的区块链，数据库中还没有区块链时，用genesis生成的创世区块创建
+func OpenBlockchain(file string, genesis func() *Block) *Blockchain {
 	var tip []byte
-	db, err := bolt.Open(dbFile, 0600, nil)
+	db, err := bolt.Open(file, 0600, nil)
 
 	checkErr(err)
+	migrateChain(db)
 
 	err = db.Update(func(tx *bolt.Tx) error {
 
@@ -83,21 +88,24 @@ func NewBlockchain(address string) *Blockchain {
 		if b == nil {
 
 			fmt.Println("区块链不存在，创建一个新的区块链")
-			transation := NewCoinbaseTX(address, genesisData)
-			genesis := NewGensisBlock([]*Transation{transation})
+			genesis := genesis()
 			b, err := tx.CreateBucket([]byte(blockBucket))
-
+			checkErr(err)
+			_, err = tx.CreateBucket([]byte(headerBucket))
 			checkErr(err)
 
-			err = b.Put(genesis.Hash, genesis.Serialize())
+			err = putBlock(tx, genesis)
 
 			checkErr(err)
 
 			err = b.Put([]byte("l"), genesis.Hash)
+			checkErr(err)
+			err = b.Put(storageVersionKey, []byte{storageVersion})
+			checkErr(err)
 			tip = genesis.Hash
 
 		} else {
-			tip = b.Get([]byte("l"))
+			tip = append([]byte{}, b.Get([]byte("l"))...)
 		}
 
 		return nil
@@ -105,7 +113,7 @@ func NewBlockchain(address string) *Blockchain {
 
 	checkErr(err)
 
-	bc := Blockchain{tip, db}
+	bc := Blockchain{tip: tip, db: db}
 
 	set := UTXOSet{&bc}
 	// 将所有UTXO找到并且持久化
@@ -114,9 +122,30 @@ func NewBlockchain(address string) *Blockchain {
 	return &bc
 }
 
+// 最新区块的hash
+func (bc *Blockchain) Tip() []byte {
+	bc.mu.RLock()
+	defer bc.mu.RUnlock()
+
+	return bc.tip
+}
+
+func (bc *Blockchain) setTip(hash []byte) {
+	bc.mu.Lock()
+	defer bc.mu.Unlock()
+
+	bc.tip = hash
+}
+
+// 关闭数据库
+func (bc *Blockchain) Close() {
+	err := bc.db.Close()
+	checkErr(err)
+}
+
 func (bc *Blockchain) iterator() *BlockChainIterateor {
 
-	bci := &BlockChainIterateor{bc.tip, bc.db}
+	bci := &BlockChainIterateor{bc.Tip(), bc.db}
 
 	return bci
 }
@@ -126,9 +155,7 @@ func (i *BlockChainIterateor) Next() *Block {
 	var block *Block
 
 	err := i.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blockBucket))
-		deblock := b.Get(i.currenthash)
-		block = DeserializeBlock(deblock)
+		block = getBlock(tx, i.currenthash)
 		return nil
 	})
 
@@ -182,19 +209,68 @@ func (bc *Blockchain) FindTransationById(ID []byte) (Transation, error) {
 	return Transation{}, errors.New("transation not found")
 }
 
-func (bc *Blockchain) VerifyTransation(tx *Transation) bool {
-	prevTXs := make(map[string]Transation)	// 键-交易id   值- 交易
+// 验证交易的解锁脚本与金额，引用的输出不在主链的UTXO中时返回错误
+func (bc *Blockchain) VerifyTransation(tx *Transation) error {
+	view, err := bc.utxoViewAt(bc.Tip())
+	if err != nil {
+		return err
+	}
+	_, err = view.verifyTransation(tx)
+	return err
+}
 
-	// 遍历该笔交易的所有输入
-	for _, vin := range tx.Vin {
-		// 找到该笔输入引用的交易
-		prevTX, err := bc.FindTransationById(vin.TXid)
+// 检查区块能否作为第height个区块连接到它的前一个区块之后。
+// 同步下载的区块、其他节点广播的区块与本地挖出的区块都经过这里的检查
+func (bc *Blockchain) ValidateBlock(block *Block, height int32) error {
+	if !block.ValidateMerkleRoot() {
+		return errors.New("bad merkle root")
+	}
+	return bc.validateTransations(block.Transations, height, block.PrevBlockHash)
+}
 
-		checkErr(err)
+// 按前一个区块之后的UTXO视图检查区块中的交易：引用的输出存在并且没有被花费、脚本（包括低s签名）与金额、
+// 锁定时间与数据输出。交易可以花费同一个区块中排在它前面的交易的输出。
+// coinbase交易只能是第一笔交易，输出总额不能超过区块奖励加上手续费；
+// 区块中也可以没有coinbase交易（send命令直接挖出的区块没有奖励）
+func (bc *Blockchain) validateTransations(txs []*Transation, height int32, prevHash []byte) error {
+	view, err := bc.utxoViewAt(prevHash)
+	if err != nil {
+		return err
+	}
 
-		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	fees := 0
+	for i, tx := range txs {
+		if tx.IsCoinBase() && i != 0 {
+			return fmt.Errorf("transation %x: coinbase is not the first transation", tx.ID)
+		}
+		fee, err := view.verifyTransation(tx)
+		if err != nil {
+			return fmt.Errorf("transation %x: %s", tx.ID, err)
+		}
+		fees += fee
+		if err := tx.checkDataOutputs(); err != nil {
+			return fmt.Errorf("transation %x: %s", tx.ID, err)
+		}
+		if err := bc.checkLockTimes(tx, height, prevHash, view); err != nil {
+			return err
+		}
+		view.spend(tx)
+		view.add(tx, height, prevHash, 0)
 	}
-	return tx.Verify(prevTXs)
+
+	if len(txs) > 0 && txs[0].IsCoinBase() {
+		reward := 0
+		for _, out := range txs[0].Vout {
+			if out.Value < 0 {
+				return fmt.Errorf("coinbase %x has a negative output", txs[0].ID)
+			}
+			reward += out.Value
+		}
+		if reward > subsidy+fees {
+			return fmt.Errorf("coinbase %x pays %d, more than subsidy %d plus fees %d", txs[0].ID, reward, subsidy, fees)
+		}
+	}
+	return nil
 }
 
 //	返回所有utxo（未花费输出）
@@ -225,6 +301,10 @@ func (bc *Blockchain) FindAllUTXO() map[string]TXOutputs {
 					}
 
 				}
+				// 数据输出永远不能花费，不算作未花费输出
+				if isUnspendable(out.ScriptPubKey) {
+					continue
+				}
 				out.index=outIdx	// 记录这笔输出的所在其交易当中的索引
 				outs := UTXO[txID]
 				outs.Outputs = append(outs.Outputs, out)
@@ -244,38 +324,106 @@ func (bc *Blockchain) FindAllUTXO() map[string]TXOutputs {
 	}
 	return UTXO
 }
+
+// 返回链上所有输出支付过的公钥哈希，键为公钥哈希的十六进制
+func (bc *Blockchain) UsedPubkeyHashes() map[string]bool {
+	used := make(map[string]bool)
+
+	bci := bc.iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transations {
+			for _, out := range tx.Vout {
+				if pubkeyHash := out.pubkeyHash(); pubkeyHash != nil {
+					used[hex.EncodeToString(pubkeyHash)] = true
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	return used
+}
+
 // 获取区块链的最高高度
 func (bc *Blockchain) GetBestHeight() int32 {
-	var lastBlock Block
+	header, err := bc.GetHeader(bc.Tip())
+	checkErr(err)
+
+	return header.Height
+}
+
+// 获取主链中所有区块的区块哈希，从最新区块到创世区块，只读取区块头
+func (bc *Blockchain) getblockhash() [][]byte {
+	return bc.getblockhashFrom(bc.Tip())
+}
+
+// 从tip到创世区块的所有区块哈希，tip可以是分叉上的区块，不在数据库中时返回空
+func (bc *Blockchain) getblockhashFrom(tip []byte) [][]byte {
+	var blocks [][]byte
 
 	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blockBucket))
-		lastHash := b.Get([]byte("l"))
-		blockdata := b.Get(lastHash)
-		lastBlock = *DeserializeBlock(blockdata)
+		for hash := tip; len(hash) != 0; {
+			header := getHeader(tx, hash)
+			if header == nil {
+				break
+			}
+			blocks = append(blocks, header.Hash)
+			hash = header.PrevBlockHash
+		}
 		return nil
 	})
 	checkErr(err)
-
-	return lastBlock.Height
+	return blocks
 }
 
-// 获取区块链中所有区块的区块哈希
-func (bc *Blockchain) getblockhash() [][]byte {
-	var blocks [][]byte
+// 区块头与区块体分开保存，只需要区块头时不用读取和解码交易
+func putBlock(tx *bolt.Tx, block *Block) error {
+	err := tx.Bucket([]byte(headerBucket)).Put(block.Hash, block.serializeWithHeight())
+	if err != nil {
+		return err
+	}
+	var body encoder
+	body.writeBody(block.Transations)
+	return tx.Bucket([]byte(blockBucket)).Put(block.Hash, body.Bytes())
+}
 
-	bci := bc.iterator()
+// 数据库中的区块头，不存在时返回nil
+func getHeader(tx *bolt.Tx, hash []byte) *BlockHeader {
+	data := tx.Bucket([]byte(headerBucket)).Get(hash)
+	if data == nil {
+		return nil
+	}
+	return deserializeHeaderWithHeight(data)
+}
 
-	for {
-		block := bci.Next()
+// 数据库中的区块，不存在时返回nil
+func getBlock(tx *bolt.Tx, hash []byte) *Block {
+	header := getHeader(tx, hash)
+	body := tx.Bucket([]byte(blockBucket)).Get(hash)
+	if header == nil || body == nil {
+		return nil
+	}
+	dec := decoder{data: body}
+	block := &Block{*header, dec.readBody()}
+	checkErr(dec.finish())
+	return block
+}
 
-		blocks = append(blocks, block.Hash)
+// 根据blockhash获取区块头
+func (bc *Blockchain) GetHeader(blockHash []byte) (*BlockHeader, error) {
+	var header *BlockHeader
 
-		if len(block.PrevBlockHash) == 0 {
-			break
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		header = getHeader(tx, blockHash)
+		if header == nil {
+			return errors.New("Block is not Fund ")
 		}
-	}
-	return blocks
+		return nil
+	})
+
+	return header, err
 }
 
 // 根据blockhash获取区块
@@ -283,24 +431,109 @@ func (bc *Blockchain) GetBlock(blockHash []byte) (Block, error) {
 	var block Block
 
 	err := bc.db.View(func(tx *bolt.Tx) error {
-		b := tx.Bucket([]byte(blockBucket))
-		blockData := b.Get(blockHash)
-
-		if blockData == nil {
+		b := getBlock(tx, blockHash)
+		if b == nil {
 			return errors.New("Block is not Fund ")
 		}
 
-		block = *DeserializeBlock(blockData)
+		block = *b
 		return nil
 	})
 
+	return block, err
+}
+
+// 数据库中是否已经存在该区块
+func (bc *Blockchain) HasBlock(blockHash []byte) bool {
+	var exist bool
+
+	err := bc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blockBucket))
+		exist = b.Get(blockHash) != nil
+		return nil
+	})
 	checkErr(err)
-	return block, nil
+
+	return exist
+}
+
+// 生成区块定位器，chain是从最新区块到创世区块排列的区块哈希。
+// 最近的10个区块逐个记录，之后步长每次翻倍，最后总是包含创世区块
+func buildLocator(chain [][]byte) [][]byte {
+	var locator [][]byte
+
+	step := 1
+	for i := 0; i < len(chain); i += step {
+		locator = append(locator, chain[i])
+
+		if len(locator) >= 10 {
+			step *= 2
+		}
+	}
+
+	genesis := chain[len(chain)-1]
+	if bytes.Compare(locator[len(locator)-1], genesis) != 0 {
+		locator = append(locator, genesis)
+	}
+	return locator
+}
+
+// 获取本地主链的区块定位器
+func (bc *Blockchain) GetBlockLocator() [][]byte {
+	return buildLocator(bc.getblockhash())
 }
 
-//	向区块链中添加区块
-func (bc *Blockchain) AddBlock(block *Block) {
-	err := bc.db.Update(func(tx *bolt.Tx) error {
+// 根据对方的区块定位器找到双方共同的主链区块，返回其后最多max个区块头，遇到hashStop时停止
+func (bc *Blockchain) GetHeadersAfter(locator [][]byte, hashStop []byte, max int) []*BlockHeader {
+	var headers []*BlockHeader
+
+	chain := bc.getblockhash()
+	ReverseHashes(chain) // 创世区块在前
+
+	position := make(map[string]int) // 键-区块哈希 值-在主链中的位置
+	for i, hash := range chain {
+		position[hex.EncodeToString(hash)] = i
+	}
+
+	// 没有任何共同区块时，从创世区块之后开始；定位器为空时（还没有任何区块头的轻节点）从创世区块开始
+	start := 1
+	if len(locator) == 0 {
+		start = 0
+	}
+	for _, hash := range locator {
+		if i, ok := position[hex.EncodeToString(hash)]; ok {
+			start = i + 1
+			break
+		}
+	}
+
+	for i := start; i < len(chain) && len(headers) < max; i++ {
+		header, err := bc.GetHeader(chain[i])
+		checkErr(err)
+		headers = append(headers, header)
+
+		if bytes.Compare(chain[i], hashStop) == 0 {
+			break
+		}
+	}
+	return headers
+}
+
+//	向区块链中添加区块，区块必须连接到已知的区块并通过ValidateBlock的检查
+func (bc *Blockchain) AddBlock(block *Block) error {
+	if bc.HasBlock(block.Hash) {
+		return nil
+	}
+	prev, err := bc.GetHeader(block.PrevBlockHash)
+	if err != nil {
+		return fmt.Errorf("previous block %x not found", block.PrevBlockHash)
+	}
+	block.Height = prev.Height + 1
+	if err := bc.ValidateBlock(block, block.Height); err != nil {
+		return err
+	}
+
+	err = bc.db.Update(func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(blockBucket))
 		blockIndb := b.Get(block.Hash)
 		// 如果数据库当中已经存在该区块，怎不继续存储
@@ -308,45 +541,38 @@ func (bc *Blockchain) AddBlock(block *Block) {
 			return nil
 		}
 
-		blockData := block.Serialize()
-		err := b.Put(block.Hash, blockData)
+		err := putBlock(tx, block)
 		checkErr(err)
 		lastHash := b.Get([]byte("l"))
-		lastBlockdata := b.Get(lastHash)
-		lastblock := DeserializeBlock(lastBlockdata)
+		lastblock := getHeader(tx, lastHash)
 
 		// 如果想要添加的区块高度比数据库中存储的最近一个区块的高度高，增进行更新
 		if block.Height > lastblock.Height {
 			err = b.Put([]byte("l"), block.Hash)
 			checkErr(err)
-			bc.tip = block.Hash
+			bc.setTip(block.Hash)
 		}
 		return nil
 	})
 	checkErr(err)
+	return nil
 }
 
-//	找出pubkeyhash的尽可能满足金额amount的utxo，返回值是utxo总金额、[交易id]utxo的索引的映射
-func (bc *Blockchain) FindSpendableOutputs(pubkeyhash []byte, amount int) (int, map[string][]int) {
-	unspentOutputs := make(map[string][]int)
-
-	UTXOMap:=bc.FindAllUTXO()	// 键 - txid 值 - utxo的在其交易中的索引
+// 返回锁定脚本为script的所有可以花费的输出，由选币策略决定花费哪些。尚未成熟的coinbase输出不返回
+func (bc *Blockchain) FindCoins(script []byte) []Coin {
+	var coins []Coin
 
-	accumulated := 0
+	view, err := bc.utxoViewAt(bc.Tip())
+	checkErr(err)
+	tipHeight := bc.GetBestHeight()
 
-	for txid,outs:=range UTXOMap{
-		for _,out:=range outs.Outputs{
-			if out.CanBeUnlockedWith(pubkeyhash) && accumulated < amount{
-				accumulated += out.Value
-				unspentOutputs[txid] = append(unspentOutputs[txid], out.index)
-				if accumulated >= amount {
-					return accumulated, unspentOutputs
-				}
-			}
+	for _, entry := range view.entries {
+		if !bytes.Equal(entry.out.ScriptPubKey, script) || isImmature(entry.coinbase, entry.height, tipHeight) {
+			continue
 		}
+		coins = append(coins, Coin{entry.txID, entry.out.index, entry.out.Value})
 	}
-
-	return accumulated, unspentOutputs
+	return coins
 }
 
 
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/hex"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// 花费prev的第index个输出，付给to value，剩下的作为手续费
+func testSpend(w *Wallet, prev *Transation, index int, to string, value int) *Transation {
+	tx := &Transation{nil, []TXInput{{prev.ID, index, nil, 0}}, []TXOutput{*NewTXOutput(value, to)}, 0}
+	tx.ID = tx.unsignedHash()
+	tx.Sign(w.PrivateKey, map[string]Transation{hex.EncodeToString(prev.ID): *prev})
+	return tx
+}
+
+func testCoinbase(to, data string, value int) *Transation {
+	tx := NewCoinbaseTX(to, data)
+	tx.Vout[0].Value = value
+	tx.ID = tx.unsignedHash()
+	return tx
+}
+
+func TestValidateBlockUTXOView(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	genesisTx := NewCoinbaseTX(addr, genesisData)
+	genesis := NewGensisBlock([]*Transation{genesisTx})
+	bc := OpenBlockchain(filepath.Join(t.TempDir(), "chain.db"), func() *Block { return genesis })
+	defer bc.Close()
+
+	// 主链：创世区块 <- main1，main1花费创世区块的输出；分叉：创世区块 <- fork1 <- fork2
+	mainSpend := testSpend(w, genesisTx, 0, addr, 90)
+	main1 := NewBlock([]*Transation{mainSpend}, genesis.Hash, 1)
+	if err := bc.AddBlock(main1); err != nil {
+		t.Fatal(err)
+	}
+	forkSpend := testSpend(w, genesisTx, 0, addr, 80)
+	fork1 := NewBlock([]*Transation{forkSpend}, genesis.Hash, 1)
+	if err := bc.AddBlock(fork1); err != nil {
+		t.Fatalf("fork spends an output spent on the main chain: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		prev *Block
+		txs  []*Transation
+		err  string // 为空时区块有效
+	}{
+		{"fork spends a fork-only output", fork1, []*Transation{testSpend(w, forkSpend, 0, addr, 70)}, ""},
+		{"main chain spends a fork-only output", main1, []*Transation{testSpend(w, forkSpend, 0, addr, 70)}, "missing or already spent"},
+		{"spent output", main1, []*Transation{testSpend(w, genesisTx, 0, addr, 70)}, "missing or already spent"},
+		{"double spend in a block", main1, []*Transation{testSpend(w, mainSpend, 0, addr, 70), testSpend(w, mainSpend, 0, addr, 60)}, "missing or already spent"},
+		{"coinbase not first", main1, []*Transation{testSpend(w, mainSpend, 0, addr, 70), testCoinbase(addr, "a", subsidy)}, "not the first"},
+		{"two coinbases", main1, []*Transation{testCoinbase(addr, "b", subsidy), testCoinbase(addr, "c", subsidy)}, "not the first"},
+		{"coinbase above subsidy", main1, []*Transation{testCoinbase(addr, "d", subsidy+1)}, "more than subsidy"},
+		{"coinbase above subsidy plus fees", main1, []*Transation{testCoinbase(addr, "e", subsidy+21), testSpend(w, mainSpend, 0, addr, 70)}, "more than subsidy"},
+		{"coinbase with fees", main1, []*Transation{testCoinbase(addr, "f", subsidy+20), testSpend(w, mainSpend, 0, addr, 70)}, ""},
+	}
+	for _, test := range tests {
+		block := NewBlock(test.txs, test.prev.Hash, test.prev.Height+1)
+		err := bc.AddBlock(block)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		case test.err != "" && bc.HasBlock(block.Hash):
+			t.Errorf("%s: invalid block stored", test.name)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"math"
+)
+
+// BIP37风格的布隆过滤器：轻节点把自己关心的公钥哈希放进过滤器交给全节点，
+// 全节点只返回命中过滤器的交易，轻节点可以通过提高误报率来隐藏真正关心的地址
+
+const maxFilterSize = 36000 // 过滤器最大字节数
+
+const maxHashFuncs = 50
+
+const maxFilterAddSize = 520 // filteradd中单个元素的最大字节数
+
+const ln2Squared = math.Ln2 * math.Ln2
+
+type BloomFilter struct {
+	Filter    []byte
+	HashFuncs uint32
+	Tweak     uint32 // 随机数，使不同轻节点的过滤器即使元素相同也不一样
+}
+
+type filterload struct {
+	AddrFrom string
+	Filter   BloomFilter
+}
+
+type filteradd struct {
+	AddrFrom string
+	Data     []byte
+}
+
+type filterclear struct {
+	AddrFrom string
+}
+
+// 根据元素个数与期望的误报率计算过滤器大小与哈希函数个数
+func NewBloomFilter(elements int, fpRate float64, tweak uint32) *BloomFilter {
+	if elements < 1 {
+		elements = 1
+	}
+	size := int(-1 / ln2Squared * float64(elements) * math.Log(fpRate) / 8)
+	if size < 1 {
+		size = 1
+	}
+	if size > maxFilterSize {
+		size = maxFilterSize
+	}
+
+	hashFuncs := uint32(float64(size*8) / float64(elements) * math.Ln2)
+	if hashFuncs < 1 {
+		hashFuncs = 1
+	}
+	if hashFuncs > maxHashFuncs {
+		hashFuncs = maxHashFuncs
+	}
+
+	return &BloomFilter{make([]byte, size), hashFuncs, tweak}
+}
+
+// 第n个哈希函数对应的位
+func (f *BloomFilter) bit(n uint32, data []byte) uint32 {
+	seed := n*0xFBA4C795 + f.Tweak
+	return murmur3(seed, data) % uint32(len(f.Filter)*8)
+}
+
+func (f *BloomFilter) Add(data []byte) {
+	if len(f.Filter) == 0 {
+		return
+	}
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		idx := f.bit(i, data)
+		f.Filter[idx>>3] |= 1 << (idx & 7)
+	}
+}
+
+func (f *BloomFilter) Contains(data []byte) bool {
+	if len(f.Filter) == 0 {
+		return false
+	}
+	for i := uint32(0); i < f.HashFuncs; i++ {
+		idx := f.bit(i, data)
+		if f.Filter[idx>>3]&(1<<(idx&7)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 输出的标识：交易id加上输出索引
+func outpoint(txID []byte, index int) []byte {
+	var idx [4]byte
+	binary.LittleEndian.PutUint32(idx[:], uint32(index))
+	return append(append([]byte{}, txID...), idx[:]...)
+}
+
+// 交易是否命中过滤器：交易id、输出锁定脚本中的数据（如公钥哈希）、输入引用的输出或解锁脚本中的数据（如公钥）。
+// 命中的输出会被加入过滤器，这样以后花费它的交易也能被匹配到
+func (f *BloomFilter) MatchTxAndUpdate(tx *Transation) bool {
+	matched := f.Contains(tx.ID)
+
+	for i, out := range tx.Vout {
+		for _, data := range scriptPushes(out.ScriptPubKey) {
+			if f.Contains(data) {
+				matched = true
+				f.Add(outpoint(tx.ID, i))
+				break
+			}
+		}
+	}
+	if matched || tx.IsCoinBase() {
+		return matched
+	}
+
+	for _, in := range tx.Vin {
+		if f.Contains(outpoint(in.TXid, in.Voutindex)) {
+			return true
+		}
+		for _, data := range scriptPushes(in.ScriptSig) {
+			if f.Contains(data) || f.Contains(HashPubKey(data)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// MurmurHash3 (x86_32)
+func murmur3(seed uint32, data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+
+	h := seed
+	n := len(data) / 4
+	for i := 0; i < n; i++ {
+		k := binary.LittleEndian.Uint32(data[i*4:])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+
+	var k uint32
+	tail := data[n*4:]
+	switch len(tail) {
+	case 3:
+		k ^= uint32(tail[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(tail[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(tail[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+
+	h ^= uint32(len(data))
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
+
+// 过滤器记在连接确认过的身份peer上（见peerKey），其他节点不能冒充轻节点的AddrFrom替换或清除它的过滤器
+func (s *Server) handleFilterLoad(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload filterload
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed filterload: %s", err)
+	}
+
+	filter := payload.Filter
+	if len(filter.Filter) > maxFilterSize || filter.HashFuncs > maxHashFuncs {
+		return misbehave(scoreFilterMisuse, "filter with %d bytes and %d hash functions", len(filter.Filter), filter.HashFuncs)
+	}
+
+	s.filtersMu.Lock()
+	s.filters[peer] = &filter
+	s.filtersMu.Unlock()
+	return nil
+}
+
+func (s *Server) handleFilterAdd(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload filteradd
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed filteradd: %s", err)
+	}
+	if len(payload.Data) > maxFilterAddSize {
+		return misbehave(scoreFilterMisuse, "filteradd with %d bytes", len(payload.Data))
+	}
+
+	s.filtersMu.Lock()
+	defer s.filtersMu.Unlock()
+
+	filter := s.filters[peer]
+	if filter == nil {
+		return misbehave(scoreFilterMisuse, "filteradd without filterload")
+	}
+	filter.Add(payload.Data)
+	return nil
+}
+
+func (s *Server) handleFilterClear(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload filterclear
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed filterclear: %s", err)
+	}
+
+	s.filtersMu.Lock()
+	delete(s.filters, peer)
+	s.filtersMu.Unlock()
+	return nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import "testing"
+
+func TestFiltersKeyedOnConnection(t *testing.T) {
+	s := NewServer("sim:0", "", nil, nil, nil)
+	load := append(commandToBytes("filterload"), gobEncode(filterload{"sim:1", *NewBloomFilter(1, 0.01, 0)})...)
+	if err := s.handleFilterLoad(load, "sim:1"); err != nil {
+		t.Fatal(err)
+	}
+
+	// 其他连接在消息中冒充sim:1
+	clearReq := append(commandToBytes("filterclear"), gobEncode(filterclear{"sim:1"})...)
+	if err := s.handleFilterClear(clearReq, "sim:2"); err != nil {
+		t.Fatal(err)
+	}
+	add := append(commandToBytes("filteradd"), gobEncode(filteradd{"sim:1", []byte("x")})...)
+	if err := s.handleFilterAdd(add, "sim:2"); err == nil {
+		t.Fatal("filteradd from a connection without a filter accepted")
+	}
+	if s.filters["sim:1"] == nil {
+		t.Fatal("another connection cleared the filter")
+	}
+
+	if err := s.handleFilterAdd(add, "sim:1"); err != nil {
+		t.Fatal(err)
+	}
+	if !s.filters["sim:1"].Contains([]byte("x")) {
+		t.Fatal("filteradd did not reach the filter")
+	}
+}
@@ -1,79 +1,1096 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
+	"strings"
+	"time"
 )
 
+const genesisAddress = "1NpxpZkBYd3uYJGMcpzFs6q65WPrr1cDaM"
+
 type CLI struct {
 	bc *Blockchain
 }
 
+// 第一次用到时才打开区块链，轻节点的命令不需要blockchain.db
+func (cli *CLI) blockchain() *Blockchain {
+	if cli.bc == nil {
+		cli.bc = NewBlockchain(genesisAddress)
+	}
+	return cli.bc
+}
+
 func (cli *CLI) addBlock() {
-	cli.bc.MineBlock([]*Transation{})
+	cli.blockchain().MineBlock([]*Transation{})
+}
+
+func (cli *CLI) validateArgs() {
+	if len(os.Args) < 1 {
+		fmt.Println("参数小于1")
+		os.Exit(1)
+	}
+	fmt.Println(os.Args)
+}
+func (cli *CLI) printChain() {
+	cli.blockchain().printBlockchain()
+}
+
+func (cli *CLI) getBalance(address string) {
+
+	balance := 0
+	script, err := addressToScript(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	set := UTXOSet{cli.blockchain()}
+	UTXOs := set.FindUTXOByScript(script)
+	//UTXOs := cli.bc.FindUTXO(pubkeyHash)
+
+	for _, out := range UTXOs {
+		balance += out.Value
+	}
+	fmt.Printf("balance of %s:%d\n", address, balance)
+}
+
+func (cli *CLI) send(nodeID, from string, payments []Payment, coinSelect string, feeRate int, dryRun bool) {
+	wallets, err := NewWallets()
+	checkErr(err)
+	if wallets.WalletsStore[from] == nil {
+		fmt.Printf("no private key for %s in the wallet\n", from)
+		os.Exit(1)
+	}
+
+	selector, err := coinSelectorByName(coinSelect)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 试运行只需要公钥，钱包锁定时也可以查看
+	if dryRun {
+		tx, fee, err := NewPaymentTransation(from, payments, cli.blockchain(), selector, FeePolicy{feeRate})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		cli.printPaymentPlan(tx, fee, from)
+		return
+	}
+
+	if _, err := validatePayments(payments); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	// 钱包在本进程中没有解锁时，交给运行中的节点用它解锁的钱包签名并广播
+	if wallets.IsLocked() {
+		err := sendControlCommand(nodeID, "walletsend", walletsend{from, payments, coinSelect, feeRate})
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("payment sent by node %s with its unlocked wallet\n", nodeID)
+		return
+	}
+
+	tx := NewUTXOTransation(from, payments, cli.blockchain(), selector, FeePolicy{feeRate})
+
+	newblock := cli.blockchain().MineBlock([]*Transation{tx})
+
+	set := UTXOSet{cli.blockchain()}
+
+	set.update(newblock)
+	wallets.TxSet(cli.blockchain()).Sync()
+
+	//cli.getBalance("1NpxpZkBYd3uYJGMcpzFs6q65WPrr1cDaM")
+	//cli.getBalance("1MVh4SCLbdnoXDT1pCmhepJ9ZMSdXTqsrB")
+	fmt.Printf("Success")
+}
+
+// 打印未签名交易的输入、输出与手续费
+func (cli *CLI) printPaymentPlan(tx *Transation, fee int, from string) {
+	coins := make(map[string]int)
+	changeScript, _ := addressToScript(from)
+	for _, coin := range cli.blockchain().FindCoins(changeScript) {
+		coins[fmt.Sprintf("%x:%d", coin.TxID, coin.Index)] = coin.Value
+	}
+
+	fmt.Printf("Inputs (%d):\n", len(tx.Vin))
+	for _, in := range tx.Vin {
+		key := fmt.Sprintf("%x:%d", in.TXid, in.Voutindex)
+		fmt.Printf("  %s  %d\n", key, coins[key])
+	}
+
+	fmt.Printf("Outputs (%d):\n", len(tx.Vout))
+	for i, out := range tx.Vout {
+		note := ""
+		if i == len(tx.Vout)-1 && bytes.Equal(out.ScriptPubKey, changeScript) && i > 0 {
+			note = "  (change)"
+		}
+		fmt.Printf("  %s  %d%s\n", out.address(), out.Value, note)
+	}
+	fmt.Printf("Fee: %d\n", fee)
+	fmt.Println("dry run, transation not signed or sent")
+}
+
+// 在线节点：构造未签名交易，只需要from的公钥，多重签名地址需要它的赎回脚本
+func (cli *CLI) createPSBT(from string, payments []Payment, coinSelect string, feeRate int, lockTime uint, out string) {
+	wallets, err := NewWallets()
+	checkErr(err)
+	redeemScript := wallets.Scripts[from]
+	if redeemScript == nil && wallets.PublicKey(from) == nil {
+		fmt.Printf("no public key for %s in the wallet, use importpubkey, addmultisigaddress or addscript\n", from)
+		os.Exit(1)
+	}
+
+	selector, err := coinSelectorByName(coinSelect)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	ptx, _, err := NewPartialTransation(from, redeemScript, payments, cli.blockchain(), selector, FeePolicy{feeRate})
+	if err == nil && lockTime != 0 {
+		err = ptx.SetLockTime(uint32(lockTime))
+	}
+	if err == nil {
+		err = ptx.WriteFile(out)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(ptx)
+	fmt.Printf("unsigned transation written to %s\n", out)
+}
+
+// 离线机器：核对后用钱包中的私钥以sigHash签名，不需要区块链
+func (cli *CLI) signPSBT(in, out, sigHash string) {
+	ptx, err := ReadPartialTransation(in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	hashType, err := parseSigHashType(sigHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	fmt.Println(ptx)
+	n, err := ptx.SignWithWallet(wallets, hashType)
+	if err == nil {
+		err = ptx.WriteFile(out)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("signed %d of %d inputs, written to %s\n", n, len(ptx.Tx.Vin), out)
+}
+
+func (cli *CLI) combinePSBT(in []string, out string) {
+	var combined *PartialTransation
+	for _, file := range in {
+		ptx, err := ReadPartialTransation(file)
+		if err == nil && combined != nil {
+			err = combined.Combine(ptx)
+		}
+		if err != nil {
+			fmt.Printf("%s: %s\n", file, err)
+			os.Exit(1)
+		}
+		if combined == nil {
+			combined = ptx
+		}
+	}
+
+	err := combined.WriteFile(out)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(combined)
+}
+
+// 发起众筹：构造只有付款输出的交易，出资人用pledge加入输入
+func (cli *CLI) crowdfund(payments []Payment, out string) {
+	ptx, err := NewCrowdfundTransation(payments)
+	if err == nil {
+		err = ptx.WriteFile(out)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(ptx)
+	fmt.Printf("crowdfunding transation written to %s\n", out)
+}
+
+// 出资：把from的输出加入众筹交易，并用ALL|ANYONECANPAY签名
+func (cli *CLI) pledge(in, from string, amount int, coinSelect, out string) {
+	ptx, err := ReadPartialTransation(in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	selector, err := coinSelectorByName(coinSelect)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets, err := NewWallets()
+	checkErr(err)
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+	if wallets.WalletsStore[from] == nil {
+		fmt.Printf("no private key for %s in the wallet\n", from)
+		os.Exit(1)
+	}
+
+	pledged, err := ptx.Pledge(from, amount, cli.blockchain(), selector)
+	if err == nil {
+		_, err = ptx.SignWithWallet(wallets, SIGHASH_ALL|SIGHASH_ANYONECANPAY)
+	}
+	if err == nil {
+		err = ptx.WriteFile(out)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(ptx)
+	fmt.Printf("pledged %d from %s, written to %s\n", pledged, from, out)
+}
+
+// 在线节点：检查签名与引用的输出未被花费，然后发送给node，node为空时直接在本地挖矿确认
+func (cli *CLI) finalizePSBT(nodeID, in, node string) {
+	ptx, err := ReadPartialTransation(in)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tx, err := ptx.Finalize()
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	bc := cli.blockchain()
+	utxo := bc.FindAllUTXO()
+	for i, vin := range tx.Vin {
+		unspent := false
+		for _, out := range utxo[hex.EncodeToString(vin.TXid)].Outputs {
+			if out.index == vin.Voutindex {
+				unspent = true
+			}
+		}
+		if !unspent {
+			fmt.Printf("input %d: output %x:%d is already spent or unknown\n", i, vin.TXid, vin.Voutindex)
+			os.Exit(1)
+		}
+	}
+	if err := bc.VerifyTransation(tx); err != nil {
+		fmt.Printf("invalid transation: %s\n", err)
+		os.Exit(1)
+	}
+	if err := bc.CheckNextBlockLockTimes(tx); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	if node != "" {
+		s := NewServer(fmt.Sprintf("localhost:%s", nodeID), "", bc, tcpTransport{}, nil)
+		s.sendTx(node, tx)
+		fmt.Printf("transation %x sent to %s\n", tx.ID, node)
+		return
+	}
+
+	newblock := bc.MineBlock([]*Transation{tx})
+	set := UTXOSet{bc}
+	set.update(newblock)
+	if wallets, err := NewWallets(); err == nil {
+		wallets.TxSet(bc).Sync()
+	}
+	fmt.Printf("transation %x confirmed\n", tx.ID)
+}
+
+// 合并 -pay、-to/-amount 与 -payfile 指定的付款
+func collectPayments(payments paymentList, to string, amount int, payFile string) []Payment {
+	list := []Payment(payments)
+	if to != "" {
+		list = append(list, Payment{to, amount})
+	}
+	if payFile != "" {
+		filePayments, err := ReadPaymentFile(payFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		list = append(list, filePayments...)
+	}
+	return list
+}
+
+func (cli *CLI) printUsage() {
+	fmt.Println("USages:")
+	fmt.Println("addblock-增加区块:")
+	fmt.Println("printChain:打印区块链")
+	fmt.Println("send -from A -to B -amount N [-coinselect bnb] [-feerate R]:发送，coinselect为选币策略（largest、smallest、bnb、privacy），feerate为每千字节的手续费")
+	fmt.Println("send -from A -pay B:N [-pay C:M ...] [-payfile FILE] [-dryrun]:在一笔交易中向多个地址付款，FILE为 地址,金额 的CSV或JSON，dryrun只打印输入、输出与手续费")
+	fmt.Println("createpsbt -from A -to B -amount N|-pay B:N|-payfile FILE [-locktime N] -out TX:在线节点构造未签名交易，附带引用的交易，只需要A的公钥；locktime为交易的锁定高度或Unix时间")
+	fmt.Println("signpsbt -in TX [-out TX2] [-sighash TYPE]:在离线机器上核对并用钱包中的私钥签名，TYPE为ALL、NONE、SINGLE，可以加上|ANYONECANPAY，默认ALL")
+	fmt.Println("combinepsbt -in TX1,TX2 -out TX:合并多个签名者的签名，或者合并众筹交易的多个出资")
+	fmt.Println("crowdfund -to B -amount N|-pay B:N|-payfile FILE -out TX:发起众筹，构造只有付款输出的交易")
+	fmt.Println("pledge -in TX -from A -amount N [-out TX2]:向众筹交易加入A的输出，用ALL|ANYONECANPAY签名；不能找零，选出的输出全部投入")
+	fmt.Println("finalizepsbt -in TX [-node ADDR]:检查签名后发送给节点，不指定节点时在本地挖矿确认")
+	fmt.Println("createWallet [-mnemonic] [-passphrase P]:创建地址，-mnemonic创建由助记词备份的HD钱包")
+	fmt.Println("restorewallet -mnemonic \"WORDS\" [-passphrase P]:用助记词恢复HD钱包")
+	fmt.Println("importaddress -address ADDR [-label L]:导入只观察、没有私钥的地址")
+	fmt.Println("importpubkey -pubkey HEX [-label L]:导入只观察的公钥")
+	fmt.Println("addmultisigaddress -m M -keys K1,K2,K3 [-label L]:添加需要其中M个私钥签名的多重签名地址，K为十六进制公钥或钱包中的地址")
+	fmt.Println("addtimelockaddress -address A -height H|-time T|-blocks N|-after D [-label L]:添加到达高度或时间（RFC3339），或者收款后经过N个区块或时长D才能由A花费的地址")
+	fmt.Println("initiate -from A -to B -amount N [-secrethash H] [-timeout 48h|-height H]:付款到哈希时间锁合约，不指定哈希时生成新的原像；原子交换的参与人用发起人的哈希和更短的超时")
+	fmt.Println("redeem -contract HEX -txid ID -secret S [-to ADDR]:收款人出示原像赎回合约")
+	fmt.Println("refund -contract HEX -txid ID [-to ADDR]:超时之后付款人取回合约中的币")
+	fmt.Println("auditcontract -contract HEX -txid ID:核对合约的金额、收款人、哈希与超时")
+	fmt.Println("extractsecret -txid ID -secrethash H:从赎回交易中取出原像")
+	fmt.Println("senddata -from A (-hex DATA|-file FILE) [-feerate R]:在数据输出中嵌入最多80字节的数据或文件的sha256，用于文件存证")
+	fmt.Println("finddata (-hex DATA|-file FILE):查找嵌入了数据的交易，打印所在区块的高度与时间")
+	fmt.Println("addscript -hex SCRIPT|-asm \"OP_...\" [-label L]:添加任意赎回脚本的脚本哈希地址")
+	fmt.Println("decodescript -hex SCRIPT|-asm \"OP_...\":打印脚本的汇编、类型与脚本哈希地址")
+	fmt.Println("validateaddress -address ADDR:检查地址并打印它的类型与锁定脚本")
+	fmt.Println("importprivkey -wif KEY [-label L] [-rescan=false]:导入WIF格式的私钥，默认重新扫描区块链")
+	fmt.Println("dumpprivkey -address ADDR:以WIF格式导出地址的私钥，加密的钱包需要先解锁")
+	fmt.Println("setlabel -address ADDR -label L:设置地址的备注，备注为空时删除")
+	fmt.Println("signmessage -address ADDR -message MSG:用地址的私钥签名消息，证明拥有该地址")
+	fmt.Println("verifymessage -address ADDR -signature SIG -message MSG:验证消息签名")
+	fmt.Println("walletbalance:钱包中所有地址的已确认、未确认与未成熟余额")
+	fmt.Println("encryptwallet -passphrase P:用口令加密钱包中的私钥")
+	fmt.Println("walletpassphrase -passphrase P [-timeout 5m]:解锁运行中的节点的钱包一段时间，钱包锁定时send交给节点签名，指令经过节点数据目录中control_NODE_ID.cookie记录的本机控制端口")
+	fmt.Println("walletpassphrasechange -old P -new Q:修改钱包口令")
+	fmt.Println("walletlock:立即锁定运行中的节点的钱包")
+	fmt.Println("单独运行的命令需要签名时，可以用环境变量WALLET_PASSPHRASE提供口令")
+	fmt.Println("listbanned:列出被封禁的节点")
+	fmt.Println("setban -addr ADDR [-duration 24h] [-remove]:封禁或解封节点，ADDR为对方的监听地址，TLS节点为listbanned中的key:公钥指纹；运行中的节点在下次启动时生效")
+	fmt.Println("clearbanned:解除所有封禁")
+	fmt.Println("startlight [-fprate RATE]:以轻节点模式运行，只同步区块头并跟踪钱包中地址的交易，fprate为布隆过滤器的误报率")
+	fmt.Println("lightbalance -address ADDR:轻节点中地址的余额")
+	fmt.Println("simnet -nodes N -blocks M [-latency -jitter -drop -partition]:在模拟网络中运行多个节点并检查同步结果")
+}
+func (cli *CLI) createWallet(mnemonic bool, passphrase string) {
+	wallets, _ := NewWallets()
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+
+	if mnemonic {
+		words, err := NewMnemonic()
+		checkErr(err)
+		err = wallets.InitHD(words, passphrase)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("mnemonic:%s\n", words)
+		fmt.Println("请把助记词抄写在纸上妥善保管，恢复钱包时需要它以及口令")
+	}
+
+	address := wallets.CreateWallet()
+	wallets.SaveToFile()
+	fmt.Printf("your address:%s\n", address)
+}
+
+// 用助记词恢复HD钱包，并在本地区块链上查找用过的地址
+func (cli *CLI) restoreWallet(mnemonic, passphrase string) {
+	wallets, _ := NewWallets()
+
+	err := wallets.InitHD(mnemonic, passphrase)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	used := cli.blockchain().UsedPubkeyHashes()
+	found := wallets.Discover(func(pubkeyHash []byte) bool {
+		return used[hex.EncodeToString(pubkeyHash)]
+	})
+	if found == 0 {
+		fmt.Println("no used addresses found, deriving the first one")
+		wallets.CreateWallet()
+	}
+	wallets.SaveToFile()
+
+	for _, address := range wallets.getAddress() {
+		if path := wallets.WalletsStore[address].Path; path != "" {
+			fmt.Printf("restored %s %s\n", path, address)
+		}
+	}
+}
+
+// 导入观察地址或公钥，并重新扫描区块链中与它有关的交易
+func (cli *CLI) importWatchOnly(address, pubkey, label string) {
+	wallets, _ := NewWallets()
+
+	var err error
+	if pubkey != "" {
+		var key []byte
+		key, err = hex.DecodeString(pubkey)
+		if err == nil {
+			address, err = wallets.ImportPubKey(key)
+		}
+	} else {
+		err = wallets.ImportAddress(address)
+	}
+	if err == nil && label != "" {
+		err = wallets.SetLabel(address, label)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Printf("watching %s\n", address)
+
+	wallets.TxSet(cli.blockchain()).Rescan()
+}
+
+// 添加多重签名地址，keys为十六进制公钥或钱包中知道公钥的地址
+func (cli *CLI) addMultiSigAddress(m int, keys, label string) {
+	wallets, _ := NewWallets()
+
+	var pubKeys [][]byte
+	for _, key := range strings.Split(keys, ",") {
+		key = strings.TrimSpace(key)
+		pubKey := wallets.PublicKey(key)
+		if pubKey == nil {
+			var err error
+			pubKey, err = hex.DecodeString(key)
+			if err != nil {
+				fmt.Printf("%s is neither a public key nor an address with known public key\n", key)
+				os.Exit(1)
+			}
+		}
+		pubKeys = append(pubKeys, pubKey)
+	}
+
+	address, script, err := wallets.AddMultiSigAddress(m, pubKeys)
+	if err == nil && label != "" {
+		err = wallets.SetLabel(address, label)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Printf("address %s\n", address)
+	fmt.Printf("redeemscript %x\n", script)
+}
+
+// 添加时间锁地址：到达高度或时间，或者收款确认一定区块数或时间之后，address的私钥才能花费
+func (cli *CLI) addTimeLockAddress(address string, height uint, at string, blocks uint, after time.Duration, label string) {
+	var lock uint32
+	relative := blocks != 0 || after != 0
+	var err error
+	switch {
+	case relative:
+		lock, err = relativeLockSequence(uint32(blocks), after)
+	case at != "":
+		var t time.Time
+		t, err = time.Parse(time.RFC3339, at)
+		if err == nil && t.Unix() < lockTimeThreshold {
+			err = fmt.Errorf("time %s is too early", at)
+		}
+		lock = uint32(t.Unix())
+	default:
+		if height >= lockTimeThreshold {
+			err = fmt.Errorf("height %d is too large", height)
+		}
+		lock = uint32(height)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	wallets, _ := NewWallets()
+	scriptAddress, script, err := wallets.AddTimeLockAddress(address, lock, relative)
+	if err == nil && label != "" {
+		err = wallets.SetLabel(scriptAddress, label)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Printf("address %s\n", scriptAddress)
+	fmt.Printf("redeemscript %s\n", DisasmScript(script))
+}
+
+// 发起原子交换：向to付款到合约，secretHash为空时生成新的原像（发起人），否则使用对方给出的哈希（参与人）
+func (cli *CLI) initiate(from, to string, amount int, secretHash string, timeout time.Duration, height uint, feeRate int) {
+	wallets, err := NewWallets()
+	checkErr(err)
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+	if wallets.WalletsStore[from] == nil {
+		fmt.Printf("no private key for %s in the wallet\n", from)
+		os.Exit(1)
+	}
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+	recipient, err := addressToPubkeyHash(to)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	var secret, hash []byte
+	if secretHash == "" {
+		secret = newSecret()
+		sum := sha256.Sum256(secret)
+		hash = sum[:]
+	} else if hash, err = hex.DecodeString(secretHash); err != nil || len(hash) != sha256.Size {
+		fmt.Println("secret hash must be 32 bytes in hex")
+		os.Exit(1)
+	}
+
+	lockTime := uint32(time.Now().Add(timeout).Unix())
+	if height != 0 {
+		if height >= lockTimeThreshold {
+			fmt.Printf("height %d is too large\n", height)
+			os.Exit(1)
+		}
+		lockTime = uint32(height)
+	}
+
+	contract := &HTLC{hash, recipient, HashPubKey(wallets.WalletsStore[from].PublicKey), lockTime}
+	payments := []Payment{{contract.Address(), amount}}
+	if _, err := validatePayments(payments); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	selector, err := coinSelectorByName(defaultCoinSelector)
+	checkErr(err)
+
+	bc := cli.blockchain()
+	tx := NewUTXOTransation(from, payments, bc, selector, FeePolicy{feeRate})
+	newblock := bc.MineBlock([]*Transation{tx})
+	set := UTXOSet{bc}
+	set.update(newblock)
+
+	_, err = wallets.AddScript(contract.Script())
+	checkErr(err)
+	wallets.SaveToFile()
+	wallets.TxSet(bc).Sync()
+
+	if secret != nil {
+		fmt.Printf("secret %x\n", secret)
+	}
+	fmt.Printf("secrethash %x\n", hash)
+	fmt.Printf("contract %x\n", contract.Script())
+	fmt.Printf("address %s\n", contract.Address())
+	fmt.Printf("txid %x\n", tx.ID)
+	fmt.Printf("refund after %s\n", lockTimeString(lockTime))
+}
+
+// 解析合约，并在区块链上找到付款到合约的交易
+func (cli *CLI) loadContract(contractHex, txid string) ([]byte, *HTLC, *Transation) {
+	contract, err := hex.DecodeString(contractHex)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	c, ok := extractHTLC(contract)
+	if !ok {
+		fmt.Println("not a hash time-locked contract")
+		os.Exit(1)
+	}
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tx, err := cli.blockchain().FindTransationById(id)
+	if err == nil {
+		_, err = findContractOutput(&tx, contract)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return contract, c, &tx
+}
+
+// 合约输出是否未被花费
+func (cli *CLI) contractUnspent(contractTx *Transation, contract []byte) bool {
+	index, _ := findContractOutput(contractTx, contract)
+	for _, out := range cli.blockchain().FindAllUTXO()[hex.EncodeToString(contractTx.ID)].Outputs {
+		if out.index == index {
+			return true
+		}
+	}
+	return false
+}
+
+// 赎回或退款：签名后检查并在本地挖矿确认
+func (cli *CLI) spendContract(contractHex, txid, secretHex, to string, refund bool, feeRate int) {
+	contract, c, contractTx := cli.loadContract(contractHex, txid)
+	if !cli.contractUnspent(contractTx, contract) {
+		fmt.Println("contract is already spent")
+		os.Exit(1)
+	}
+
+	wallets, err := NewWallets()
+	checkErr(err)
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+	owner, lockTime := c.Recipient, uint32(0)
+	if refund {
+		owner, lockTime = c.Refund, c.LockTime
+	}
+	wallet := wallets.WalletsStore[pubkeyHashToAddress(owner)]
+	if wallet == nil {
+		fmt.Printf("no private key for %s in the wallet\n", pubkeyHashToAddress(owner))
+		os.Exit(1)
+	}
+	if to == "" {
+		to = pubkeyHashToAddress(owner)
+	}
+	if _, err := addressToScript(to); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	tx, err := newContractSpend(contractTx, contract, to, lockTime, FeePolicy{feeRate})
+	if err == nil && refund {
+		err = tx.refundContract(contract, wallet.PrivateKey)
+	} else if err == nil {
+		var secret []byte
+		secret, err = hex.DecodeString(secretHex)
+		if err == nil {
+			err = tx.redeemContract(contract, secret, wallet.PrivateKey)
+		}
+	}
+	bc := cli.blockchain()
+	if err == nil {
+		err = bc.VerifyTransation(tx)
+	}
+	if err == nil {
+		err = bc.CheckNextBlockLockTimes(tx)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	newblock := bc.MineBlock([]*Transation{tx})
+	set := UTXOSet{bc}
+	set.update(newblock)
+	wallets.TxSet(bc).Sync()
+	fmt.Printf("transation %x confirmed, %d paid to %s\n", tx.ID, tx.Vout[0].Value, to)
+}
+
+// 核对合约条款：收款人、退款人、金额、哈希与超时，以及合约输出是否还没有被花费
+func (cli *CLI) auditContract(contractHex, txid string) {
+	contract, c, contractTx := cli.loadContract(contractHex, txid)
+	index, _ := findContractOutput(contractTx, contract)
+
+	fmt.Printf("address %s\n", c.Address())
+	fmt.Printf("value %d\n", contractTx.Vout[index].Value)
+	fmt.Printf("recipient %s\n", pubkeyHashToAddress(c.Recipient))
+	fmt.Printf("refund %s\n", pubkeyHashToAddress(c.Refund))
+	fmt.Printf("secrethash %x\n", c.SecretHash)
+
+	bc := cli.blockchain()
+	expired := c.LockTime < lockTimeThreshold && int32(c.LockTime) <= bc.GetBestHeight() ||
+		c.LockTime >= lockTimeThreshold && c.LockTime <= bc.medianTimePast(bc.Tip())
+	status := "not expired"
+	if expired {
+		status = "expired, can be refunded"
+	}
+	fmt.Printf("locktime %s (%s)\n", lockTimeString(c.LockTime), status)
+	if !cli.contractUnspent(contractTx, contract) {
+		fmt.Println("contract is already spent")
+		os.Exit(1)
+	}
+}
+
+// 从对方的赎回交易中取出原像
+func (cli *CLI) extractSecret(txid, secretHash string) {
+	id, err := hex.DecodeString(txid)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	hash, err := hex.DecodeString(secretHash)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	tx, err := cli.blockchain().FindTransationById(id)
+	var secret []byte
+	if err == nil {
+		secret, err = extractSecret(&tx, hash)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("secret %x\n", secret)
+}
+
+// 要嵌入的数据：十六进制数据，或者文件内容的sha256
+func parseDataArg(dataHex, file string) []byte {
+	if file != "" {
+		content, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		hash := sha256.Sum256(content)
+		return hash[:]
+	}
+	data, err := hex.DecodeString(dataHex)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return data
+}
+
+// 在数据输出中嵌入数据，手续费由from支付，数据随区块一起留下时间证明
+func (cli *CLI) sendData(from string, data []byte, feeRate int) {
+	wallets, err := NewWallets()
+	checkErr(err)
+	wallet := wallets.WalletsStore[from]
+	if wallet == nil {
+		fmt.Printf("no private key for %s in the wallet\n", from)
+		os.Exit(1)
+	}
+	if wallets.IsLocked() {
+		fmt.Println(errWalletLocked)
+		os.Exit(1)
+	}
+	selector, err := coinSelectorByName(defaultCoinSelector)
+	checkErr(err)
+
+	bc := cli.blockchain()
+	tx, fee, err := NewDataTransation(from, data, bc, selector, FeePolicy{feeRate})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	bc.SignTransation(tx, wallet.PrivateKey)
+	newblock := bc.MineBlock([]*Transation{tx})
+	set := UTXOSet{bc}
+	set.update(newblock)
+	wallets.TxSet(bc).Sync()
+
+	fmt.Printf("txid %x\n", tx.ID)
+	fmt.Printf("data %x\n", data)
+	fmt.Printf("fee %d\n", fee)
+	fmt.Printf("block %x height %d\n", newblock.Hash, newblock.Height)
+}
+
+// 在区块链中查找嵌入了data的交易，打印所在区块的高度与时间作为时间证明
+func (cli *CLI) findData(data []byte) {
+	found := false
+	bci := cli.blockchain().iterator()
+	for {
+		block := bci.Next()
+		for _, tx := range block.Transations {
+			for _, out := range tx.Vout {
+				if embedded, ok := extractNullData(out.ScriptPubKey); ok && bytes.Equal(embedded, data) {
+					found = true
+					fmt.Printf("txid %x\n", tx.ID)
+					fmt.Printf("block %x height %d\n", block.Hash, block.Height)
+					fmt.Printf("time %s\n", time.Unix(int64(block.Time), 0).UTC().Format(time.RFC3339))
+				}
+			}
+		}
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	if !found {
+		fmt.Printf("data %x not found\n", data)
+		os.Exit(1)
+	}
+}
+
+// 十六进制或汇编形式的脚本
+func parseScriptArg(scriptHex, asm string) []byte {
+	var script []byte
+	var err error
+	if scriptHex != "" {
+		script, err = hex.DecodeString(scriptHex)
+		if err == nil {
+			_, err = parseScript(script)
+		}
+	} else {
+		script, err = AssembleScript(asm)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	return script
+}
+
+// 添加任意赎回脚本的脚本哈希地址，付款到这个地址的输出由满足赎回脚本的人花费
+func (cli *CLI) addScript(scriptHex, asm, label string) {
+	wallets, _ := NewWallets()
+
+	address, err := wallets.AddScript(parseScriptArg(scriptHex, asm))
+	if err == nil && label != "" {
+		err = wallets.SetLabel(address, label)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Printf("address %s\n", address)
+}
+
+func (cli *CLI) decodeScript(scriptHex, asm string) {
+	script := parseScriptArg(scriptHex, asm)
+
+	fmt.Printf("asm %s\n", DisasmScript(script))
+	fmt.Printf("hex %x\n", script)
+	class := scriptClass(script)
+	fmt.Printf("type %s\n", class)
+	switch class {
+	case "pubkeyhash":
+		fmt.Printf("address %s\n", pubkeyHashToAddress(extractPubkeyHash(script)))
+	case "scripthash":
+		fmt.Printf("address %s\n", scriptHashToAddress(extractScriptHash(script)))
+	case "multisig":
+		m, pubKeys, _ := extractMultiSig(script)
+		fmt.Printf("required %d of %d\n", m, len(pubKeys))
+		for _, pubKey := range pubKeys {
+			fmt.Printf("address %s\n", pubkeyHashToAddress(HashPubKey(pubKey)))
+		}
+	}
+	if class != "scripthash" {
+		fmt.Printf("p2sh %s\n", scriptHashToAddress(HashPubKey(script)))
+	}
+}
+
+func (cli *CLI) validateAddress(address string) {
+	addressVersion, _, err := decodeAddress(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	script, _ := addressToScript(address)
+	kind := "pubkeyhash"
+	if addressVersion == scriptHashVersion {
+		kind = "scripthash"
+	}
+	fmt.Printf("valid %s %s\n", kind, address)
+	fmt.Printf("scriptPubKey %s\n", DisasmScript(script))
+}
+
+// 导入其他钱包导出的私钥，rescan时重新扫描区块链中与它有关的交易
+func (cli *CLI) importPrivKey(wif, label string, rescan bool) {
+	wallets, _ := NewWallets()
+
+	address, err := wallets.ImportPrivateKey(wif)
+	if err == nil && label != "" {
+		err = wallets.SetLabel(address, label)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+	fmt.Printf("imported %s\n", address)
+
+	if rescan {
+		wallets.TxSet(cli.blockchain()).Rescan()
+	}
+}
+
+func (cli *CLI) dumpPrivKey(address string) {
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	wif, err := wallets.DumpPrivateKey(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(wif)
+}
+
+func (cli *CLI) setLabel(address, label string) {
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	err = wallets.SetLabel(address, label)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	wallets.SaveToFile()
+}
+
+func (cli *CLI) signMessage(address, message string) {
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	wallet := wallets.WalletsStore[address]
+	if wallet == nil {
+		fmt.Printf("no private key for %s in the wallet\n", address)
+		os.Exit(1)
+	}
+	signature, err := SignMessage(wallet, message)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println(signature)
 }
 
-func (cli *CLI) validateArgs() {
-	if len(os.Args) < 1 {
-		fmt.Println("参数小于1")
+// 不需要钱包，任何人都可以验证
+func (cli *CLI) verifyMessage(address, signature, message string) {
+	err := VerifyMessage(address, signature, message)
+	if err != nil {
+		fmt.Println(err)
 		os.Exit(1)
 	}
-	fmt.Println(os.Args)
-}
-func (cli *CLI) printChain() {
-	cli.bc.printBlockchain()
+	fmt.Println("signature is valid")
 }
 
-func (cli *CLI) getBalance(address string) {
-
-	balance := 0
-	decodeAddress := base58Decode([]byte(address))
-	pubkeyHash := decodeAddress[1 : len(decodeAddress)-4]
+// 整个钱包的余额，观察地址单独列出
+func (cli *CLI) walletBalance() {
+	wallets, err := NewWallets()
+	checkErr(err)
 
-	set := UTXOSet{cli.bc}
-	UTXOs := set.FindUTXObyPubkeyHash(pubkeyHash)
-	//UTXOs := cli.bc.FindUTXO(pubkeyHash)
+	txs := wallets.TxSet(cli.blockchain())
+	txs.Sync()
 
-	for _, out := range UTXOs {
-		balance += out.Value
+	mine, watchOnly := wallets.PubkeyHashes()
+	balance := txs.Balance(mine)
+	fmt.Printf("confirmed:%d unconfirmed:%d immature:%d\n", balance.Confirmed, balance.Unconfirmed, balance.Immature)
+	if len(watchOnly) > 0 {
+		balance = txs.Balance(watchOnly)
+		fmt.Printf("watch-only confirmed:%d unconfirmed:%d immature:%d\n", balance.Confirmed, balance.Unconfirmed, balance.Immature)
 	}
-	fmt.Printf("balance of %s:%d\n", address, balance)
 }
 
-func (cli *CLI) send(from, to string, amount int) {
-	tx := NewUTXOTransation(from, to, amount, cli.bc)
+func (cli *CLI) encryptWallet(passphrase string) {
+	wallets, err := NewWallets()
+	checkErr(err)
 
-	newblock := cli.bc.MineBlock([]*Transation{tx})
+	err = wallets.EncryptWallet(passphrase)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("wallet encrypted, unlock it with walletpassphrase before sending")
+}
 
-	set := UTXOSet{cli.bc}
+// 解锁运行中的节点的钱包。先在本地检查口令，密钥只发给本机的节点，不写入任何文件
+func (cli *CLI) walletPassphrase(nodeID, passphrase string, timeout time.Duration) {
+	wallets, err := NewWallets()
+	checkErr(err)
 
-	set.update(newblock)
+	err = wallets.Unlock(passphrase)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 
-	//cli.getBalance("1NpxpZkBYd3uYJGMcpzFs6q65WPrr1cDaM")
-	//cli.getBalance("1MVh4SCLbdnoXDT1pCmhepJ9ZMSdXTqsrB")
-	fmt.Printf("Success")
+	err = sendControlCommand(nodeID, "walletunlock", walletunlock{passphrase, timeout})
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("wallet of node %s unlocked for %s\n", nodeID, timeout)
 }
 
-func (cli *CLI) printUsage() {
-	fmt.Println("USages:")
-	fmt.Println("addblock-增加区块:")
-	fmt.Println("printChain:打印区块链")
+func (cli *CLI) walletLock(nodeID string) {
+	err := sendControlCommand(nodeID, "walletlock", nil)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("wallet of node %s locked\n", nodeID)
 }
-func (cli *CLI) createWallet() {
-	wallets, _ := NewWallets()
-	address := wallets.CreateWallet()
-	wallets.SaveToFile()
-	fmt.Printf("your address:%s\n", address)
+
+func (cli *CLI) walletPassphraseChange(oldPassphrase, newPassphrase string) {
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	err = wallets.ChangePassphrase(oldPassphrase, newPassphrase)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("wallet passphrase changed")
 }
+
 func (cli *CLI) listAddress() {
 	wallets, err := NewWallets()
 	checkErr(err)
 	addresses := wallets.getAddress()
 
 	for _, address := range addresses {
-		fmt.Println("address", address)
+		fields := []string{"address", address}
+		if path := wallets.WalletsStore[address].Path; path != "" {
+			fields = append(fields, path)
+		}
+		if label := wallets.Labels[address]; label != "" {
+			fields = append(fields, fmt.Sprintf("%q", label))
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+	for address := range wallets.WatchOnly {
+		fields := []string{"address", address, "watch-only"}
+		if label := wallets.Labels[address]; label != "" {
+			fields = append(fields, fmt.Sprintf("%q", label))
+		}
+		fmt.Println(strings.Join(fields, " "))
+	}
+	for address, script := range wallets.Scripts {
+		fields := []string{"address", address, "script"}
+		if m, pubKeys, ok := extractMultiSig(script); ok {
+			fields[2] = fmt.Sprintf("multisig %d-of-%d", m, len(pubKeys))
+		} else if c, ok := extractHTLC(script); ok {
+			fields[2] = "htlc refund after " + lockTimeString(c.LockTime)
+		} else if lock, relative, _, ok := extractTimeLock(script); ok {
+			fields[2] = "timelock " + lockTimeString(lock)
+			if relative {
+				fields[2] = fmt.Sprintf("timelock sequence %#x", lock)
+			}
+		}
+		if label := wallets.Labels[address]; label != "" {
+			fields = append(fields, fmt.Sprintf("%q", label))
+		}
+		fmt.Println(strings.Join(fields, " "))
 	}
 
 }
@@ -96,17 +1113,196 @@ func (cli *CLI) Run() {
 
 	startNodeCmd := flag.NewFlagSet("startNodeCmd", flag.ExitOnError)
 	startNodeMinner := startNodeCmd.String("minner", "", "minnerAddress")
+	startNodeCompact := startNodeCmd.Bool("compact", true, "relay new blocks as compact blocks")
+	startNodeSecure := startNodeCmd.String("secure", secureOff, "peer encryption: off, prefer or require")
 
 	sendCmd := flag.NewFlagSet("send", flag.ExitOnError)
 	sendFrom := sendCmd.String("from", "", "source wallet address")
 	sendTo := sendCmd.String("to", "", "Destination wallet address")
 	sendAmount := sendCmd.Int("amount", 0, "Amount to send")
+	sendCoinSelect := sendCmd.String("coinselect", defaultCoinSelector, "coin selection: largest, smallest, bnb or privacy")
+	sendFeeRate := sendCmd.Int("feerate", 0, "fee per 1000 bytes of transation")
+	var sendPayments paymentList
+	sendCmd.Var(&sendPayments, "pay", "payment ADDRESS:AMOUNT, can be repeated")
+	sendPayFile := sendCmd.String("payfile", "", "CSV or JSON file of payments")
+	sendDryRun := sendCmd.Bool("dryrun", false, "print inputs, outputs and fee without signing")
+
+	createPSBTCMD := flag.NewFlagSet("createpsbt", flag.ExitOnError)
+	createPSBTFrom := createPSBTCMD.String("from", "", "source wallet address")
+	createPSBTTo := createPSBTCMD.String("to", "", "Destination wallet address")
+	createPSBTAmount := createPSBTCMD.Int("amount", 0, "Amount to send")
+	var createPSBTPayments paymentList
+	createPSBTCMD.Var(&createPSBTPayments, "pay", "payment ADDRESS:AMOUNT, can be repeated")
+	createPSBTPayFile := createPSBTCMD.String("payfile", "", "CSV or JSON file of payments")
+	createPSBTCoinSelect := createPSBTCMD.String("coinselect", defaultCoinSelector, "coin selection: largest, smallest, bnb or privacy")
+	createPSBTFeeRate := createPSBTCMD.Int("feerate", 0, "fee per 1000 bytes of transation")
+	createPSBTLockTime := createPSBTCMD.Uint("locktime", 0, "block height or unix time before which the transation can not be mined")
+	createPSBTOut := createPSBTCMD.String("out", "", "file to write the unsigned transation to")
+
+	signPSBTCMD := flag.NewFlagSet("signpsbt", flag.ExitOnError)
+	signPSBTIn := signPSBTCMD.String("in", "", "partially signed transation file")
+	signPSBTOut := signPSBTCMD.String("out", "", "file to write the result to, default is the input file")
+	signPSBTSigHash := signPSBTCMD.String("sighash", "ALL", "signature hash type: ALL, NONE or SINGLE, optionally with |ANYONECANPAY")
+
+	combinePSBTCMD := flag.NewFlagSet("combinepsbt", flag.ExitOnError)
+	combinePSBTIn := combinePSBTCMD.String("in", "", "comma separated partially signed transation files")
+	combinePSBTOut := combinePSBTCMD.String("out", "", "file to write the combined transation to")
+
+	crowdfundCMD := flag.NewFlagSet("crowdfund", flag.ExitOnError)
+	crowdfundTo := crowdfundCMD.String("to", "", "Destination wallet address")
+	crowdfundAmount := crowdfundCMD.Int("amount", 0, "Amount to raise")
+	var crowdfundPayments paymentList
+	crowdfundCMD.Var(&crowdfundPayments, "pay", "payment ADDRESS:AMOUNT, can be repeated")
+	crowdfundPayFile := crowdfundCMD.String("payfile", "", "CSV or JSON file of payments")
+	crowdfundOut := crowdfundCMD.String("out", "", "file to write the crowdfunding transation to")
+
+	pledgeCMD := flag.NewFlagSet("pledge", flag.ExitOnError)
+	pledgeIn := pledgeCMD.String("in", "", "crowdfunding transation file")
+	pledgeFrom := pledgeCMD.String("from", "", "wallet address to pledge from")
+	pledgeAmount := pledgeCMD.Int("amount", 0, "Amount to pledge")
+	pledgeCoinSelect := pledgeCMD.String("coinselect", defaultCoinSelector, "coin selection: largest, smallest, bnb or privacy")
+	pledgeOut := pledgeCMD.String("out", "", "file to write the result to, default is the input file")
+
+	finalizePSBTCMD := flag.NewFlagSet("finalizepsbt", flag.ExitOnError)
+	finalizePSBTIn := finalizePSBTCMD.String("in", "", "fully signed transation file")
+	finalizePSBTNode := finalizePSBTCMD.String("node", "", "node address to send the transation to, mine it locally if empty")
 
 	createWalletCMD := flag.NewFlagSet("createWallet", flag.ExitOnError)
+	createWalletMnemonic := createWalletCMD.Bool("mnemonic", false, "create an HD wallet backed by a new mnemonic")
+	createWalletPassphrase := createWalletCMD.String("passphrase", "", "optional passphrase protecting the mnemonic")
+	restoreWalletCMD := flag.NewFlagSet("restorewallet", flag.ExitOnError)
+	restoreWalletMnemonic := restoreWalletCMD.String("mnemonic", "", "the mnemonic words, quoted")
+	restoreWalletPassphrase := restoreWalletCMD.String("passphrase", "", "passphrase used when the wallet was created")
 	listAddressCMD := flag.NewFlagSet("listaddress", flag.ExitOnError)
 
+	encryptWalletCMD := flag.NewFlagSet("encryptwallet", flag.ExitOnError)
+	encryptWalletPassphrase := encryptWalletCMD.String("passphrase", "", "passphrase protecting the private keys")
+	walletPassphraseCMD := flag.NewFlagSet("walletpassphrase", flag.ExitOnError)
+	walletPassphrasePassphrase := walletPassphraseCMD.String("passphrase", "", "the wallet passphrase")
+	walletPassphraseTimeout := walletPassphraseCMD.Duration("timeout", 5*time.Minute, "how long the wallet stays unlocked")
+	walletPassphraseChangeCMD := flag.NewFlagSet("walletpassphrasechange", flag.ExitOnError)
+	walletPassphraseChangeOld := walletPassphraseChangeCMD.String("old", "", "the current passphrase")
+	walletPassphraseChangeNew := walletPassphraseChangeCMD.String("new", "", "the new passphrase")
+	walletLockCMD := flag.NewFlagSet("walletlock", flag.ExitOnError)
+
+	importAddressCMD := flag.NewFlagSet("importaddress", flag.ExitOnError)
+	importAddressAddress := importAddressCMD.String("address", "", "the watch-only address")
+	importAddressLabel := importAddressCMD.String("label", "", "what the address is for")
+	importPubKeyCMD := flag.NewFlagSet("importpubkey", flag.ExitOnError)
+	importPubKeyPubKey := importPubKeyCMD.String("pubkey", "", "the watch-only public key in hex")
+	importPubKeyLabel := importPubKeyCMD.String("label", "", "what the address is for")
+	addMultiSigCMD := flag.NewFlagSet("addmultisigaddress", flag.ExitOnError)
+	addMultiSigM := addMultiSigCMD.Int("m", 0, "the number of signatures required")
+	addMultiSigKeys := addMultiSigCMD.String("keys", "", "comma separated public keys in hex or addresses")
+	addMultiSigLabel := addMultiSigCMD.String("label", "", "what the address is for")
+	addTimeLockCMD := flag.NewFlagSet("addtimelockaddress", flag.ExitOnError)
+	addTimeLockAddress := addTimeLockCMD.String("address", "", "the address that can spend after the lock")
+	addTimeLockHeight := addTimeLockCMD.Uint("height", 0, "block height the funds are locked until")
+	addTimeLockTime := addTimeLockCMD.String("time", "", "time the funds are locked until, in RFC3339")
+	addTimeLockBlocks := addTimeLockCMD.Uint("blocks", 0, "blocks each payment is locked for after it is confirmed")
+	addTimeLockAfter := addTimeLockCMD.Duration("after", 0, "how long each payment is locked for after it is confirmed")
+	addTimeLockLabel := addTimeLockCMD.String("label", "", "what the address is for")
+	initiateCMD := flag.NewFlagSet("initiate", flag.ExitOnError)
+	initiateFrom := initiateCMD.String("from", "", "source wallet address, also the refund address")
+	initiateTo := initiateCMD.String("to", "", "the counterparty who can redeem with the secret")
+	initiateAmount := initiateCMD.Int("amount", 0, "Amount to lock in the contract")
+	initiateSecretHash := initiateCMD.String("secrethash", "", "the initiator's secret hash, when participating in a swap")
+	initiateTimeout := initiateCMD.Duration("timeout", 48*time.Hour, "how long until the contract can be refunded")
+	initiateHeight := initiateCMD.Uint("height", 0, "block height after which the contract can be refunded, instead of timeout")
+	initiateFeeRate := initiateCMD.Int("feerate", 0, "fee per 1000 bytes of transation")
+	redeemCMD := flag.NewFlagSet("redeem", flag.ExitOnError)
+	redeemContract := redeemCMD.String("contract", "", "the contract in hex")
+	redeemTxID := redeemCMD.String("txid", "", "the transation paying to the contract")
+	redeemSecret := redeemCMD.String("secret", "", "the secret in hex")
+	redeemTo := redeemCMD.String("to", "", "address to pay to, the recipient by default")
+	redeemFeeRate := redeemCMD.Int("feerate", 0, "fee per 1000 bytes of transation")
+	refundCMD := flag.NewFlagSet("refund", flag.ExitOnError)
+	refundContract := refundCMD.String("contract", "", "the contract in hex")
+	refundTxID := refundCMD.String("txid", "", "the transation paying to the contract")
+	refundTo := refundCMD.String("to", "", "address to pay to, the refund address by default")
+	refundFeeRate := refundCMD.Int("feerate", 0, "fee per 1000 bytes of transation")
+	auditContractCMD := flag.NewFlagSet("auditcontract", flag.ExitOnError)
+	auditContractContract := auditContractCMD.String("contract", "", "the contract in hex")
+	auditContractTxID := auditContractCMD.String("txid", "", "the transation paying to the contract")
+	extractSecretCMD := flag.NewFlagSet("extractsecret", flag.ExitOnError)
+	extractSecretTxID := extractSecretCMD.String("txid", "", "the transation redeeming the contract")
+	extractSecretHash := extractSecretCMD.String("secrethash", "", "the secret hash of the contract")
+	sendDataCMD := flag.NewFlagSet("senddata", flag.ExitOnError)
+	sendDataFrom := sendDataCMD.String("from", "", "source wallet address paying the fee")
+	sendDataHex := sendDataCMD.String("hex", "", "data to embed in hex")
+	sendDataFile := sendDataCMD.String("file", "", "file whose sha256 to embed")
+	sendDataFeeRate := sendDataCMD.Int("feerate", 0, "fee per 1000 bytes of transation")
+	findDataCMD := flag.NewFlagSet("finddata", flag.ExitOnError)
+	findDataHex := findDataCMD.String("hex", "", "embedded data in hex")
+	findDataFile := findDataCMD.String("file", "", "file whose sha256 was embedded")
+	addScriptCMD := flag.NewFlagSet("addscript", flag.ExitOnError)
+	addScriptHex := addScriptCMD.String("hex", "", "the redeem script in hex")
+	addScriptAsm := addScriptCMD.String("asm", "", "the redeem script in assembly")
+	addScriptLabel := addScriptCMD.String("label", "", "what the address is for")
+	decodeScriptCMD := flag.NewFlagSet("decodescript", flag.ExitOnError)
+	decodeScriptHex := decodeScriptCMD.String("hex", "", "the script in hex")
+	decodeScriptAsm := decodeScriptCMD.String("asm", "", "the script in assembly")
+	validateAddressCMD := flag.NewFlagSet("validateaddress", flag.ExitOnError)
+	validateAddressAddress := validateAddressCMD.String("address", "", "the address to check")
+	importPrivKeyCMD := flag.NewFlagSet("importprivkey", flag.ExitOnError)
+	importPrivKeyWIF := importPrivKeyCMD.String("wif", "", "the private key in WIF format")
+	importPrivKeyLabel := importPrivKeyCMD.String("label", "", "what the address is for")
+	importPrivKeyRescan := importPrivKeyCMD.Bool("rescan", true, "rescan the blockchain for transations of the key")
+	dumpPrivKeyCMD := flag.NewFlagSet("dumpprivkey", flag.ExitOnError)
+	dumpPrivKeyAddress := dumpPrivKeyCMD.String("address", "", "the address to export the private key of")
+	signMessageCMD := flag.NewFlagSet("signmessage", flag.ExitOnError)
+	signMessageAddress := signMessageCMD.String("address", "", "the address to sign with")
+	signMessageMessage := signMessageCMD.String("message", "", "the message to sign")
+	verifyMessageCMD := flag.NewFlagSet("verifymessage", flag.ExitOnError)
+	verifyMessageAddress := verifyMessageCMD.String("address", "", "the address that signed the message")
+	verifyMessageSignature := verifyMessageCMD.String("signature", "", "the signature in base64")
+	verifyMessageMessage := verifyMessageCMD.String("message", "", "the message that was signed")
+	setLabelCMD := flag.NewFlagSet("setlabel", flag.ExitOnError)
+	setLabelAddress := setLabelCMD.String("address", "", "the address to label")
+	setLabelLabel := setLabelCMD.String("label", "", "the label, empty removes it")
+	walletBalanceCMD := flag.NewFlagSet("walletbalance", flag.ExitOnError)
+
 	getBestHeightCMD := flag.NewFlagSet("getBestHeight", flag.ExitOnError)
+
+	listBannedCMD := flag.NewFlagSet("listbanned", flag.ExitOnError)
+	setBanCMD := flag.NewFlagSet("setban", flag.ExitOnError)
+	setBanAddr := setBanCMD.String("addr", "", "peer listen address, e.g. localhost:3001, or key:FINGERPRINT")
+	setBanDuration := setBanCMD.Duration("duration", defaultBanTime, "how long to ban the peer")
+	setBanRemove := setBanCMD.Bool("remove", false, "remove the ban instead of adding it")
+	clearBannedCMD := flag.NewFlagSet("clearbanned", flag.ExitOnError)
+
+	startLightCMD := flag.NewFlagSet("startlight", flag.ExitOnError)
+	startLightFPRate := startLightCMD.Float64("fprate", 0.0001, "false positive rate of the bloom filter, 0 sends the exact pubkey hashes")
+	lightBalanceCMD := flag.NewFlagSet("lightbalance", flag.ExitOnError)
+	lightBalanceAddress := lightBalanceCMD.String("address", "", "the address to get balance of")
+
+	simnetCMD := flag.NewFlagSet("simnet", flag.ExitOnError)
+	simnetNodes := simnetCMD.Int("nodes", 4, "number of nodes")
+	simnetBlocks := simnetCMD.Int("blocks", 5, "number of blocks to mine")
+	simnetLatency := simnetCMD.Duration("latency", 10*time.Millisecond, "message latency")
+	simnetJitter := simnetCMD.Duration("jitter", 10*time.Millisecond, "random extra latency, reorders messages")
+	simnetDrop := simnetCMD.Float64("drop", 0, "probability that a message is dropped")
+	simnetPartition := simnetCMD.Bool("partition", false, "mine on both sides of a network partition before healing it")
+	simnetTimeout := simnetCMD.Duration("timeout", 30*time.Second, "how long to wait for the nodes to converge")
 	switch os.Args[1] {
+	case "startlight":
+		err := startLightCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "lightbalance":
+		err := lightBalanceCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "simnet":
+		err := simnetCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "listbanned":
+		err := listBannedCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "setban":
+		err := setBanCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "clearbanned":
+		err := clearBannedCMD.Parse(os.Args[2:])
+		checkErr(err)
 	case "startNodeCmd":
 		err := startNodeCmd.Parse(os.Args[2:])
 		checkErr(err)
@@ -116,12 +1312,105 @@ func (cli *CLI) Run() {
 	case "createWallet":
 		err := createWalletCMD.Parse(os.Args[2:])
 		checkErr(err)
+	case "restorewallet":
+		err := restoreWalletCMD.Parse(os.Args[2:])
+		checkErr(err)
 	case "listaddress":
 		err := listAddressCMD.Parse(os.Args[2:])
 		checkErr(err)
+	case "importaddress":
+		err := importAddressCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "importprivkey":
+		err := importPrivKeyCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "dumpprivkey":
+		err := dumpPrivKeyCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "signmessage":
+		err := signMessageCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "verifymessage":
+		err := verifyMessageCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "setlabel":
+		err := setLabelCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "importpubkey":
+		err := importPubKeyCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "addmultisigaddress":
+		err := addMultiSigCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "addtimelockaddress":
+		err := addTimeLockCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "initiate":
+		err := initiateCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "redeem":
+		err := redeemCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "refund":
+		err := refundCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "auditcontract":
+		err := auditContractCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "extractsecret":
+		err := extractSecretCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "senddata":
+		err := sendDataCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "finddata":
+		err := findDataCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "addscript":
+		err := addScriptCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "decodescript":
+		err := decodeScriptCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "validateaddress":
+		err := validateAddressCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "walletbalance":
+		err := walletBalanceCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "encryptwallet":
+		err := encryptWalletCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "walletpassphrase":
+		err := walletPassphraseCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "walletpassphrasechange":
+		err := walletPassphraseChangeCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "walletlock":
+		err := walletLockCMD.Parse(os.Args[2:])
+		checkErr(err)
 	case "send":
 		err := sendCmd.Parse(os.Args[2:])
 		checkErr(err)
+	case "createpsbt":
+		err := createPSBTCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "signpsbt":
+		err := signPSBTCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "combinepsbt":
+		err := combinePSBTCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "finalizepsbt":
+		err := finalizePSBTCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "crowdfund":
+		err := crowdfundCMD.Parse(os.Args[2:])
+		checkErr(err)
+	case "pledge":
+		err := pledgeCMD.Parse(os.Args[2:])
+		checkErr(err)
 	case "getbalance":
 		err := getBalanceCMD.Parse(os.Args[2:])
 		checkErr(err)
@@ -149,35 +1438,287 @@ func (cli *CLI) Run() {
 		cli.getBalance(*getBalanceAddress)
 	}
 	if sendCmd.Parsed() {
-		if *sendFrom == "" || *sendTo == "" || *sendAmount <= 0 {
+		payments := collectPayments(sendPayments, *sendTo, *sendAmount, *sendPayFile)
+		if *sendFrom == "" || len(payments) == 0 {
+			os.Exit(1)
+		}
+		if *sendFeeRate < 0 {
+			sendCmd.Usage()
+			os.Exit(1)
+		}
+		cli.send(nodeID, *sendFrom, payments, *sendCoinSelect, *sendFeeRate, *sendDryRun)
+	}
+	if createPSBTCMD.Parsed() {
+		payments := collectPayments(createPSBTPayments, *createPSBTTo, *createPSBTAmount, *createPSBTPayFile)
+		if *createPSBTFrom == "" || len(payments) == 0 || *createPSBTOut == "" || *createPSBTFeeRate < 0 {
+			createPSBTCMD.Usage()
+			os.Exit(1)
+		}
+		cli.createPSBT(*createPSBTFrom, payments, *createPSBTCoinSelect, *createPSBTFeeRate, *createPSBTLockTime, *createPSBTOut)
+	}
+	if signPSBTCMD.Parsed() {
+		if *signPSBTIn == "" {
+			signPSBTCMD.Usage()
 			os.Exit(1)
 		}
-		cli.send(*sendFrom, *sendTo, *sendAmount)
+		if *signPSBTOut == "" {
+			*signPSBTOut = *signPSBTIn
+		}
+		cli.signPSBT(*signPSBTIn, *signPSBTOut, *signPSBTSigHash)
+	}
+	if combinePSBTCMD.Parsed() {
+		if *combinePSBTIn == "" || *combinePSBTOut == "" {
+			combinePSBTCMD.Usage()
+			os.Exit(1)
+		}
+		cli.combinePSBT(strings.Split(*combinePSBTIn, ","), *combinePSBTOut)
+	}
+	if crowdfundCMD.Parsed() {
+		payments := collectPayments(crowdfundPayments, *crowdfundTo, *crowdfundAmount, *crowdfundPayFile)
+		if len(payments) == 0 || *crowdfundOut == "" {
+			crowdfundCMD.Usage()
+			os.Exit(1)
+		}
+		cli.crowdfund(payments, *crowdfundOut)
+	}
+	if pledgeCMD.Parsed() {
+		if *pledgeIn == "" || *pledgeFrom == "" || *pledgeAmount <= 0 {
+			pledgeCMD.Usage()
+			os.Exit(1)
+		}
+		if *pledgeOut == "" {
+			*pledgeOut = *pledgeIn
+		}
+		cli.pledge(*pledgeIn, *pledgeFrom, *pledgeAmount, *pledgeCoinSelect, *pledgeOut)
+	}
+	if finalizePSBTCMD.Parsed() {
+		if *finalizePSBTIn == "" {
+			finalizePSBTCMD.Usage()
+			os.Exit(1)
+		}
+		cli.finalizePSBT(nodeID, *finalizePSBTIn, *finalizePSBTNode)
 	}
 	if createWalletCMD.Parsed() {
-		cli.createWallet()
+		cli.createWallet(*createWalletMnemonic, *createWalletPassphrase)
+	}
+	if restoreWalletCMD.Parsed() {
+		if *restoreWalletMnemonic == "" {
+			restoreWalletCMD.Usage()
+			os.Exit(1)
+		}
+		cli.restoreWallet(*restoreWalletMnemonic, *restoreWalletPassphrase)
 	}
 	if listAddressCMD.Parsed() {
 		cli.listAddress()
 	}
+	if importAddressCMD.Parsed() {
+		if *importAddressAddress == "" {
+			importAddressCMD.Usage()
+			os.Exit(1)
+		}
+		cli.importWatchOnly(*importAddressAddress, "", *importAddressLabel)
+	}
+	if importPubKeyCMD.Parsed() {
+		if *importPubKeyPubKey == "" {
+			importPubKeyCMD.Usage()
+			os.Exit(1)
+		}
+		cli.importWatchOnly("", *importPubKeyPubKey, *importPubKeyLabel)
+	}
+	if addMultiSigCMD.Parsed() {
+		if *addMultiSigKeys == "" {
+			addMultiSigCMD.Usage()
+			os.Exit(1)
+		}
+		cli.addMultiSigAddress(*addMultiSigM, *addMultiSigKeys, *addMultiSigLabel)
+	}
+	if addTimeLockCMD.Parsed() {
+		locks := 0
+		for _, set := range []bool{*addTimeLockHeight != 0, *addTimeLockTime != "", *addTimeLockBlocks != 0, *addTimeLockAfter != 0} {
+			if set {
+				locks++
+			}
+		}
+		if *addTimeLockAddress == "" || locks != 1 {
+			addTimeLockCMD.Usage()
+			os.Exit(1)
+		}
+		cli.addTimeLockAddress(*addTimeLockAddress, *addTimeLockHeight, *addTimeLockTime, *addTimeLockBlocks, *addTimeLockAfter, *addTimeLockLabel)
+	}
+	if initiateCMD.Parsed() {
+		if *initiateFrom == "" || *initiateTo == "" || *initiateAmount <= 0 || *initiateFeeRate < 0 {
+			initiateCMD.Usage()
+			os.Exit(1)
+		}
+		cli.initiate(*initiateFrom, *initiateTo, *initiateAmount, *initiateSecretHash, *initiateTimeout, *initiateHeight, *initiateFeeRate)
+	}
+	if redeemCMD.Parsed() {
+		if *redeemContract == "" || *redeemTxID == "" || *redeemSecret == "" || *redeemFeeRate < 0 {
+			redeemCMD.Usage()
+			os.Exit(1)
+		}
+		cli.spendContract(*redeemContract, *redeemTxID, *redeemSecret, *redeemTo, false, *redeemFeeRate)
+	}
+	if refundCMD.Parsed() {
+		if *refundContract == "" || *refundTxID == "" || *refundFeeRate < 0 {
+			refundCMD.Usage()
+			os.Exit(1)
+		}
+		cli.spendContract(*refundContract, *refundTxID, "", *refundTo, true, *refundFeeRate)
+	}
+	if sendDataCMD.Parsed() {
+		if *sendDataFrom == "" || (*sendDataHex == "") == (*sendDataFile == "") || *sendDataFeeRate < 0 {
+			sendDataCMD.Usage()
+			os.Exit(1)
+		}
+		cli.sendData(*sendDataFrom, parseDataArg(*sendDataHex, *sendDataFile), *sendDataFeeRate)
+	}
+	if findDataCMD.Parsed() {
+		if (*findDataHex == "") == (*findDataFile == "") {
+			findDataCMD.Usage()
+			os.Exit(1)
+		}
+		cli.findData(parseDataArg(*findDataHex, *findDataFile))
+	}
+	if auditContractCMD.Parsed() {
+		if *auditContractContract == "" || *auditContractTxID == "" {
+			auditContractCMD.Usage()
+			os.Exit(1)
+		}
+		cli.auditContract(*auditContractContract, *auditContractTxID)
+	}
+	if extractSecretCMD.Parsed() {
+		if *extractSecretTxID == "" || *extractSecretHash == "" {
+			extractSecretCMD.Usage()
+			os.Exit(1)
+		}
+		cli.extractSecret(*extractSecretTxID, *extractSecretHash)
+	}
+	if addScriptCMD.Parsed() {
+		if (*addScriptHex == "") == (*addScriptAsm == "") {
+			addScriptCMD.Usage()
+			os.Exit(1)
+		}
+		cli.addScript(*addScriptHex, *addScriptAsm, *addScriptLabel)
+	}
+	if decodeScriptCMD.Parsed() {
+		if (*decodeScriptHex == "") == (*decodeScriptAsm == "") {
+			decodeScriptCMD.Usage()
+			os.Exit(1)
+		}
+		cli.decodeScript(*decodeScriptHex, *decodeScriptAsm)
+	}
+	if validateAddressCMD.Parsed() {
+		if *validateAddressAddress == "" {
+			validateAddressCMD.Usage()
+			os.Exit(1)
+		}
+		cli.validateAddress(*validateAddressAddress)
+	}
+	if importPrivKeyCMD.Parsed() {
+		if *importPrivKeyWIF == "" {
+			importPrivKeyCMD.Usage()
+			os.Exit(1)
+		}
+		cli.importPrivKey(*importPrivKeyWIF, *importPrivKeyLabel, *importPrivKeyRescan)
+	}
+	if dumpPrivKeyCMD.Parsed() {
+		if *dumpPrivKeyAddress == "" {
+			dumpPrivKeyCMD.Usage()
+			os.Exit(1)
+		}
+		cli.dumpPrivKey(*dumpPrivKeyAddress)
+	}
+	if signMessageCMD.Parsed() {
+		if *signMessageAddress == "" {
+			signMessageCMD.Usage()
+			os.Exit(1)
+		}
+		cli.signMessage(*signMessageAddress, *signMessageMessage)
+	}
+	if verifyMessageCMD.Parsed() {
+		if *verifyMessageAddress == "" || *verifyMessageSignature == "" {
+			verifyMessageCMD.Usage()
+			os.Exit(1)
+		}
+		cli.verifyMessage(*verifyMessageAddress, *verifyMessageSignature, *verifyMessageMessage)
+	}
+	if setLabelCMD.Parsed() {
+		if *setLabelAddress == "" {
+			setLabelCMD.Usage()
+			os.Exit(1)
+		}
+		cli.setLabel(*setLabelAddress, *setLabelLabel)
+	}
+	if walletBalanceCMD.Parsed() {
+		cli.walletBalance()
+	}
+	if encryptWalletCMD.Parsed() {
+		cli.encryptWallet(*encryptWalletPassphrase)
+	}
+	if walletPassphraseCMD.Parsed() {
+		cli.walletPassphrase(nodeID, *walletPassphrasePassphrase, *walletPassphraseTimeout)
+	}
+	if walletPassphraseChangeCMD.Parsed() {
+		cli.walletPassphraseChange(*walletPassphraseChangeOld, *walletPassphraseChangeNew)
+	}
+	if walletLockCMD.Parsed() {
+		cli.walletLock(nodeID)
+	}
 	if getBestHeightCMD.Parsed() {
 		cli.getBestHeight()
 	}
+	if listBannedCMD.Parsed() {
+		cli.listBanned()
+	}
+	if setBanCMD.Parsed() {
+		if *setBanAddr == "" {
+			setBanCMD.Usage()
+			os.Exit(1)
+		}
+		cli.setBan(*setBanAddr, *setBanDuration, *setBanRemove)
+	}
+	if clearBannedCMD.Parsed() {
+		cli.clearBanned()
+	}
+	if startLightCMD.Parsed() {
+		cli.startLight(nodeID, *startLightFPRate)
+	}
+	if lightBalanceCMD.Parsed() {
+		if *lightBalanceAddress == "" {
+			lightBalanceCMD.Usage()
+			os.Exit(1)
+		}
+		cli.lightBalance(nodeID, *lightBalanceAddress)
+	}
+	if simnetCMD.Parsed() {
+		if *simnetNodes < 2 {
+			simnetCMD.Usage()
+			os.Exit(1)
+		}
+		if !cli.simnet(*simnetNodes, *simnetBlocks, *simnetLatency, *simnetJitter, *simnetDrop, *simnetPartition, *simnetTimeout) {
+			os.Exit(1)
+		}
+	}
 	if startNodeCmd.Parsed() {
 		nodeID := os.Getenv("NODE_ID")
 		if nodeID == "" {
 			startNodeCmd.Usage()
 			os.Exit(1)
 		}
-		cli.stratNode(nodeID, *startNodeMinner)
+		if *startNodeSecure != secureOff && *startNodeSecure != securePrefer && *startNodeSecure != secureRequire {
+			startNodeCmd.Usage()
+			os.Exit(1)
+		}
+		cli.stratNode(nodeID, *startNodeMinner, *startNodeCompact, *startNodeSecure)
 	}
 }
 func (cli *CLI) getBestHeight() {
 
-	fmt.Println(cli.bc.GetBestHeight())
+	fmt.Println(cli.blockchain().GetBestHeight())
 }
 
-func (cli *CLI) stratNode(nodeID string, minnerAddress string) {
+func (cli *CLI) stratNode(nodeID string, minnerAddress string, compact bool, secure string) {
 	fmt.Printf("starting node%s", nodeID)
 
 	if len(minnerAddress) > 0 {
@@ -187,5 +1728,134 @@ func (cli *CLI) stratNode(nodeID string, minnerAddress string) {
 			log.Panic("error minner address")
 		}
 	}
-	startServer(nodeID, minnerAddress, cli.bc)
+	startServer(nodeID, minnerAddress, compact, secure, cli.blockchain())
+}
+
+func (cli *CLI) listBanned() {
+	bl, err := LoadBanList(banFile)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	for addr, until := range bl.Bans {
+		fmt.Printf("%s banned until %s\n", addr, time.Unix(until, 0).Format(time.RFC3339))
+	}
+}
+
+func (cli *CLI) setBan(addr string, duration time.Duration, remove bool) {
+	bl, err := LoadBanList(banFile)
+	if err == nil && remove {
+		err = bl.Unban(addr)
+	} else if err == nil {
+		err = bl.Ban(addr, duration)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if remove {
+		fmt.Printf("unbanned %s\n", addr)
+	} else {
+		fmt.Printf("banned %s for %s\n", addr, duration)
+	}
+}
+
+// 封禁列表损坏时也可以用它清空
+func (cli *CLI) clearBanned() {
+	bl, _ := LoadBanList(banFile)
+	if err := bl.Clear(); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("cleared all bans")
+}
+
+// 在进程内的模拟网络中运行多个节点，挖出若干区块后检查所有节点是否同步到同一个最新区块
+func (cli *CLI) simnet(nodes, blocks int, latency, jitter time.Duration, drop float64, partition bool, timeout time.Duration) bool {
+	cluster, err := NewSimCluster(nodes, time.Now().UnixNano())
+	checkErr(err)
+	defer cluster.Close()
+
+	// 等待所有节点与种子节点完成握手
+	deadline := time.Now().Add(timeout)
+	for len(cluster.Servers[0].nodes()) < nodes && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cluster.Network.SetConditions(latency, jitter, drop)
+
+	if partition {
+		var left, right []string
+		for i := range cluster.Servers {
+			if i < nodes/2 {
+				left = append(left, simNodeAddress(i))
+			} else {
+				right = append(right, simNodeAddress(i))
+			}
+		}
+		cluster.Network.Partition(left, right)
+
+		// 两个分区各自挖矿，左边的链更长
+		for i := 0; i < blocks/2; i++ {
+			cluster.Mine(nodes - 1)
+		}
+		for i := 0; i < blocks; i++ {
+			cluster.Mine(0)
+		}
+		cluster.Network.Heal()
+		fmt.Println("partition healed")
+	} else {
+		for i := 0; i < blocks; i++ {
+			cluster.Mine(0)
+		}
+	}
+	// 最后一个区块把各节点都带到最长链上
+	cluster.Mine(0)
+
+	if !cluster.WaitConverged(timeout) {
+		fmt.Println("nodes did not converge:")
+		for _, s := range cluster.Servers {
+			fmt.Printf("  %s height %d tip %x\n", s.address, s.bc.GetBestHeight(), s.bc.Tip())
+		}
+		return false
+	}
+	fmt.Printf("%d nodes converged on height %d tip %x\n", nodes, cluster.Servers[0].bc.GetBestHeight(), cluster.Servers[0].bc.Tip())
+	return true
+}
+
+// 以轻节点模式运行，跟踪wallet.dat中所有地址的交易
+func (cli *CLI) startLight(nodeID string, fpRate float64) {
+	wallets, _ := NewWallets()
+
+	mine, watchOnly := wallets.PubkeyHashes()
+	pubkeyHashes := append(mine, watchOnly...)
+	fmt.Printf("tracking %d addresses\n", len(pubkeyHashes))
+
+	address := fmt.Sprintf("localhost:%s", nodeID)
+	lc := NewLightClient(address, lightDBFile(nodeID), tcpTransport{}, defaultSeeds, pubkeyHashes)
+	if fpRate > 0 {
+		lc.UseBloomFilter(fpRate)
+	}
+	fmt.Printf("starting light client %s\n", address)
+
+	err := lc.Start()
+	checkErr(err)
+}
+
+func (cli *CLI) lightBalance(nodeID, address string) {
+	pubkeyHash, err := addressToPubkeyHash(address)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	lc := NewLightClient("", lightDBFile(nodeID), nil, nil, [][]byte{pubkeyHash})
+	defer lc.Stop()
+
+	height := int32(-1)
+	if tip := lc.tip(); tip != nil {
+		height = tip.Height
+	}
+	fmt.Printf("balance of %s:%d (headers synced to height %d)\n", address, lc.Balance(pubkeyHash), height)
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 选币：从地址的未花费输出中挑选本次交易的输入。不同的策略在手续费、
+// 输出碎片化与隐私之间取舍，发送时用 -coinselect 指定
+
+// 估算交易大小用的字节数
+const (
+	txBaseSize   = 64
+	txInputSize  = 180 // 交易id、索引、签名与公钥
+	txOutputSize = 40
+)
+
+const bnbMaxTries = 100000 // 分支定界最多尝试的次数
+
+var errInsufficientFunds = errors.New("Error:Not enough funds")
+
+// 可以花费的输出
+type Coin struct {
+	TxID  []byte
+	Index int
+	Value int
+}
+
+type CoinSelector interface {
+	// 选出足够支付target以及手续费的输出，outputs是不含找零的输出个数
+	Select(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error)
+}
+
+// 手续费规则
+type FeePolicy struct {
+	Rate int // 每千字节的手续费
+}
+
+// inputs个输入、outputs个输出的交易需要的手续费
+func (f FeePolicy) Fee(inputs, outputs int) int {
+	size := txBaseSize + inputs*txInputSize + outputs*txOutputSize
+	return (size*f.Rate + 999) / 1000
+}
+
+// 单独一个输入或输出的手续费，向上取整，所以各部分之和不少于整个交易的手续费
+func (f FeePolicy) inputFee() int {
+	return (txInputSize*f.Rate + 999) / 1000
+}
+
+func (f FeePolicy) outputFee() int {
+	return (txOutputSize*f.Rate + 999) / 1000
+}
+
+// 找零不超过以后花费它的手续费时就是粉尘，不创建找零输出，直接计入手续费
+func (f FeePolicy) IsDust(value int) bool {
+	return value <= 0 || value <= f.inputFee()
+}
+
+// 根据选中的输出计算手续费与找零，outputs是不含找零的输出个数
+func (f FeePolicy) Change(selected []Coin, target, outputs int) (fee, change int, err error) {
+	total := 0
+	for _, coin := range selected {
+		total += coin.Value
+	}
+
+	change = total - target - f.Fee(len(selected), outputs+1)
+	if !f.IsDust(change) {
+		return total - target - change, change, nil
+	}
+
+	fee = total - target
+	if fee < f.Fee(len(selected), outputs) {
+		return 0, 0, errInsufficientFunds
+	}
+	return fee, 0, nil
+}
+
+var coinSelectors = map[string]CoinSelector{
+	"largest":  largestFirst{},
+	"smallest": smallestFirst{},
+	"bnb":      branchAndBound{largestFirst{}},
+	"privacy":  privacySelector{},
+}
+
+const defaultCoinSelector = "bnb"
+
+func coinSelectorByName(name string) (CoinSelector, error) {
+	selector, ok := coinSelectors[name]
+	if !ok {
+		var names []string
+		for n := range coinSelectors {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		return nil, fmt.Errorf("unknown coin selection %q, use one of %s", name, strings.Join(names, ", "))
+	}
+	return selector, nil
+}
+
+// 按顺序累加，直到足够支付target与不带找零时的手续费
+func accumulate(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error) {
+	var selected []Coin
+	total := 0
+	for _, coin := range coins {
+		selected = append(selected, coin)
+		total += coin.Value
+		if total >= target+fees.Fee(len(selected), outputs) {
+			return selected, nil
+		}
+	}
+	return nil, errInsufficientFunds
+}
+
+// 优先花费最大的输出，输入最少，手续费最低
+type largestFirst struct{}
+
+func (largestFirst) Select(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error) {
+	sorted := append([]Coin{}, coins...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value > sorted[j].Value })
+	return accumulate(sorted, target, outputs, fees)
+}
+
+// 优先花费最小的输出，把碎片化的输出合并起来，手续费较高
+type smallestFirst struct{}
+
+func (smallestFirst) Select(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error) {
+	sorted := append([]Coin{}, coins...)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].Value < sorted[j].Value })
+	return accumulate(sorted, target, outputs, fees)
+}
+
+// 分支定界：寻找不需要找零的组合，多出的部分不超过创建并花费一个找零输出的手续费，
+// 在所有这样的组合中选浪费最少的。找不到时使用fallback
+type branchAndBound struct {
+	fallback CoinSelector
+}
+
+func (s branchAndBound) Select(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error) {
+	if selected := exactMatch(coins, target, outputs, fees); selected != nil {
+		return selected, nil
+	}
+	return s.fallback.Select(coins, target, outputs, fees)
+}
+
+func exactMatch(coins []Coin, target, outputs int, fees FeePolicy) []Coin {
+	// 有效价值：面值减去花费它的手续费，手续费比面值还高的输出不参与
+	var candidates []Coin
+	for _, coin := range coins {
+		if coin.Value > fees.inputFee() {
+			candidates = append(candidates, coin)
+		}
+	}
+	effective := func(c Coin) int { return c.Value - fees.inputFee() }
+	sort.SliceStable(candidates, func(i, j int) bool { return effective(candidates[i]) > effective(candidates[j]) })
+
+	// remaining[i]是第i个及之后所有候选输出的有效价值之和
+	remaining := make([]int, len(candidates)+1)
+	for i := len(candidates) - 1; i >= 0; i-- {
+		remaining[i] = remaining[i+1] + effective(candidates[i])
+	}
+
+	low := target + fees.Fee(0, outputs)
+	high := low + fees.outputFee() + fees.inputFee() // 多出的部分不超过找零输出的成本
+
+	var best []int
+	bestWaste := -1
+	tries := 0
+	var chosen []int
+
+	var search func(i, sum int)
+	search = func(i, sum int) {
+		tries++
+		if tries > bnbMaxTries || sum > high || sum+remaining[i] < low {
+			return
+		}
+		if sum >= low {
+			// 各部分的手续费分别取整，最后用实际的手续费确认确实不需要找零
+			if waste := sum - low; (bestWaste < 0 || waste < bestWaste) && noChange(candidates, chosen, target, outputs, fees) {
+				bestWaste = waste
+				best = append([]int{}, chosen...)
+			}
+			return
+		}
+		if i == len(candidates) {
+			return
+		}
+
+		// 上一个输出等值且没有被选中时，选它与选上一个的结果相同，已经搜索过了
+		skippedTwin := i > 0 && effective(candidates[i]) == effective(candidates[i-1]) &&
+			(len(chosen) == 0 || chosen[len(chosen)-1] != i-1)
+		if !skippedTwin {
+			chosen = append(chosen, i)
+			search(i+1, sum+effective(candidates[i]))
+			chosen = chosen[:len(chosen)-1]
+		}
+
+		search(i+1, sum)
+	}
+	search(0, 0)
+
+	if best == nil {
+		return nil
+	}
+	selected := make([]Coin, len(best))
+	for i, index := range best {
+		selected[i] = candidates[index]
+	}
+	return selected
+}
+
+func noChange(candidates []Coin, chosen []int, target, outputs int, fees FeePolicy) bool {
+	selected := make([]Coin, len(chosen))
+	for i, index := range chosen {
+		selected[i] = candidates[index]
+	}
+	_, change, err := fees.Change(selected, target, outputs)
+	return err == nil && change == 0
+}
+
+// 注重隐私：优先不产生找零，避免找零输出暴露哪一个输出属于发送方；
+// 否则按随机顺序选择，不让别人从输入推断出钱包中输出的大小分布
+type privacySelector struct{}
+
+func (privacySelector) Select(coins []Coin, target, outputs int, fees FeePolicy) ([]Coin, error) {
+	if selected := exactMatch(coins, target, outputs, fees); selected != nil {
+		return selected, nil
+	}
+
+	shuffled := append([]Coin{}, coins...)
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	r.Shuffle(len(shuffled), func(i, j int) { shuffled[i], shuffled[j] = shuffled[j], shuffled[i] })
+	return accumulate(shuffled, target, outputs, fees)
+}
@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// 紧凑区块：只携带区块头、交易的短ID以及对方不可能拥有的交易（coinbase），
+// 接收方用自己交易池中的交易还原区块，只向发送方请求缺失的交易
+
+const shortIDLength = 6
+
+const maxPartialBlocks = 16 // 同时等待缺失交易的区块数量上限
+
+const partialBlockTimeout = 30 * time.Second // 超过这个时间还没收到缺失交易的区块会被丢弃
+
+type prefilledTx struct {
+	Index int    // 交易在区块中的位置
+	Tx    []byte // 序列化后的交易
+}
+
+type cmpctblock struct {
+	AddrFrom  string
+	Header    []byte   // 序列化的区块头
+	Nonce     uint64   // 计算短ID时使用的随机数，防止构造碰撞
+	ShortIDs  [][]byte // 没有预先填充的交易的短ID，按区块中的顺序排列
+	Prefilled []prefilledTx
+}
+
+type getblocktxn struct {
+	AddrFrom  string
+	BlockHash []byte
+	Indexes   []int // 缺失的交易在区块中的位置
+}
+
+type blocktxn struct {
+	AddrFrom    string
+	BlockHash   []byte
+	Transations [][]byte
+}
+
+// 正在还原的区块
+type partialBlock struct {
+	header      *BlockHeader
+	transations []*Transation // 尚未还原的位置为nil
+	missing     []int
+	peer        string    // 发来区块的节点的身份（见peerKey），只接受它发回的交易
+	time        time.Time // 发出请求的时间
+}
+
+// 交易的短ID：sha256(区块哈希 || nonce || 交易ID) 的前6个字节
+func shortTxID(blockHash []byte, nonce uint64, txID []byte) []byte {
+	var n [8]byte
+	binary.LittleEndian.PutUint64(n[:], nonce)
+
+	hash := sha256.Sum256(bytes.Join([][]byte{blockHash, n[:], txID}, []byte{}))
+	return hash[:shortIDLength]
+}
+
+// 记录对方是否支持紧凑区块
+func (s *Server) setCompactPeer(addr string, compact bool) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	s.compactPeers[addr] = compact
+}
+
+func (s *Server) isCompactPeer(addr string) bool {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	return s.compact && s.compactPeers[addr]
+}
+
+// 构建紧凑区块，coinbase交易总是预先填充
+func (s *Server) newCompactBlock(block *Block) *cmpctblock {
+	var nonce [8]byte
+	_, err := rand.Read(nonce[:])
+	checkErr(err)
+
+	cb := &cmpctblock{
+		AddrFrom: s.address,
+		Header:   block.Header().Serialize(),
+		Nonce:    binary.LittleEndian.Uint64(nonce[:]),
+	}
+
+	for i, tx := range block.Transations {
+		if tx.IsCoinBase() {
+			cb.Prefilled = append(cb.Prefilled, prefilledTx{i, tx.Serialize()})
+			continue
+		}
+		cb.ShortIDs = append(cb.ShortIDs, shortTxID(block.Hash, cb.Nonce, tx.ID))
+	}
+	return cb
+}
+
+// 向所有已知节点广播新区块，支持紧凑区块的节点只收到紧凑区块，轻节点只收到区块哈希
+func (s *Server) announceBlock(block *Block, except string) {
+	for _, node := range s.nodes() {
+		if node == s.address || node == except {
+			continue
+		}
+		if s.isLightPeer(node) {
+			s.sendInv(node, "block", [][]byte{block.Hash})
+		} else if s.isCompactPeer(node) {
+			s.sendCmpctBlock(node, s.newCompactBlock(block))
+		} else {
+			s.sendBlock(node, block)
+		}
+	}
+}
+
+func (s *Server) sendCmpctBlock(addr string, cb *cmpctblock) {
+	payload := gobEncode(*cb)
+	request := append(commandToBytes("cmpctblock"), payload...)
+
+	s.sendData(addr, request)
+}
+
+// peer是连接确认过的发送者身份（见peerKey）
+func (s *Server) handleCmpctBlock(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload cmpctblock
+
+	buff.Write(request[commandLength:])
+
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed cmpctblock: %s", err)
+	}
+
+	header, err := ParseHeader(payload.Header)
+	if err != nil {
+		return misbehave(scoreMalformed, "cmpctblock: %s", err)
+	}
+	if s.bc.HasBlock(header.Hash) {
+		return nil
+	}
+	if !header.Validate() {
+		return misbehave(scoreInvalidHeader, "cmpctblock %x has invalid proof of work", header.Hash)
+	}
+	if !s.bc.HasBlock(header.PrevBlockHash) {
+		s.sendGetHeaders(payload.AddrFrom, s.chainSync.locator(s.bc))
+		return nil
+	}
+
+	total := len(payload.ShortIDs) + len(payload.Prefilled)
+	if total > maxBlockTransations {
+		return misbehave(scoreOversized, "cmpctblock with %d transations", total)
+	}
+
+	pb := &partialBlock{header: header, transations: make([]*Transation, total)}
+	for _, p := range payload.Prefilled {
+		if p.Index < 0 || p.Index >= total || pb.transations[p.Index] != nil {
+			return misbehave(scoreMalformed, "cmpctblock prefilled index %d out of range", p.Index)
+		}
+		tx, err := ParseTransation(p.Tx)
+		if err != nil {
+			return misbehave(scoreMalformed, "malformed prefilled transation: %s", err)
+		}
+		pb.transations[p.Index] = tx
+	}
+
+	// 用交易池中的交易按短ID填充剩下的位置
+	pool := make(map[string]*Transation)
+	for _, tx := range s.mempoolTransations() {
+		pool[hex.EncodeToString(shortTxID(header.Hash, payload.Nonce, tx.ID))] = tx
+	}
+
+	next := 0
+	for i := range pb.transations {
+		if pb.transations[i] != nil {
+			continue
+		}
+		if next >= len(payload.ShortIDs) {
+			return misbehave(scoreMalformed, "cmpctblock short ids do not fill the block")
+		}
+		if tx := pool[hex.EncodeToString(payload.ShortIDs[next])]; tx != nil {
+			pb.transations[i] = tx
+		} else {
+			pb.missing = append(pb.missing, i)
+		}
+		next++
+	}
+
+	if len(pb.missing) == 0 {
+		return s.completeCompactBlock(pb, payload.AddrFrom)
+	}
+
+	pb.peer = peer
+	pb.time = time.Now()
+	s.addPartialBlock(hex.EncodeToString(header.Hash), pb)
+
+	fmt.Printf("cmpctblock %x missing %d transations\n", header.Hash, len(pb.missing))
+	s.sendGetBlockTxn(payload.AddrFrom, header.Hash, pb.missing)
+	return nil
+}
+
+// 记录等待缺失交易的区块。先丢弃超时的区块，数量仍达到上限时丢弃最早的一个
+func (s *Server) addPartialBlock(hash string, pb *partialBlock) {
+	s.compactMu.Lock()
+	defer s.compactMu.Unlock()
+
+	var oldest string
+	for h, p := range s.partialBlocks {
+		if time.Since(p.time) > partialBlockTimeout {
+			delete(s.partialBlocks, h)
+			continue
+		}
+		if oldest == "" || p.time.Before(s.partialBlocks[oldest].time) {
+			oldest = h
+		}
+	}
+	if len(s.partialBlocks) >= maxPartialBlocks {
+		delete(s.partialBlocks, oldest)
+	}
+	s.partialBlocks[hash] = pb
+}
+
+func (s *Server) sendGetBlockTxn(addr string, blockHash []byte, indexes []int) {
+	payload := gobEncode(getblocktxn{s.address, blockHash, indexes})
+	request := append(commandToBytes("getblocktxn"), payload...)
+
+	s.sendData(addr, request)
+}
+
+func (s *Server) handleGetBlockTxn(request []byte) error {
+	var buff bytes.Buffer
+	var payload getblocktxn
+
+	buff.Write(request[commandLength:])
+
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed getblocktxn: %s", err)
+	}
+
+	block, err := s.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		fmt.Printf("%s requested transations of unknown block %x\n", payload.AddrFrom, payload.BlockHash)
+		return nil
+	}
+
+	var txs [][]byte
+	for _, i := range payload.Indexes {
+		if i < 0 || i >= len(block.Transations) {
+			return misbehave(scoreMalformed, "getblocktxn index %d out of range", i)
+		}
+		txs = append(txs, block.Transations[i].Serialize())
+	}
+
+	data := gobEncode(blocktxn{s.address, payload.BlockHash, txs})
+	s.sendData(payload.AddrFrom, append(commandToBytes("blocktxn"), data...))
+	return nil
+}
+
+func (s *Server) handleBlockTxn(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload blocktxn
+
+	buff.Write(request[commandLength:])
+
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed blocktxn: %s", err)
+	}
+
+	hash := hex.EncodeToString(payload.BlockHash)
+
+	// 只接受被请求的节点发回的交易，其他节点不能抢先用错误的交易让区块还原失败。
+	// 比较的是连接确认过的身份，消息中的AddrFrom可以随意填写
+	s.compactMu.Lock()
+	pb := s.partialBlocks[hash]
+	if pb == nil || pb.peer != peer {
+		s.compactMu.Unlock()
+		return nil
+	}
+	delete(s.partialBlocks, hash)
+	s.compactMu.Unlock()
+
+	if len(payload.Transations) != len(pb.missing) {
+		return misbehave(scoreMalformed, "blocktxn with %d transations, want %d", len(payload.Transations), len(pb.missing))
+	}
+
+	for i, data := range payload.Transations {
+		tx, err := ParseTransation(data)
+		if err != nil {
+			return misbehave(scoreMalformed, "malformed transation in blocktxn: %s", err)
+		}
+		pb.transations[pb.missing[i]] = tx
+	}
+
+	return s.completeCompactBlock(pb, payload.AddrFrom)
+}
+
+// 还原出完整区块后校验merkle根；短ID碰撞导致校验失败时，退回到请求完整区块
+func (s *Server) completeCompactBlock(pb *partialBlock, from string) error {
+	h := pb.header
+	block := &Block{*h, pb.transations}
+
+	if !block.ValidateMerkleRoot() {
+		fmt.Printf("cmpctblock %x failed to reconstruct, fetch full block\n", h.Hash)
+		s.sendGetData(from, "block", h.Hash)
+		return nil
+	}
+
+	return s.acceptBlock(block, from)
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestAddPartialBlockEvicts(t *testing.T) {
+	s := NewServer("sim:0", "", nil, nil, nil)
+	for i := 0; i < maxPartialBlocks+5; i++ {
+		s.addPartialBlock(fmt.Sprint(i), &partialBlock{peer: "sim:1", time: time.Now().Add(time.Duration(i) * time.Millisecond)})
+	}
+	if len(s.partialBlocks) != maxPartialBlocks {
+		t.Fatalf("%d partial blocks, limit is %d", len(s.partialBlocks), maxPartialBlocks)
+	}
+	if s.partialBlocks["0"] != nil || s.partialBlocks[fmt.Sprint(maxPartialBlocks+4)] == nil {
+		t.Fatal("did not evict the oldest partial block")
+	}
+
+	s.partialBlocks = map[string]*partialBlock{"stale": {time: time.Now().Add(-2 * partialBlockTimeout)}}
+	s.addPartialBlock("new", &partialBlock{time: time.Now()})
+	if s.partialBlocks["stale"] != nil {
+		t.Fatal("kept a timed out partial block")
+	}
+}
+
+func TestBlockTxnOnlyFromRequestedPeer(t *testing.T) {
+	s := NewServer("sim:0", "", nil, nil, nil)
+	hash := []byte{1, 2}
+	key := hex.EncodeToString(hash)
+	s.partialBlocks[key] = &partialBlock{peer: "sim:1", missing: []int{0}, time: time.Now()}
+
+	// 另一个连接在消息中冒充被请求的节点
+	request := append(commandToBytes("blocktxn"), gobEncode(blocktxn{"sim:1", hash, [][]byte{{1}}})...)
+	if err := s.handleBlockTxn(request, "sim:2"); err != nil {
+		t.Fatal(err)
+	}
+	if s.partialBlocks[key] == nil {
+		t.Fatal("blocktxn from another connection consumed the partial block")
+	}
+
+	if err := s.handleBlockTxn(request, "sim:1"); err == nil {
+		t.Fatal("malformed transation from the requested peer accepted")
+	}
+	if s.partialBlocks[key] != nil {
+		t.Fatal("blocktxn from the requested peer did not consume the partial block")
+	}
+}
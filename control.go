@@ -0,0 +1,140 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// 本机的控制端口，管理运行中节点的指令只从这里接受，P2P端口不处理它们。
+// 控制端口只监听回环地址上的随机端口，启动时生成随机口令，与监听地址一起写入数据目录中的cookie文件，
+// 每个请求都要带上口令。所有节点都运行在同一台机器上时，能读取这个文件才说明请求来自这个节点的用户
+
+const controlTimeout = 30 * time.Second
+
+func controlCookieFile(nodeID string) string {
+	return fmt.Sprintf("control_%s.cookie", nodeID)
+}
+
+type controlRequest struct {
+	Token   string
+	Command string
+	Payload []byte
+}
+
+type controlReply struct {
+	Error string
+}
+
+// 打开控制端口，写入cookie文件
+func (s *Server) startControl(nodeID string) error {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return err
+	}
+	token := make([]byte, 32)
+	if _, err := rand.Read(token); err != nil {
+		ln.Close()
+		return err
+	}
+	file := controlCookieFile(nodeID)
+	cookie := fmt.Sprintf("%s\n%x\n", ln.Addr(), token)
+	if err := ioutil.WriteFile(file, []byte(cookie), 0600); err != nil {
+		ln.Close()
+		return err
+	}
+
+	s.nodesMu.Lock()
+	s.control = ln
+	s.controlFile = file
+	s.nodesMu.Unlock()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.handleControl(conn, hex.EncodeToString(token))
+		}
+	}()
+	return nil
+}
+
+// 关闭控制端口，删除cookie文件
+func (s *Server) stopControl() {
+	if s.control != nil {
+		s.control.Close()
+		os.Remove(s.controlFile)
+		s.control = nil
+	}
+}
+
+func (s *Server) handleControl(conn net.Conn, token string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	var req controlRequest
+	var reply controlReply
+	err := gob.NewDecoder(io.LimitReader(conn, maxMessageSize)).Decode(&req)
+	if err == nil && subtle.ConstantTimeCompare([]byte(req.Token), []byte(token)) != 1 {
+		err = errors.New("wrong control token")
+	}
+	if err == nil {
+		err = s.handleWalletCommand(req.Command, req.Payload)
+	}
+	if err != nil {
+		reply.Error = err.Error()
+	}
+	gob.NewEncoder(conn).Encode(&reply)
+}
+
+// 读取cookie文件，把指令发送给本机运行的节点，返回节点执行的结果。payload为nil时指令没有参数
+func sendControlCommand(nodeID, command string, payload interface{}) error {
+	data, err := ioutil.ReadFile(controlCookieFile(nodeID))
+	if os.IsNotExist(err) {
+		return fmt.Errorf("node %s is not running", nodeID)
+	}
+	if err != nil {
+		return err
+	}
+	lines := strings.Fields(string(data))
+	if len(lines) != 2 {
+		return fmt.Errorf("malformed %s", controlCookieFile(nodeID))
+	}
+
+	var buff bytes.Buffer
+	if payload != nil {
+		if err := gob.NewEncoder(&buff).Encode(payload); err != nil {
+			return err
+		}
+	}
+	conn, err := net.DialTimeout("tcp", lines[0], controlTimeout)
+	if err != nil {
+		return fmt.Errorf("node %s is not running", nodeID)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(controlTimeout))
+
+	err = gob.NewEncoder(conn).Encode(&controlRequest{lines[1], command, buff.Bytes()})
+	if err != nil {
+		return err
+	}
+	var reply controlReply
+	if err := gob.NewDecoder(conn).Decode(&reply); err != nil {
+		return err
+	}
+	if reply.Error != "" {
+		return errors.New(reply.Error)
+	}
+	return nil
+}
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// 共识数据的二进制编码，交易id、默克尔根、数据库以及网络消息中的交易与区块都使用它，与Go版本和gob的实现无关。
+// 网络消息的外层（地址、命令参数等）没有改变，仍然是gob，见server.go中的gobEncode
+//
+// 基本类型：
+//   uint32/int32/int64  定长小端
+//   varint              个数与长度，与比特币的CompactSize相同：小于0xfd时1字节，
+//                       否则为0xfd/0xfe/0xff加2/4/8字节小端，必须使用最短的形式
+//   bytes               varint长度 + 内容，空字段与nil的编码相同
+//
+// 交易（版本1）：
+//   uint32 版本 | varint 输入个数 | 输入... | varint 输出个数 | 输出... | uint32 锁定时间
+//   输入：bytes 交易id | int32 输出索引（coinbase为-1） | bytes 解锁脚本 | uint32 序号
+//   输出：int64 金额 | bytes 锁定脚本
+//   交易id不在编码中，是把所有解锁脚本置空之后编码的sha256；见证hash是完整编码的sha256
+//
+// 区块头：
+//   int32 版本 | bytes 前一个区块hash | bytes 默克尔根 | bytes 见证默克尔根 | int32 时间 | int32 难度 | int32 随机数
+//   区块hash是区块头编码的两次sha256，不在编码中；高度也不在编码中，由前一个区块头推出
+//
+// 区块体：varint 交易个数 | 交易...
+// 区块：区块头 | 区块体
+//
+// 数据库中的区块头（只用于数据库）：区块头 | int32 高度
+//
+// 未花费输出（只用于数据库）：varint 个数 | (int32 索引 | 输出)...
+
+const txVersion = 1 // 交易编码的版本，解码时拒绝其他版本
+
+var errNonCanonical = errors.New("non-canonical varint")
+
+type encoder struct {
+	bytes.Buffer
+}
+
+func (e *encoder) writeUint32(v uint32) {
+	var buf [4]byte
+	binary.LittleEndian.PutUint32(buf[:], v)
+	e.Write(buf[:])
+}
+
+func (e *encoder) writeInt32(v int32) {
+	e.writeUint32(uint32(v))
+}
+
+func (e *encoder) writeInt64(v int64) {
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(v))
+	e.Write(buf[:])
+}
+
+func (e *encoder) writeVarInt(n uint64) {
+	switch {
+	case n < 0xfd:
+		e.WriteByte(byte(n))
+	case n <= 0xffff:
+		e.WriteByte(0xfd)
+		var buf [2]byte
+		binary.LittleEndian.PutUint16(buf[:], uint16(n))
+		e.Write(buf[:])
+	case n <= 0xffffffff:
+		e.WriteByte(0xfe)
+		e.writeUint32(uint32(n))
+	default:
+		e.WriteByte(0xff)
+		e.writeInt64(int64(n))
+	}
+}
+
+func (e *encoder) writeBytes(b []byte) {
+	e.writeVarInt(uint64(len(b)))
+	e.Write(b)
+}
+
+// 解码器记录第一个错误，之后的读取都返回零值，调用方最后检查一次err
+type decoder struct {
+	data []byte
+	err  error
+}
+
+func (d *decoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > len(d.data) {
+		d.err = io.ErrUnexpectedEOF
+		return nil
+	}
+	b := d.data[:n]
+	d.data = d.data[n:]
+	return b
+}
+
+func (d *decoder) readUint32() uint32 {
+	b := d.next(4)
+	if b == nil {
+		return 0
+	}
+	return binary.LittleEndian.Uint32(b)
+}
+
+func (d *decoder) readInt32() int32 {
+	return int32(d.readUint32())
+}
+
+func (d *decoder) readInt64() int64 {
+	b := d.next(8)
+	if b == nil {
+		return 0
+	}
+	return int64(binary.LittleEndian.Uint64(b))
+}
+
+func (d *decoder) readVarInt() uint64 {
+	b := d.next(1)
+	if b == nil {
+		return 0
+	}
+	var n, min uint64
+	switch b[0] {
+	case 0xfd:
+		if b = d.next(2); b != nil {
+			n, min = uint64(binary.LittleEndian.Uint16(b)), 0xfd
+		}
+	case 0xfe:
+		n, min = uint64(d.readUint32()), 0x10000
+	case 0xff:
+		n, min = uint64(d.readInt64()), 0x100000000
+	default:
+		return uint64(b[0])
+	}
+	if d.err == nil && n < min {
+		d.err = errNonCanonical
+	}
+	return n
+}
+
+// 读取个数，每个元素至少占1字节，个数超过剩余字节数的消息一定是错误的，避免按个数分配大量内存
+func (d *decoder) readCount() int {
+	n := d.readVarInt()
+	if d.err == nil && n > uint64(len(d.data)) {
+		d.err = fmt.Errorf("count %d exceeds remaining %d bytes", n, len(d.data))
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+// 空字段解码为nil
+func (d *decoder) readBytes() []byte {
+	n := d.readCount()
+	if n == 0 {
+		return nil
+	}
+	return append([]byte{}, d.next(n)...)
+}
+
+// 整个输入都已读完，多余的字节说明编码不是规范的
+func (d *decoder) finish() error {
+	if d.err == nil && len(d.data) != 0 {
+		d.err = fmt.Errorf("%d trailing bytes", len(d.data))
+	}
+	return d.err
+}
+
+func (e *encoder) writeTransation(tx *Transation) {
+	e.writeUint32(txVersion)
+	e.writeVarInt(uint64(len(tx.Vin)))
+	for _, vin := range tx.Vin {
+		e.writeBytes(vin.TXid)
+		e.writeInt32(int32(vin.Voutindex))
+		e.writeBytes(vin.ScriptSig)
+		e.writeUint32(vin.Sequence)
+	}
+	e.writeVarInt(uint64(len(tx.Vout)))
+	for _, out := range tx.Vout {
+		e.writeTXOutput(out)
+	}
+	e.writeUint32(tx.LockTime)
+}
+
+func (e *encoder) writeTXOutput(out TXOutput) {
+	e.writeInt64(int64(out.Value))
+	e.writeBytes(out.ScriptPubKey)
+}
+
+// 解码交易，id由调用方根据内容计算
+func (d *decoder) readTransation() *Transation {
+	tx := &Transation{}
+	if version := d.readUint32(); d.err == nil && version != txVersion {
+		d.err = fmt.Errorf("unknown transation version %d", version)
+	}
+	for i, n := 0, d.readCount(); i < n; i++ {
+		var vin TXInput
+		vin.TXid = d.readBytes()
+		vin.Voutindex = int(d.readInt32())
+		vin.ScriptSig = d.readBytes()
+		vin.Sequence = d.readUint32()
+		tx.Vin = append(tx.Vin, vin)
+	}
+	for i, n := 0, d.readCount(); i < n; i++ {
+		out := d.readTXOutput()
+		out.index = i
+		tx.Vout = append(tx.Vout, out)
+	}
+	tx.LockTime = d.readUint32()
+	return tx
+}
+
+func (d *decoder) readTXOutput() TXOutput {
+	value := d.readInt64()
+	return TXOutput{int(value), d.readBytes(), -1}
+}
+
+func (e *encoder) writeHeader(h *BlockHeader) {
+	e.writeInt32(h.Version)
+	e.writeBytes(h.PrevBlockHash)
+	e.writeBytes(h.Merkleroot)
+	e.writeBytes(h.WitnessRoot)
+	e.writeInt32(h.Time)
+	e.writeInt32(h.Bits)
+	e.writeInt32(h.Nonce)
+}
+
+// 解码区块头并计算区块hash
+func (d *decoder) readHeader() *BlockHeader {
+	h := &BlockHeader{}
+	h.Version = d.readInt32()
+	h.PrevBlockHash = d.readBytes()
+	h.Merkleroot = d.readBytes()
+	h.WitnessRoot = d.readBytes()
+	h.Time = d.readInt32()
+	h.Bits = d.readInt32()
+	h.Nonce = d.readInt32()
+	h.Hash = h.computeHash()
+	return h
+}
+
+func (e *encoder) writeBody(txs []*Transation) {
+	e.writeVarInt(uint64(len(txs)))
+	for _, tx := range txs {
+		e.writeTransation(tx)
+	}
+}
+
+// 解码区块体并计算交易id
+func (d *decoder) readBody() []*Transation {
+	var txs []*Transation
+	for i, n := 0, d.readCount(); i < n; i++ {
+		tx := d.readTransation()
+		tx.ID = tx.unsignedHash()
+		txs = append(txs, tx)
+	}
+	return txs
+}
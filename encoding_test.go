@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestVarIntRoundTrip(t *testing.T) {
+	tests := []struct {
+		n    uint64
+		size int
+	}{
+		{0, 1}, {0xfc, 1}, {0xfd, 3}, {0xffff, 3}, {0x10000, 5}, {0xffffffff, 5}, {0x100000000, 9},
+	}
+	for _, test := range tests {
+		var e encoder
+		e.writeVarInt(test.n)
+		if len(e.Bytes()) != test.size {
+			t.Errorf("%#x: encoded in %d bytes, want %d", test.n, len(e.Bytes()), test.size)
+		}
+		dec := decoder{data: e.Bytes()}
+		if n := dec.readVarInt(); n != test.n || dec.finish() != nil {
+			t.Errorf("%#x: decoded %#x, %v", test.n, n, dec.finish())
+		}
+	}
+}
+
+func TestVarIntRejectsNonMinimal(t *testing.T) {
+	tests := [][]byte{
+		{0xfd, 0xfc, 0x00},
+		{0xfe, 0xff, 0xff, 0x00, 0x00},
+		{0xff, 0xff, 0xff, 0xff, 0xff, 0x00, 0x00, 0x00, 0x00},
+	}
+	for _, data := range tests {
+		dec := decoder{data: data}
+		dec.readVarInt()
+		if dec.finish() != errNonCanonical {
+			t.Errorf("%x: got %v, want %v", data, dec.finish(), errNonCanonical)
+		}
+	}
+}
+
+func TestTransationEncoding(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	prev := NewCoinbaseTX(addr, "prev")
+	tx := testSpend(w, prev, 0, addr, 50)
+	tx.Vin[0].Sequence = 7
+	tx.LockTime = 100
+	tx.ID = tx.unsignedHash()
+	data := tx.Serialize()
+
+	parsed, err := ParseTransation(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Serialize(), data) || !bytes.Equal(parsed.ID, tx.ID) {
+		t.Fatalf("round trip changed the transation:\n%s\n%s", tx, parsed)
+	}
+
+	// 偏移4是输入个数，只有一个输入，编码为1字节
+	modify := func(f func([]byte) []byte) []byte {
+		return f(append([]byte{}, data...))
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"non-minimal input count", modify(func(d []byte) []byte {
+			return append(append(d[:4:4], 0xfd, 0x01, 0x00), d[5:]...)
+		}), "non-canonical"},
+		{"trailing bytes", modify(func(d []byte) []byte { return append(d, 0) }), "trailing"},
+		{"truncated", modify(func(d []byte) []byte { return d[:len(d)-1] }), "unexpected EOF"},
+		{"unknown version", modify(func(d []byte) []byte { d[0] = 2; return d }), "unknown transation version"},
+		{"count exceeds data", modify(func(d []byte) []byte { d[4] = 0xfc; return d }), "exceeds remaining"},
+	}
+	for _, test := range tests {
+		_, err := ParseTransation(test.data)
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestBlockEncoding(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	prev := NewCoinbaseTX(addr, "prev")
+	block := NewBlock([]*Transation{testCoinbase(addr, "reward", subsidy), testSpend(w, prev, 0, addr, 50)}, make([]byte, 32), 1)
+	data := block.Serialize()
+
+	parsed, err := ParseBlock(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(parsed.Serialize(), data) || !bytes.Equal(parsed.Hash, block.Hash) || !parsed.ValidateMerkleRoot() {
+		t.Fatal("round trip changed the block")
+	}
+	header, err := ParseHeader(block.Header().Serialize())
+	if err != nil || !bytes.Equal(header.Hash, block.Hash) {
+		t.Fatalf("header round trip: %v", err)
+	}
+
+	// 区块头从版本开始，偏移4是前一个区块hash的长度
+	nonMinimal := append(append(append([]byte{}, data[:4]...), 0xfd, 32, 0), data[5:]...)
+	if _, err := ParseBlock(nonMinimal); err == nil || !strings.Contains(err.Error(), "non-canonical") {
+		t.Errorf("non-minimal hash length: got %v", err)
+	}
+	if _, err := ParseBlock(append(data, 0)); err == nil {
+		t.Error("trailing bytes accepted")
+	}
+	if _, err := ParseHeader(data); err == nil {
+		t.Error("header with a body accepted")
+	}
+}
+
+func TestTXOutputsEncoding(t *testing.T) {
+	outs := TXOutputs{[]TXOutput{{10, []byte{OP_1}, 0}, {20, nil, 3}}}
+	parsed := DeserializeTXOutputs(outs.SerializeTXOutputs())
+	if len(parsed.Outputs) != 2 {
+		t.Fatalf("decoded %d outputs", len(parsed.Outputs))
+	}
+	for i, out := range parsed.Outputs {
+		want := outs.Outputs[i]
+		if out.Value != want.Value || out.index != want.index || !bytes.Equal(out.ScriptPubKey, want.ScriptPubKey) {
+			t.Errorf("output %d: got %+v, want %+v", i, out, want)
+		}
+	}
+}
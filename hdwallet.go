@@ -0,0 +1,226 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// 分层确定性钱包：所有私钥都由一组助记词推导出来，抄下助记词就备份了整个钱包。
+// 助记词按BIP39生成，子私钥按BIP32推导，地址路径为BIP44的 m/44'/币种'/账户'/链/索引。
+// 我们使用P-256曲线，主私钥与子私钥的推导按照SLIP-0010中针对NIST P-256的规定
+
+const mnemonicEntropyBits = 128 // 12个单词
+
+const hardenedKeyStart = 0x80000000 // 大于等于它的索引为强化推导
+
+const (
+	hdPurpose  = 44
+	hdCoinType = 1 // 测试网络共用的币种编号
+)
+
+// BIP44中的两条链
+const (
+	externalChain = 0 // 收款地址
+	changeChain   = 1 // 找零地址
+)
+
+const hdGapLimit = 20 // 恢复钱包时，连续这么多个地址都没有被使用过就停止查找
+
+var masterKeySalt = []byte("Nist256p1 seed")
+
+var errInvalidMnemonic = errors.New("invalid mnemonic")
+
+var mnemonicWordList []string
+var mnemonicWordIndex map[string]int
+
+func init() {
+	mnemonicWordList = strings.Fields(englishWords)
+	mnemonicWordIndex = make(map[string]int, len(mnemonicWordList))
+	for i, word := range mnemonicWordList {
+		mnemonicWordIndex[word] = i
+	}
+}
+
+// 生成新的助记词
+func NewMnemonic() (string, error) {
+	entropy := make([]byte, mnemonicEntropyBits/8)
+	_, err := rand.Read(entropy)
+	if err != nil {
+		return "", err
+	}
+	return entropyToMnemonic(entropy), nil
+}
+
+// 熵后面接上sha256的前len/32位作为校验，每11位对应一个单词
+func entropyToMnemonic(entropy []byte) string {
+	checksumBits := uint(len(entropy) * 8 / 32)
+	hash := sha256.Sum256(entropy)
+
+	data := new(big.Int).SetBytes(append(append([]byte{}, entropy...), hash[0]))
+	data.Rsh(data, 8-checksumBits)
+
+	n := (len(entropy)*8 + int(checksumBits)) / 11
+	words := make([]string, n)
+	mask := big.NewInt(2047)
+	for i := n - 1; i >= 0; i-- {
+		words[i] = mnemonicWordList[new(big.Int).And(data, mask).Int64()]
+		data.Rsh(data, 11)
+	}
+	return strings.Join(words, " ")
+}
+
+// 检查助记词的单词与校验位，返回其中的熵
+func mnemonicToEntropy(mnemonic string) ([]byte, error) {
+	words := strings.Fields(mnemonic)
+	if len(words) < 12 || len(words) > 24 || len(words)%3 != 0 {
+		return nil, errInvalidMnemonic
+	}
+
+	data := new(big.Int)
+	for _, word := range words {
+		index, ok := mnemonicWordIndex[word]
+		if !ok {
+			return nil, fmt.Errorf("%w: unknown word %q", errInvalidMnemonic, word)
+		}
+		data.Lsh(data, 11)
+		data.Or(data, big.NewInt(int64(index)))
+	}
+
+	checksumBits := uint(len(words) * 11 / 33)
+	checksum := new(big.Int).And(data, big.NewInt(1<<checksumBits-1))
+	data.Rsh(data, checksumBits)
+
+	entropy := data.FillBytes(make([]byte, len(words)*11*32/33/8))
+	if entropyToMnemonic(entropy) != strings.Join(words, " ") {
+		return nil, fmt.Errorf("%w: checksum %x does not match", errInvalidMnemonic, checksum)
+	}
+	return entropy, nil
+}
+
+// 由助记词和可选的口令得到种子。口令只支持ASCII字符，BIP39要求的NFKD规范化没有做
+func MnemonicToSeed(mnemonic, passphrase string) ([]byte, error) {
+	if _, err := mnemonicToEntropy(mnemonic); err != nil {
+		return nil, err
+	}
+	normalized := strings.Join(strings.Fields(mnemonic), " ")
+	return pbkdf2.Key([]byte(normalized), []byte("mnemonic"+passphrase), 2048, 64, sha512.New), nil
+}
+
+// 扩展私钥：私钥加上用于推导子私钥的链码
+type ExtendedKey struct {
+	Key       []byte // 32字节私钥
+	ChainCode []byte
+}
+
+func hmacSHA512(key, data []byte) []byte {
+	mac := hmac.New(sha512.New, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+// 由种子得到主私钥，结果不是有效私钥时对结果再做一次HMAC
+func NewMasterKey(seed []byte) *ExtendedKey {
+	n := elliptic.P256().Params().N
+
+	I := hmacSHA512(masterKeySalt, seed)
+	for {
+		key := new(big.Int).SetBytes(I[:32])
+		if key.Sign() > 0 && key.Cmp(n) < 0 {
+			return &ExtendedKey{I[:32], I[32:]}
+		}
+		I = hmacSHA512(masterKeySalt, I)
+	}
+}
+
+// 推导第index个子私钥，index大于等于hardenedKeyStart时为强化推导，不依赖公钥
+func (k *ExtendedKey) Child(index uint32) *ExtendedKey {
+	curve := elliptic.P256()
+	n := curve.Params().N
+
+	var data []byte
+	if index >= hardenedKeyStart {
+		data = append([]byte{0x00}, k.Key...)
+	} else {
+		x, y := curve.ScalarBaseMult(k.Key)
+		data = elliptic.MarshalCompressed(curve, x, y)
+	}
+	data = binary.BigEndian.AppendUint32(data, index)
+
+	parent := new(big.Int).SetBytes(k.Key)
+	for {
+		I := hmacSHA512(k.ChainCode, data)
+
+		il := new(big.Int).SetBytes(I[:32])
+		if il.Cmp(n) < 0 {
+			child := il.Add(il, parent)
+			child.Mod(child, n)
+			if child.Sign() != 0 {
+				return &ExtendedKey{child.FillBytes(make([]byte, 32)), I[32:]}
+			}
+		}
+		// 极小概率出现无效的子私钥，按SLIP-0010用右半部分重新计算
+		data = binary.BigEndian.AppendUint32(append([]byte{0x01}, I[32:]...), index)
+	}
+}
+
+// 按路径依次推导
+func (k *ExtendedKey) Derive(path []uint32) *ExtendedKey {
+	for _, index := range path {
+		k = k.Child(index)
+	}
+	return k
+}
+
+// 转换为签名使用的私钥与钱包中保存的公钥
+func (k *ExtendedKey) keyPair() (ecdsa.PrivateKey, []byte) {
+	curve := elliptic.P256()
+
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(k.Key)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(k.Key)
+
+	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return private, pubKey
+}
+
+// 解析形如 m/44'/1'/0'/0/5 的路径，'或h表示强化推导
+func ParseDerivationPath(path string) ([]uint32, error) {
+	parts := strings.Split(path, "/")
+	if len(parts) == 0 || parts[0] != "m" {
+		return nil, fmt.Errorf("derivation path %q must start with m", path)
+	}
+
+	var indexes []uint32
+	for _, part := range parts[1:] {
+		hardened := strings.HasSuffix(part, "'") || strings.HasSuffix(part, "h")
+		if hardened {
+			part = part[:len(part)-1]
+		}
+		index, err := strconv.ParseUint(part, 10, 31)
+		if err != nil {
+			return nil, fmt.Errorf("bad index %q in derivation path %q", part, path)
+		}
+		if hardened {
+			index += hardenedKeyStart
+		}
+		indexes = append(indexes, uint32(index))
+	}
+	return indexes, nil
+}
+
+// BIP44路径
+func hdPath(account, chain, index uint32) string {
+	return fmt.Sprintf("m/%d'/%d'/%d'/%d/%d", hdPurpose, hdCoinType, account, chain, index)
+}
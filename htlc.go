@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+)
+
+// 哈希时间锁合约（HTLC）：收款人出示哈希的原像就能花费，超时之后付款人可以取回。
+// 两条链上用同一个哈希各建一个合约就是原子交换：发起人在对方链上赎回时公开原像，
+// 对方从赎回交易中取出原像再赎回发起人的合约。发起人的超时要比对方的长，
+// 保证对方在发起人能退款之前有时间赎回
+
+const secretSize = 32 // 原像的长度，两条链都检查长度，防止一条链上能用的原像在另一条链上不能用
+
+type HTLC struct {
+	SecretHash []byte // 原像的sha256
+	Recipient  []byte // 收款人的公钥哈希
+	Refund     []byte // 付款人的公钥哈希
+	LockTime   uint32 // 超时的区块高度或时间
+}
+
+// 合约脚本，作为脚本哈希地址的赎回脚本：
+// OP_IF OP_SIZE 32 OP_EQUALVERIFY OP_SHA256 <哈希> OP_EQUALVERIFY OP_DUP OP_HASH160 <收款人>
+// OP_ELSE <超时> OP_CHECKLOCKTIMEVERIFY OP_DROP OP_DUP OP_HASH160 <付款人>
+// OP_ENDIF OP_EQUALVERIFY OP_CHECKSIG
+func (c *HTLC) Script() []byte {
+	return NewScriptBuilder().
+		AddOp(OP_IF).
+		AddOp(OP_SIZE).AddInt64(secretSize).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_SHA256).AddData(c.SecretHash).AddOp(OP_EQUALVERIFY).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.Recipient).
+		AddOp(OP_ELSE).
+		AddInt64(int64(c.LockTime)).AddOp(OP_CHECKLOCKTIMEVERIFY).AddOp(OP_DROP).
+		AddOp(OP_DUP).AddOp(OP_HASH160).AddData(c.Refund).
+		AddOp(OP_ENDIF).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+func (c *HTLC) Address() string {
+	return scriptHashToAddress(HashPubKey(c.Script()))
+}
+
+// 脚本是标准的合约时解析出合约条款
+func extractHTLC(script []byte) (*HTLC, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 20 {
+		return nil, false
+	}
+	lockTime, ok := lockTimeOp(ops[11])
+	if !ok {
+		return nil, false
+	}
+	c := &HTLC{ops[5].data, ops[9].data, ops[16].data, lockTime}
+	if len(c.SecretHash) != sha256.Size || len(c.Recipient) != 20 || len(c.Refund) != 20 {
+		return nil, false
+	}
+	if !bytes.Equal(script, c.Script()) {
+		return nil, false
+	}
+	return c, true
+}
+
+// 生成随机原像
+func newSecret() []byte {
+	secret := make([]byte, secretSize)
+	_, err := rand.Read(secret)
+	checkErr(err)
+	return secret
+}
+
+// 在交易中找到付款到合约的输出
+func findContractOutput(tx *Transation, contract []byte) (int, error) {
+	script := payToScriptHashScript(HashPubKey(contract))
+	for i, out := range tx.Vout {
+		if bytes.Equal(out.ScriptPubKey, script) {
+			return i, nil
+		}
+	}
+	return 0, fmt.Errorf("transation %x does not pay to the contract", tx.ID)
+}
+
+// 花费合约输出的交易，未签名。退款时lockTime为合约的超时
+func newContractSpend(contractTx *Transation, contract []byte, to string, lockTime uint32, fees FeePolicy) (*Transation, error) {
+	index, err := findContractOutput(contractTx, contract)
+	if err != nil {
+		return nil, err
+	}
+	value := contractTx.Vout[index].Value - fees.Fee(1, 1)
+	if fees.IsDust(value) {
+		return nil, fmt.Errorf("contract value %d does not cover the fee", contractTx.Vout[index].Value)
+	}
+
+	tx := Transation{nil, []TXInput{{contractTx.ID, index, nil, 0}}, []TXOutput{*NewTXOutput(value, to)}, lockTime}
+	tx.ID = tx.unsignedHash()
+	return &tx, nil
+}
+
+// 用收款人的私钥与原像赎回，解锁脚本：<签名> <公钥> <原像> OP_1 <合约>
+func (tx *Transation) redeemContract(contract, secret []byte, privkey ecdsa.PrivateKey) error {
+	c, ok := extractHTLC(contract)
+	if !ok {
+		return errors.New("not a hash time-locked contract")
+	}
+	hash := sha256.Sum256(secret)
+	if len(secret) != secretSize || !bytes.Equal(hash[:], c.SecretHash) {
+		return errors.New("secret does not match the contract")
+	}
+	pubKey := append(privkey.PublicKey.X.Bytes(), privkey.PublicKey.Y.Bytes()...)
+	if !bytes.Equal(HashPubKey(pubKey), c.Recipient) {
+		return errors.New("key is not the recipient of the contract")
+	}
+
+	sig := tx.signatureFor(0, contract, privkey, SIGHASH_ALL)
+	tx.Vin[0].ScriptSig = NewScriptBuilder().AddData(sig).AddData(pubKey).AddData(secret).
+		AddOp(OP_1).AddData(contract).Script()
+	return nil
+}
+
+// 超时之后用付款人的私钥退款，解锁脚本：<签名> <公钥> OP_0 <合约>
+func (tx *Transation) refundContract(contract []byte, privkey ecdsa.PrivateKey) error {
+	c, ok := extractHTLC(contract)
+	if !ok {
+		return errors.New("not a hash time-locked contract")
+	}
+	pubKey := append(privkey.PublicKey.X.Bytes(), privkey.PublicKey.Y.Bytes()...)
+	if !bytes.Equal(HashPubKey(pubKey), c.Refund) {
+		return errors.New("key is not the refund key of the contract")
+	}
+
+	sig := tx.signatureFor(0, contract, privkey, SIGHASH_ALL)
+	tx.Vin[0].ScriptSig = NewScriptBuilder().AddData(sig).AddData(pubKey).
+		AddOp(OP_0).AddData(contract).Script()
+	return nil
+}
+
+// 从赎回交易的解锁脚本中找出哈希为secretHash的原像
+func extractSecret(tx *Transation, secretHash []byte) ([]byte, error) {
+	for _, vin := range tx.Vin {
+		for _, push := range scriptPushes(vin.ScriptSig) {
+			hash := sha256.Sum256(push)
+			if len(push) == secretSize && bytes.Equal(hash[:], secretHash) {
+				return push, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf("transation %x does not reveal secret of hash %s", tx.ID, hex.EncodeToString(secretHash))
+}
@@ -0,0 +1,276 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+
+	"github.com/boltdb/bolt"
+)
+
+// 版本0交易的签名验证，只在迁移时使用。
+// 当时的签名hash是交易副本gob编码的sha256：副本中去掉交易id与所有输入的签名和公钥，
+// 当前输入的公钥换成引用输出的公钥hash。gob编码中带有进程内分配的类型编号，
+// 编号取决于进程中先编码了哪些类型，所以这里手工按gob的格式编码，并尝试可能的编号。
+
+// gob编码中五个类型的编号
+type legacyTypeIDs struct {
+	tx, input, inputs, output, outputs int
+}
+
+// 进程中先编码Transation时，从base开始依次分配
+func txFirstTypeIDs(base int) legacyTypeIDs {
+	return legacyTypeIDs{base, base + 1, base + 2, base + 3, base + 4}
+}
+
+// 进程中先编码TXOutputs(send命令更新UTXO集合)时，TXOutput与[]TXOutput在前
+func outputFirstTypeIDs(base int) legacyTypeIDs {
+	return legacyTypeIDs{base + 2, base + 3, base + 4, base, base + 1}
+}
+
+// 已知的编号：send命令、createblockchain命令，以及新版本Go中直接编码交易
+var legacyLayouts = []legacyTypeIDs{outputFirstTypeIDs(66), txFirstTypeIDs(65), txFirstTypeIDs(64)}
+
+// gob的消息编码
+type legacyGob struct {
+	bytes.Buffer
+}
+
+func (e *legacyGob) uint(x uint64) {
+	if x < 0x80 {
+		e.WriteByte(byte(x))
+		return
+	}
+	var buf [8]byte
+	n := 8
+	for ; x > 0; x >>= 8 {
+		n--
+		buf[n] = byte(x)
+	}
+	e.WriteByte(byte(-(8 - n)))
+	e.Write(buf[n:])
+}
+
+func (e *legacyGob) int(x int) {
+	if x < 0 {
+		e.uint(uint64(^x)<<1 | 1)
+	} else {
+		e.uint(uint64(x) << 1)
+	}
+}
+
+func (e *legacyGob) bytes(b []byte) {
+	e.uint(uint64(len(b)))
+	e.Write(b)
+}
+
+// 类型定义中的CommonType
+func (e *legacyGob) common(name string, id int) {
+	e.uint(1)
+	e.uint(1)
+	e.bytes([]byte(name))
+	e.uint(1)
+	e.int(id)
+	e.uint(0)
+}
+
+func (e *legacyGob) structType(name string, id int, fields []string, ids []int) {
+	e.uint(3)
+	e.common(name, id)
+	e.uint(1)
+	e.uint(uint64(len(fields)))
+	for i, field := range fields {
+		e.uint(1)
+		e.bytes([]byte(field))
+		e.uint(1)
+		e.int(ids[i])
+		e.uint(0)
+	}
+	e.uint(0)
+	e.uint(0)
+}
+
+func (e *legacyGob) sliceType(name string, id, elem int) {
+	e.uint(2)
+	e.common(name, id)
+	e.uint(1)
+	e.int(elem)
+	e.uint(0)
+	e.uint(0)
+}
+
+// 结构体中的字段，零值省略，delta是与上一个写入字段的序号差
+type legacyField struct {
+	last int
+}
+
+func (f *legacyField) next(e *legacyGob, index int) {
+	e.uint(uint64(index - f.last))
+	f.last = index
+}
+
+// 写入一条消息：长度、类型编号、内容
+func writeGobMessage(out *bytes.Buffer, id int, body func(e *legacyGob)) {
+	var msg legacyGob
+	msg.int(id)
+	body(&msg)
+	var head legacyGob
+	head.uint(uint64(msg.Len()))
+	out.Write(head.Bytes())
+	out.Write(msg.Bytes())
+}
+
+// 与当时的gob.Encoder编码交易的结果相同，交易id为空
+func (t *legacyTransation) gobEncode(ids legacyTypeIDs) []byte {
+	const bytesID, intID = 5, 2
+	var out bytes.Buffer
+	writeGobMessage(&out, -ids.tx, func(e *legacyGob) {
+		e.structType("Transation", ids.tx, []string{"ID", "Vin", "Vout"}, []int{bytesID, ids.inputs, ids.outputs})
+	})
+	writeGobMessage(&out, -ids.inputs, func(e *legacyGob) {
+		e.sliceType("[]main.TXInput", ids.inputs, ids.input)
+	})
+	writeGobMessage(&out, -ids.input, func(e *legacyGob) {
+		e.structType("TXInput", ids.input, []string{"TXid", "Voutindex", "Signature", "PubKey"}, []int{bytesID, intID, bytesID, bytesID})
+	})
+	writeGobMessage(&out, -ids.outputs, func(e *legacyGob) {
+		e.sliceType("[]main.TXOutput", ids.outputs, ids.output)
+	})
+	writeGobMessage(&out, -ids.output, func(e *legacyGob) {
+		e.structType("TXOutput", ids.output, []string{"Value", "PubkeyHash"}, []int{intID, bytesID})
+	})
+
+	writeGobMessage(&out, ids.tx, func(e *legacyGob) {
+		f := legacyField{last: -1}
+		if len(t.Vin) > 0 {
+			f.next(e, 1)
+			e.uint(uint64(len(t.Vin)))
+			for _, in := range t.Vin {
+				g := legacyField{last: -1}
+				if len(in.TXid) > 0 {
+					g.next(e, 0)
+					e.bytes(in.TXid)
+				}
+				if in.Voutindex != 0 {
+					g.next(e, 1)
+					e.int(in.Voutindex)
+				}
+				if len(in.Signature) > 0 {
+					g.next(e, 2)
+					e.bytes(in.Signature)
+				}
+				if len(in.PubKey) > 0 {
+					g.next(e, 3)
+					e.bytes(in.PubKey)
+				}
+				e.uint(0)
+			}
+		}
+		if len(t.Vout) > 0 {
+			f.next(e, 2)
+			e.uint(uint64(len(t.Vout)))
+			for _, out := range t.Vout {
+				g := legacyField{last: -1}
+				if out.Value != 0 {
+					g.next(e, 0)
+					e.int(out.Value)
+				}
+				if len(out.PubkeyHash) > 0 {
+					g.next(e, 1)
+					e.bytes(out.PubkeyHash)
+				}
+				e.uint(0)
+			}
+		}
+		e.uint(0)
+	})
+	return out.Bytes()
+}
+
+// 第i个输入的签名hash：去掉所有签名与公钥，第i个输入的公钥换成引用输出的公钥hash
+func (t *legacyTransation) sigHash(i int, prevPubkeyHash []byte, ids legacyTypeIDs) []byte {
+	txcopy := legacyTransation{}
+	for _, vin := range t.Vin {
+		txcopy.Vin = append(txcopy.Vin, legacyTXInput{vin.TXid, vin.Voutindex, nil, nil})
+	}
+	txcopy.Vout = t.Vout
+	txcopy.Vin[i].PubKey = prevPubkeyHash
+	hash := sha256.Sum256(txcopy.gobEncode(ids))
+	return hash[:]
+}
+
+func verifyLegacySignature(pubKey, sig, hash []byte) bool {
+	if len(pubKey) == 0 || len(sig) == 0 {
+		return false
+	}
+	var r, s, x, y big.Int
+	r.SetBytes(sig[:len(sig)/2])
+	s.SetBytes(sig[len(sig)/2:])
+	x.SetBytes(pubKey[:len(pubKey)/2])
+	y.SetBytes(pubKey[len(pubKey)/2:])
+	return ecdsa.Verify(&ecdsa.PublicKey{Curve: elliptic.P256(), X: &x, Y: &y}, hash, &r, &s)
+}
+
+// 验证第i个输入：公钥要与引用输出的公钥hash一致，签名按已知的类型编号验证，
+// 都不成立时再尝试其他可能的编号，成立的编号放到最前面
+func (t *legacyTransation) verifyInput(i int, prevOut legacyTXOutput) bool {
+	vin := t.Vin[i]
+	if !bytes.Equal(HashPubKey(vin.PubKey), prevOut.PubkeyHash) {
+		return false
+	}
+	for _, ids := range legacyLayouts {
+		if verifyLegacySignature(vin.PubKey, vin.Signature, t.sigHash(i, prevOut.PubkeyHash, ids)) {
+			return true
+		}
+	}
+	for base := 64; base < 128; base++ {
+		for _, ids := range []legacyTypeIDs{txFirstTypeIDs(base), outputFirstTypeIDs(base)} {
+			if verifyLegacySignature(vin.PubKey, vin.Signature, t.sigHash(i, prevOut.PubkeyHash, ids)) {
+				legacyLayouts = append([]legacyTypeIDs{ids}, legacyLayouts...)
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 迁移之前按旧规则验证主链上所有交易的签名，引用的输出必须在之前的区块中并且还没有花费
+func verifyLegacyChain(tx *bolt.Tx) error {
+	var chain []*legacyBlock
+	for hash := tx.Bucket([]byte(blockBucket)).Get([]byte("l")); len(hash) != 0; {
+		block, err := readLegacyBlock0(tx, hash)
+		if err != nil {
+			return fmt.Errorf("block %x: %s", hash, err)
+		}
+		chain = append(chain, block)
+		hash = block.PrevBlockHash
+	}
+
+	unspent := make(map[string]legacyTXOutput)
+	for i := len(chain) - 1; i >= 0; i-- {
+		for _, t := range chain[i].Transations {
+			for j, vin := range t.Vin {
+				if vin.isCoinbase() {
+					continue
+				}
+				key := fmt.Sprintf("%x:%d", vin.TXid, vin.Voutindex)
+				prevOut, ok := unspent[key]
+				if !ok {
+					return fmt.Errorf("transation %x spends missing output %s", t.ID, key)
+				}
+				if !t.verifyInput(j, prevOut) {
+					return fmt.Errorf("transation %x input %d has an invalid signature", t.ID, j)
+				}
+				delete(unspent, key)
+			}
+			for k, out := range t.Vout {
+				unspent[fmt.Sprintf("%s:%d", hex.EncodeToString(t.ID), k)] = out
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// 时间锁：交易的锁定时间是绝对锁定，达到指定的区块高度或时间之前交易不能打包；
+// 输入的序号是相对锁定（类似BIP68），它花费的输出被确认指定的区块数或时间之后才能打包。
+// 时间按前11个区块时间的中位数计算，矿工不能通过修改区块时间提前解锁
+
+const (
+	lockTimeThreshold = 500000000 // 锁定时间小于它时为区块高度，否则为Unix时间
+
+	sequenceFinal               = 0xffffffff // 所有输入的序号都是它时锁定时间不生效
+	sequenceLockTimeDisabled    = 1 << 31    // 置位时输入没有相对锁定
+	sequenceLockTimeIsSeconds   = 1 << 22    // 置位时相对锁定以512秒为单位，否则以区块为单位
+	sequenceLockTimeMask        = 0x0000ffff
+	sequenceLockTimeGranularity = 9 // 相对锁定的时间单位为2^9秒
+
+	medianTimeBlocks = 11
+)
+
+// 可读的锁定时间
+func lockTimeString(lockTime uint32) string {
+	if lockTime < lockTimeThreshold {
+		return fmt.Sprintf("height %d", lockTime)
+	}
+	return time.Unix(int64(lockTime), 0).UTC().Format(time.RFC3339)
+}
+
+// 以区块数或秒数表示的相对锁定对应的序号
+func relativeLockSequence(blocks uint32, duration time.Duration) (uint32, error) {
+	if duration > 0 {
+		units := uint32((duration + time.Second<<sequenceLockTimeGranularity - 1) / (time.Second << sequenceLockTimeGranularity))
+		if units > sequenceLockTimeMask {
+			return 0, fmt.Errorf("relative lock of %s is too long", duration)
+		}
+		return sequenceLockTimeIsSeconds | units, nil
+	}
+	if blocks == 0 || blocks > sequenceLockTimeMask {
+		return 0, fmt.Errorf("relative lock of %d blocks, need 1 to %d", blocks, sequenceLockTimeMask)
+	}
+	return blocks, nil
+}
+
+// 交易放入高度为height、前一个区块时间中位数为medianTime的区块时，锁定时间是否已经解除
+func (tx *Transation) IsFinal(height int32, medianTime uint32) bool {
+	if tx.LockTime == 0 {
+		return true
+	}
+	limit := uint32(height)
+	if tx.LockTime >= lockTimeThreshold {
+		limit = medianTime
+	}
+	if tx.LockTime < limit {
+		return true
+	}
+	for _, vin := range tx.Vin {
+		if vin.Sequence != sequenceFinal {
+			return false
+		}
+	}
+	return true
+}
+
+// 区块及其之前共11个区块时间的中位数
+func (bc *Blockchain) medianTimePast(blockHash []byte) uint32 {
+	var times []int
+	for len(times) < medianTimeBlocks && len(blockHash) != 0 {
+		header, err := bc.GetHeader(blockHash)
+		if err != nil {
+			break
+		}
+		times = append(times, int(header.Time))
+		blockHash = header.PrevBlockHash
+	}
+	if len(times) == 0 {
+		return 0
+	}
+	sort.Ints(times)
+	return uint32(times[len(times)/2])
+}
+
+// 检查交易放入高度为height、前一个区块为prevHash的区块时，绝对与相对锁定是否都已解除
+func (bc *Blockchain) CheckLockTimes(tx *Transation, height int32, prevHash []byte) error {
+	view, err := bc.utxoViewAt(prevHash)
+	if err != nil {
+		return err
+	}
+	return bc.checkLockTimes(tx, height, prevHash, view)
+}
+
+// 与CheckLockTimes相同，输出被确认的高度与时间从prevHash之后的UTXO视图中查找
+func (bc *Blockchain) checkLockTimes(tx *Transation, height int32, prevHash []byte, view *utxoView) error {
+	if tx.IsCoinBase() {
+		return nil
+	}
+	medianTime := bc.medianTimePast(prevHash)
+	if !tx.IsFinal(height, medianTime) {
+		return fmt.Errorf("transation %x is locked until %s", tx.ID, lockTimeString(tx.LockTime))
+	}
+
+	for i, vin := range tx.Vin {
+		lock := vin.Sequence & sequenceLockTimeMask
+		if vin.Sequence&sequenceLockTimeDisabled != 0 || lock == 0 {
+			continue
+		}
+		entry := view.lookup(vin)
+		if entry == nil {
+			return fmt.Errorf("input %d: output %x:%d is missing or already spent", i, vin.TXid, vin.Voutindex)
+		}
+
+		if vin.Sequence&sequenceLockTimeIsSeconds == 0 {
+			if unlock := entry.height + int32(lock); height < unlock {
+				return fmt.Errorf("input %d is locked until height %d", i, unlock)
+			}
+			continue
+		}
+		// 从输出所在区块的前一个区块的时间中位数开始计算，创世区块用它自己的时间
+		confirmed := uint32(entry.time)
+		if len(entry.prevHash) != 0 {
+			confirmed = bc.medianTimePast(entry.prevHash)
+		}
+		if unlock := confirmed + lock<<sequenceLockTimeGranularity; medianTime < unlock {
+			return fmt.Errorf("input %d is locked until %s", i, lockTimeString(unlock))
+		}
+	}
+	return nil
+}
+
+// 检查交易能否打包进下一个区块，用于交易池
+func (bc *Blockchain) CheckNextBlockLockTimes(tx *Transation) error {
+	return bc.CheckLockTimes(tx, bc.GetBestHeight()+1, bc.Tip())
+}
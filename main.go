@@ -1,8 +1,7 @@
 package main
 
 func main() {
-	bc := NewBlockchain("1NpxpZkBYd3uYJGMcpzFs6q65WPrr1cDaM")
-	cli := CLI{bc}
+	cli := CLI{}
 	cli.Run()
 	//wallet:=NewWallet()
 	//
@@ -1,6 +1,9 @@
 package main
 
-import "crypto/sha256"
+import (
+	"bytes"
+	"crypto/sha256"
+)
 
 //默克尔树节点
 type MerkleTree struct {
@@ -21,10 +24,7 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	if left == nil && right == nil {
 		mnode.Data = data
 	} else {
-		prevhashes := append(left.Data, right.Data...)
-		firsthash := sha256.Sum256(prevhashes)
-		hash := sha256.Sum256(firsthash[:])
-		mnode.Data = hash[:]
+		mnode.Data = hashMerklePair(left.Data, right.Data)
 	}
 
 	mnode.Left = left
@@ -33,6 +33,14 @@ func NewMerkleNode(left, right *MerkleNode, data []byte) *MerkleNode {
 	return &mnode
 }
 
+//两个子节点拼接后做两次sha256
+func hashMerklePair(left, right []byte) []byte {
+	prevhashes := append(append([]byte{}, left...), right...)
+	firsthash := sha256.Sum256(prevhashes)
+	hash := sha256.Sum256(firsthash[:])
+	return hash[:]
+}
+
 //构建默克尔树
 func NewMerkleTree(data [][]byte) *MerkleTree {
 	var nodes []MerkleNode
@@ -60,3 +68,54 @@ func NewMerkleTree(data [][]byte) *MerkleTree {
 	mTree := MerkleTree{&(nodes[len(nodes)-1])}
 	return &mTree
 }
+
+//默克尔证明：证明某个叶子包含在默克尔根中所需的兄弟节点
+type MerkleProof struct {
+	Index  int      // 叶子在所有叶子中的位置
+	Hashes [][]byte // 从叶子所在层到根的下一层，每一层的兄弟节点
+}
+
+//为第index个叶子生成默克尔证明，与NewMerkleTree一样，某一层个数为奇数时最后一个元素与自己拼接
+func NewMerkleProof(data [][]byte, index int) *MerkleProof {
+	proof := &MerkleProof{Index: index}
+
+	level := data
+	for len(level) > 1 {
+		sibling := index ^ 1
+		if sibling >= len(level) {
+			sibling = index
+		}
+		proof.Hashes = append(proof.Hashes, level[sibling])
+
+		var next [][]byte
+		for i := 0; i < len(level); i += 2 {
+			i2 := min(i+1, len(level)-1)
+			next = append(next, hashMerklePair(level[i], level[i2]))
+		}
+		level = next
+		index /= 2
+	}
+	return proof
+}
+
+//用默克尔证明从叶子计算出根，并与root比较
+func (p *MerkleProof) Verify(root, leaf []byte) bool {
+	if p.Index < 0 {
+		return false
+	}
+	hash := leaf
+	index := p.Index
+	for _, sibling := range p.Hashes {
+		if index%2 == 0 {
+			hash = hashMerklePair(hash, sibling)
+		} else {
+			hash = hashMerklePair(sibling, hash)
+		}
+		index /= 2
+	}
+	// 索引超出了证明的层数，说明叶子位置是伪造的
+	if index != 0 {
+		return false
+	}
+	return bytes.Equal(hash, root)
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/big"
+)
+
+// 签名消息：证明自己拥有某个地址而不需要转账。
+// 签名是65字节的可恢复签名（恢复标识、r、s），验证时从签名中恢复公钥，
+// 再比较公钥哈希与地址中的是否一致，所以签名中不需要附带公钥
+
+const messagePrefix = "Signed Message:\n" // 防止签名被当作交易签名使用
+
+var errInvalidMessageSignature = errors.New("invalid message signature")
+
+// 带前缀的消息的双重sha256
+func messageHash(message string) []byte {
+	var data []byte
+	data = binary.AppendUvarint(data, uint64(len(messagePrefix)))
+	data = append(data, messagePrefix...)
+	data = binary.AppendUvarint(data, uint64(len(message)))
+	data = append(data, message...)
+
+	first := sha256.Sum256(data)
+	second := sha256.Sum256(first[:])
+	return second[:]
+}
+
+// 用钱包中地址的私钥签名消息，返回base64编码的签名
+func SignMessage(wallet *Wallet, message string) (string, error) {
+	if wallet.PrivateKey.D == nil {
+		return "", errWalletLocked
+	}
+	hash := messageHash(message)
+
+	r, s, err := ecdsa.Sign(rand.Reader, &wallet.PrivateKey, hash)
+	if err != nil {
+		return "", err
+	}
+
+	// 试出能恢复出自己公钥的恢复标识
+	for recID := byte(0); recID < 4; recID++ {
+		pubKey, err := recoverPubKey(hash, r, s, recID)
+		if err == nil && bytes.Equal(pubKey, wallet.PublicKey) {
+			sig := append([]byte{recID}, r.FillBytes(make([]byte, 32))...)
+			sig = append(sig, s.FillBytes(make([]byte, 32))...)
+			return base64.StdEncoding.EncodeToString(sig), nil
+		}
+	}
+	return "", errors.New("can not find recovery id for signature")
+}
+
+// 验证签名是否由address的私钥对message签出
+func VerifyMessage(address, signature, message string) error {
+	pubkeyHash, err := addressToPubkeyHash(address)
+	if err != nil {
+		return err
+	}
+	sig, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil || len(sig) != 65 {
+		return errInvalidMessageSignature
+	}
+
+	r := new(big.Int).SetBytes(sig[1:33])
+	s := new(big.Int).SetBytes(sig[33:])
+	pubKey, err := recoverPubKey(messageHash(message), r, s, sig[0])
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(HashPubKey(pubKey), pubkeyHash) {
+		return fmt.Errorf("%w: signed by a different key", errInvalidMessageSignature)
+	}
+	return nil
+}
+
+// 从签名中恢复公钥：Q = r⁻¹(sR - eG)，R的横坐标为r（recID第2位为1时为r+n），
+// recID第1位为R纵坐标的奇偶
+func recoverPubKey(hash []byte, r, s *big.Int, recID byte) ([]byte, error) {
+	curve := elliptic.P256()
+	params := curve.Params()
+	n, p := params.N, params.P
+
+	if recID > 3 || r.Sign() <= 0 || r.Cmp(n) >= 0 || s.Sign() <= 0 || s.Cmp(n) >= 0 {
+		return nil, errInvalidMessageSignature
+	}
+
+	x := new(big.Int).Set(r)
+	if recID&2 != 0 {
+		x.Add(x, n)
+		if x.Cmp(p) >= 0 {
+			return nil, errInvalidMessageSignature
+		}
+	}
+
+	// y² = x³ - 3x + b
+	y := new(big.Int).Exp(x, big.NewInt(3), p)
+	y.Sub(y, new(big.Int).Mul(x, big.NewInt(3)))
+	y.Add(y, params.B)
+	y.Mod(y, p)
+	if y.ModSqrt(y, p) == nil {
+		return nil, errInvalidMessageSignature
+	}
+	if y.Bit(0) != uint(recID&1) {
+		y.Sub(p, y)
+	}
+
+	// 与ecdsa包一致，哈希长于曲线阶时只取左边的位
+	e := new(big.Int).SetBytes(hash)
+	if excess := len(hash)*8 - n.BitLen(); excess > 0 {
+		e.Rsh(e, uint(excess))
+	}
+
+	rInv := new(big.Int).ModInverse(r, n)
+	u1 := new(big.Int).Mul(e, rInv)
+	u1.Neg(u1).Mod(u1, n)
+	u2 := new(big.Int).Mul(s, rInv)
+	u2.Mod(u2, n)
+
+	x1, y1 := curve.ScalarBaseMult(u1.Bytes())
+	x2, y2 := curve.ScalarMult(x, y, u2.Bytes())
+	qx, qy := curve.Add(x1, y1, x2, y2)
+	if qx.Sign() == 0 && qy.Sign() == 0 {
+		return nil, errInvalidMessageSignature
+	}
+
+	return append(qx.Bytes(), qy.Bytes()...), nil
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 数据库编码的迁移。
+// 版本0用gob保存区块，交易id与默克尔根也由gob编码计算；
+// 版本1改用encoding.go中的编码，但区块头中带有高度，区块hash只覆盖部分字段；
+// 版本2的区块hash是区块头编码的两次sha256，区块头与区块体分开保存；
+// 版本3的默克尔根只覆盖交易id，区块头中增加了覆盖签名的见证默克尔根。
+// 旧版本的交易id、默克尔根或区块hash与当前的定义不同，需要从创世区块开始重写主链：
+// 按当前编码重新计算交易id并替换输入中引用的旧id，重新计算默克尔根，再重新做工作量证明。
+// 工作量证明总是从随机数0开始搜索，区块时间不变，所以每个节点迁移出的链完全相同。
+// 版本0的交易还是旧的结构：输出中直接保存公钥hash，输入中保存签名与公钥，coinbase的数据放在公钥中，
+// 迁移时转换为P2PKH锁定脚本与解锁脚本。旧签名按旧的签名hash计算，写入之前先按旧规则验证一遍，
+// 之后保留原样，不再按当前的规则验证
+
+const storageVersion = 3 // 数据库中区块的编码版本
+
+var storageVersionKey = []byte("version")
+
+// 版本0的区块，字段与当时的Block相同，用gob解码
+type legacyBlock struct {
+	Version       int32
+	PrevBlockHash []byte
+	Merkleroot    []byte
+	Hash          []byte
+	Time          int32
+	Bits          int32
+	Nonce         int32
+	Transations   []*legacyTransation
+	Height        int32
+}
+
+// 版本0的交易，字段与当时的Transation、TXInput、TXOutput相同
+type legacyTransation struct {
+	ID   []byte
+	Vin  []legacyTXInput
+	Vout []legacyTXOutput
+}
+
+type legacyTXInput struct {
+	TXid      []byte
+	Voutindex int
+	Signature []byte // r与s直接拼接，各占一半
+	PubKey    []byte // 公钥的x与y直接拼接；coinbase交易中是任意数据
+}
+
+type legacyTXOutput struct {
+	Value      int
+	PubkeyHash []byte
+}
+
+func (in *legacyTXInput) isCoinbase() bool {
+	return len(in.TXid) == 0 && in.Voutindex == -1
+}
+
+// 转换为当前的交易结构，交易id在迁移时重新计算
+func (t *legacyTransation) convert() *Transation {
+	tx := &Transation{ID: t.ID}
+	for _, vin := range t.Vin {
+		in := TXInput{vin.TXid, vin.Voutindex, nil, 0}
+		if vin.isCoinbase() {
+			in.ScriptSig = vin.PubKey
+		} else {
+			in.ScriptSig = payToPubkeyHashSigScript(vin.Signature, vin.PubKey)
+		}
+		tx.Vin = append(tx.Vin, in)
+	}
+	for _, out := range t.Vout {
+		tx.Vout = append(tx.Vout, TXOutput{out.Value, payToPubkeyHashScript(out.PubkeyHash), -1})
+	}
+	return tx
+}
+
+func readLegacyBlock0(tx *bolt.Tx, hash []byte) (*legacyBlock, error) {
+	var b legacyBlock
+	data := tx.Bucket([]byte(blockBucket)).Get(hash)
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&b)
+	return &b, err
+}
+
+// 版本1与版本2的区块头，后面是高度
+func readLegacyHeader(dec *decoder) BlockHeader {
+	var h BlockHeader
+	h.Version = dec.readInt32()
+	h.PrevBlockHash = dec.readBytes()
+	h.Merkleroot = dec.readBytes()
+	h.Time = dec.readInt32()
+	h.Bits = dec.readInt32()
+	h.Nonce = dec.readInt32()
+	h.Height = dec.readInt32()
+	return h
+}
+
+// 从数据库中读取旧版本的区块
+func legacyReadBlock(tx *bolt.Tx, version byte, hash []byte) (*Block, error) {
+	data := tx.Bucket([]byte(blockBucket)).Get(hash)
+	switch version {
+	case 0:
+		b, err := readLegacyBlock0(tx, hash)
+		if err != nil {
+			return nil, err
+		}
+		block := &Block{BlockHeader{b.Version, b.PrevBlockHash, b.Merkleroot, nil, b.Time, b.Bits, b.Nonce, b.Hash, b.Height}, nil}
+		for _, t := range b.Transations {
+			block.Transations = append(block.Transations, t.convert())
+		}
+		return block, nil
+	case 1:
+		dec := decoder{data: data}
+		block := &Block{readLegacyHeader(&dec), nil}
+		block.Transations = dec.readBody()
+		return block, dec.finish()
+	}
+
+	header := decoder{data: tx.Bucket([]byte(headerBucket)).Get(hash)}
+	body := decoder{data: data}
+	block := &Block{readLegacyHeader(&header), body.readBody()}
+	if err := header.finish(); err != nil {
+		return nil, err
+	}
+	return block, body.finish()
+}
+
+// 数据库还是旧版本时重写主链，分叉上的区块直接丢弃，UTXO集合与钱包交易集合之后重建
+func migrateChain(db *bolt.DB) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blockBucket))
+		if b == nil {
+			return nil
+		}
+		var version byte
+		if v := b.Get(storageVersionKey); len(v) == 1 {
+			version = v[0]
+		}
+		if version == storageVersion {
+			return nil
+		}
+		if version == 0 {
+			if err := verifyLegacyChain(tx); err != nil {
+				return err
+			}
+		}
+
+		var chain []*Block
+		for hash := b.Get([]byte("l")); len(hash) != 0; {
+			block, err := legacyReadBlock(tx, version, hash)
+			if err != nil {
+				return fmt.Errorf("block %x: %s", hash, err)
+			}
+			chain = append(chain, block)
+			hash = block.PrevBlockHash
+		}
+		fmt.Printf("migrating %d blocks from storage version %d to %d\n", len(chain), version, storageVersion)
+
+		var keys [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			keys = append(keys, append([]byte{}, k...))
+			return nil
+		})
+		checkErr(err)
+		for _, k := range keys {
+			checkErr(b.Delete(k))
+		}
+		for _, name := range []string{headerBucket, utxoBucket, walletTxBucket} {
+			if err := tx.DeleteBucket([]byte(name)); err != nil && err != bolt.ErrBucketNotFound {
+				return err
+			}
+		}
+		_, err = tx.CreateBucket([]byte(headerBucket))
+		checkErr(err)
+
+		ids := make(map[string][]byte)
+		var prevHash []byte
+		for i := len(chain) - 1; i >= 0; i-- {
+			block := chain[i]
+			for _, t := range block.Transations {
+				if !t.IsCoinBase() {
+					for j, vin := range t.Vin {
+						if id, ok := ids[hex.EncodeToString(vin.TXid)]; ok {
+							t.Vin[j].TXid = id
+						}
+					}
+				}
+				oldID := hex.EncodeToString(t.ID)
+				t.ID = t.unsignedHash()
+				ids[oldID] = t.ID
+			}
+
+			block.PrevBlockHash = prevHash
+			block.createMerkelTreeRoot(block.Transations)
+			block.Nonce, block.Hash = NewProofofWork(&block.BlockHeader).Run()
+			checkErr(putBlock(tx, block))
+			prevHash = block.Hash
+		}
+		checkErr(b.Put([]byte("l"), prevHash))
+		return b.Put(storageVersionKey, []byte{storageVersion})
+	})
+	checkErr(err)
+}
+
+// 轻节点保存的区块头与交易是旧版本时清空，重新从全节点同步
+func migrateLightStore(db *bolt.DB) {
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightHeaderBucket))
+		if bytes.Equal(b.Get(storageVersionKey), []byte{storageVersion}) {
+			return nil
+		}
+		if b.Get([]byte("l")) != nil {
+			fmt.Printf("clearing headers and transations of an old storage version, resyncing\n")
+			for _, name := range []string{lightHeaderBucket, lightTxBucket} {
+				checkErr(tx.DeleteBucket([]byte(name)))
+				_, err := tx.CreateBucket([]byte(name))
+				checkErr(err)
+			}
+			b = tx.Bucket([]byte(lightHeaderBucket))
+		}
+		return b.Put(storageVersionKey, []byte{storageVersion})
+	})
+	checkErr(err)
+}
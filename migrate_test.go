@@ -0,0 +1,163 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/boltdb/bolt"
+)
+
+// 仓库中的blockchain.db是版本0的数据库：创世区块之后有7个区块，每个区块一笔转账
+const legacyTestDB = "blockchain.db"
+
+func copyLegacyDB(t *testing.T) string {
+	data, err := ioutil.ReadFile(legacyTestDB)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(t.TempDir(), "blockchain.db")
+	if err := ioutil.WriteFile(file, data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+// 按旧结构统计每个公钥hash的余额
+func legacyBalances(t *testing.T, file string) map[string]int {
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	unspent := make(map[string]legacyTXOutput)
+	err = db.View(func(tx *bolt.Tx) error {
+		var chain []*legacyBlock
+		for hash := tx.Bucket([]byte(blockBucket)).Get([]byte("l")); len(hash) != 0; {
+			block, err := readLegacyBlock0(tx, hash)
+			if err != nil {
+				return err
+			}
+			chain = append(chain, block)
+			hash = block.PrevBlockHash
+		}
+		for i := len(chain) - 1; i >= 0; i-- {
+			for _, t := range chain[i].Transations {
+				for _, vin := range t.Vin {
+					delete(unspent, fmt.Sprintf("%x:%d", vin.TXid, vin.Voutindex))
+				}
+				for k, out := range t.Vout {
+					unspent[fmt.Sprintf("%x:%d", t.ID, k)] = out
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	balances := make(map[string]int)
+	for _, out := range unspent {
+		balances[hex.EncodeToString(out.PubkeyHash)] += out.Value
+	}
+	return balances
+}
+
+func TestMigrateLegacyChain(t *testing.T) {
+	file := copyLegacyDB(t)
+	want := legacyBalances(t, file)
+	if len(want) == 0 {
+		t.Fatal("no balances in the legacy database")
+	}
+
+	bc := OpenBlockchain(file, func() *Block { t.Fatal("genesis recreated"); return nil })
+	defer bc.Close()
+
+	if got := bc.GetBestHeight(); got != 7 {
+		t.Fatalf("migrated chain height %d, want 7", got)
+	}
+	set := UTXOSet{bc}
+	for pubkeyHash, balance := range want {
+		hash, _ := hex.DecodeString(pubkeyHash)
+		got := 0
+		for _, out := range set.FindUTXOByScript(payToPubkeyHashScript(hash)) {
+			got += out.Value
+		}
+		if got != balance {
+			t.Errorf("balance of %s is %d after migration, want %d", pubkeyHash, got, balance)
+		}
+	}
+
+	var genesis *Block
+	for hash := bc.Tip(); len(hash) != 0; {
+		block, err := bc.GetBlock(hash)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, tx := range block.Transations {
+			for i, vin := range tx.Vin {
+				if !tx.IsCoinBase() && vin.pubKey() == nil {
+					t.Fatalf("transation %x input %d lost its signature", tx.ID, i)
+				}
+			}
+		}
+		genesis = &block
+		hash = block.PrevBlockHash
+	}
+	if data := genesis.Transations[0].Vin[0].ScriptSig; !bytes.Equal(data, []byte(genesisData)) {
+		t.Fatalf("genesis coinbase data %q, want %q", data, genesisData)
+	}
+}
+
+func TestMigrateRejectsBadSignature(t *testing.T) {
+	file := copyLegacyDB(t)
+	db, err := bolt.Open(file, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 篡改最新区块中交易的签名
+	err = db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(blockBucket))
+		hash := b.Get([]byte("l"))
+		block, err := readLegacyBlock0(tx, hash)
+		if err != nil {
+			return err
+		}
+		block.Transations[0].Vin[0].Signature[0] ^= 1
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(block); err != nil {
+			return err
+		}
+		return b.Put(hash, buf.Bytes())
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("migration accepted a bad signature")
+			}
+		}()
+		migrateChain(db)
+	}()
+
+	// 数据库没有被改写
+	err = db.View(func(tx *bolt.Tx) error {
+		if v := tx.Bucket([]byte(blockBucket)).Get(storageVersionKey); v != nil {
+			t.Fatalf("storage version %v written", v)
+		}
+		return nil
+	})
+	db.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
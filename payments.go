@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// 批量付款：一笔交易向多个地址付款，只有一个找零输出。
+// 付款可以在命令行中用 -pay 地址:金额 重复指定，也可以从CSV或JSON文件读取
+
+const maxPayments = 1000 // 一笔交易中付款的最大个数
+
+// 一个收款地址与金额
+type Payment struct {
+	Address string `json:"address"`
+	Amount  int    `json:"amount"`
+}
+
+// 可以重复使用的 -pay 参数
+type paymentList []Payment
+
+func (p *paymentList) String() string {
+	var parts []string
+	for _, payment := range *p {
+		parts = append(parts, fmt.Sprintf("%s:%d", payment.Address, payment.Amount))
+	}
+	return strings.Join(parts, ",")
+}
+
+func (p *paymentList) Set(value string) error {
+	i := strings.LastIndex(value, ":")
+	if i < 0 {
+		return fmt.Errorf("payment %q must be ADDRESS:AMOUNT", value)
+	}
+	amount, err := strconv.Atoi(value[i+1:])
+	if err != nil {
+		return fmt.Errorf("bad amount in payment %q", value)
+	}
+	*p = append(*p, Payment{value[:i], amount})
+	return nil
+}
+
+// 按扩展名读取付款文件，.json为 [{"address":..., "amount":...}] 数组，
+// 其他为每行 地址,金额 的CSV，第一行可以是表头
+func ReadPaymentFile(path string) ([]Payment, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		var payments []Payment
+		dec := json.NewDecoder(file)
+		dec.DisallowUnknownFields()
+		if err := dec.Decode(&payments); err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+		return payments, nil
+	}
+	return readPaymentCSV(path, file)
+}
+
+func readPaymentCSV(path string, r io.Reader) ([]Payment, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 2
+	reader.TrimLeadingSpace = true
+	reader.Comment = '#'
+
+	var payments []Payment
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		line, _ := reader.FieldPos(0)
+		amount, err := strconv.Atoi(strings.TrimSpace(record[1]))
+		if err != nil {
+			if len(payments) == 0 && line == 1 {
+				continue // 表头
+			}
+			return nil, fmt.Errorf("%s:%d: bad amount %q", path, line, record[1])
+		}
+		payments = append(payments, Payment{strings.TrimSpace(record[0]), amount})
+	}
+	return payments, nil
+}
+
+// 检查地址与金额，返回付款总额
+func validatePayments(payments []Payment) (int, error) {
+	if len(payments) == 0 {
+		return 0, errors.New("no payments")
+	}
+	if len(payments) > maxPayments {
+		return 0, fmt.Errorf("%d payments, at most %d in one transation", len(payments), maxPayments)
+	}
+
+	total := 0
+	for i, payment := range payments {
+		if _, err := addressToScript(payment.Address); err != nil {
+			return 0, fmt.Errorf("payment %d: %s", i+1, err)
+		}
+		if payment.Amount <= 0 {
+			return 0, fmt.Errorf("payment %d: amount must be positive", i+1)
+		}
+		if total > math.MaxInt32-payment.Amount {
+			return 0, fmt.Errorf("payment %d: total amount too large", i+1)
+		}
+		total += payment.Amount
+	}
+	return total, nil
+}
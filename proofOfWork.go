@@ -7,17 +7,17 @@ import (
 )
 
 type ProofOfWork struct {
-	block   *Block
+	header  *BlockHeader
 	tartget *big.Int
 }
 
 const targetBits = 16
 
-func NewProofofWork(b *Block) *ProofOfWork {
+func NewProofofWork(h *BlockHeader) *ProofOfWork {
 
 	target := big.NewInt(1)
 	target.Lsh(target, uint(256-targetBits))	// 实际目标值不是这样求，而是根据难度值来推
-	pow := &ProofOfWork{b, target}
+	pow := &ProofOfWork{h, target}
 	return pow
 }
 
@@ -29,19 +29,11 @@ func NewProofofWork(b *Block) *ProofOfWork {
 //	fmt.Printf("d-----%d\n",target.Bytes())
 //	fmt.Printf("x-----%x\n",target.Bytes())
 //}
+// 随机数为nonce时序列化的区块头，区块hash只覆盖区块头
 func (pow *ProofOfWork) prepareData(nonce int32) []byte {
-
-	data := bytes.Join(
-		[][]byte{
-			IntToHex(pow.block.Version),
-			pow.block.PrevBlockHash,
-			pow.block.Merkleroot,
-			IntToHex(pow.block.Time),
-			IntToHex(pow.block.Bits),
-			IntToHex(nonce)},
-		[]byte{},
-	)
-	return data
+	h := *pow.header
+	h.Nonce = nonce
+	return h.Serialize()
 }
 
 func (pow *ProofOfWork) Run() (int32, []byte) {
@@ -78,12 +70,13 @@ func (pow *ProofOfWork) Run() (int32, []byte) {
 func (pow *ProofOfWork) Validate() bool {
 	var hashInt big.Int
 
-	data := pow.prepareData(pow.block.Nonce)
+	data := pow.prepareData(pow.header.Nonce)
 
 	fitstHash := sha256.Sum256(data)
 	secondhash := sha256.Sum256(fitstHash[:])
 	hashInt.SetBytes(secondhash[:])
-	isValid := hashInt.Cmp(pow.tartget) == -1
+	// 除了满足难度目标，区块中记录的hash也必须是由区块头计算出来的
+	isValid := hashInt.Cmp(pow.tartget) == -1 && bytes.Equal(secondhash[:], pow.header.Hash)
 
 	return isValid
 }
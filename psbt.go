@@ -0,0 +1,549 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strings"
+)
+
+// 部分签名交易（类似BIP174的PSBT）：在线节点构造未签名交易，并附上每个输入引用的交易，
+// 离线机器不需要区块链就能核对金额并签名；多个签名者各自签名后合并，最后在线节点检查并广播。
+// 多重签名与时间锁输入的签名先分别保存，最后才组成解锁脚本。
+// 众筹：发起人构造只有目标输出、没有输入的交易，每个出资人加入自己的输入并用ALL|ANYONECANPAY签名，
+// 签名只覆盖自己的输入与全部输出，所以各自的出资可以合并成一笔交易，输入总额达到目标之前交易无效
+
+const psbtPrefix = "psbt:" // 文件内容为前缀加上base64编码，可以直接复制粘贴
+
+type PartialTransation struct {
+	Tx      Transation
+	PrevTXs []Transation // 输入引用的交易
+	Inputs  []psbtInput  // 与Tx.Vin一一对应
+}
+
+type psbtInput struct {
+	RedeemScript []byte            // 花费脚本哈希地址时的赎回脚本
+	Sigs         map[string][]byte // 多重签名与时间锁输入已有的签名，键-公钥的十六进制
+}
+
+// 构造付款的部分签名交易，from只需要公钥；from是脚本哈希地址时redeemScript为它的赎回脚本，
+// 时间锁脚本会设置交易的锁定时间或输入的序号
+func NewPartialTransation(from string, redeemScript []byte, payments []Payment, bc *Blockchain, selector CoinSelector, fees FeePolicy) (*PartialTransation, int, error) {
+	tx, fee, err := NewPaymentTransation(from, payments, bc, selector, fees)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ptx := &PartialTransation{Tx: *tx, Inputs: make([]psbtInput, len(tx.Vin))}
+	for i := range ptx.Inputs {
+		ptx.Inputs[i].RedeemScript = redeemScript
+	}
+	if lock, relative, _, ok := extractTimeLock(redeemScript); ok {
+		if relative {
+			for i := range ptx.Tx.Vin {
+				ptx.Tx.Vin[i].Sequence = lock
+			}
+		} else {
+			ptx.Tx.LockTime = lock
+		}
+		ptx.Tx.ID = ptx.Tx.unsignedHash()
+	}
+	seen := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		id := hex.EncodeToString(vin.TXid)
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+
+		prevTX, err := bc.FindTransationById(vin.TXid)
+		if err != nil {
+			return nil, 0, err
+		}
+		ptx.PrevTXs = append(ptx.PrevTXs, prevTX)
+	}
+	return ptx, fee, nil
+}
+
+// 构造众筹交易：只有付款输出，没有输入，由出资人用Pledge加入输入
+func NewCrowdfundTransation(payments []Payment) (*PartialTransation, error) {
+	if _, err := validatePayments(payments); err != nil {
+		return nil, err
+	}
+	tx := Transation{}
+	for _, payment := range payments {
+		tx.Vout = append(tx.Vout, *NewTXOutput(payment.Amount, payment.Address))
+	}
+	tx.ID = tx.unsignedHash()
+	return &PartialTransation{Tx: tx}, nil
+}
+
+// 从from的未花费输出中选出不少于amount的输出加入交易，返回加入的总额。
+// 众筹的输出已经被其他出资人签名，不能找零，选出的输出全部投入，超出目标的部分成为手续费
+func (p *PartialTransation) Pledge(from string, amount int, bc *Blockchain, selector CoinSelector) (int, error) {
+	pubkeyHash, err := addressToPubkeyHash(from)
+	if err != nil {
+		return 0, err
+	}
+	if amount <= 0 {
+		return 0, errors.New("pledge amount must be positive")
+	}
+	if err := p.checkCanAddInputs(); err != nil {
+		return 0, err
+	}
+
+	var coins []Coin
+	for _, coin := range bc.FindCoins(payToPubkeyHashScript(pubkeyHash)) {
+		if p.findInput(coin.TxID, coin.Index) < 0 {
+			coins = append(coins, coin)
+		}
+	}
+	selected, err := selector.Select(coins, amount, len(p.Tx.Vout), FeePolicy{})
+	if err != nil {
+		return 0, err
+	}
+
+	pledged := 0
+	prevTXs := p.prevTXs()
+	for _, coin := range selected {
+		p.Tx.Vin = append(p.Tx.Vin, TXInput{coin.TxID, coin.Index, nil, 0})
+		p.Inputs = append(p.Inputs, psbtInput{})
+		pledged += coin.Value
+
+		id := hex.EncodeToString(coin.TxID)
+		if _, ok := prevTXs[id]; ok {
+			continue
+		}
+		prevTX, err := bc.FindTransationById(coin.TxID)
+		if err != nil {
+			return 0, err
+		}
+		p.PrevTXs = append(p.PrevTXs, prevTX)
+		prevTXs[id] = prevTX
+	}
+	p.Tx.ID = p.Tx.unsignedHash()
+	return pledged, nil
+}
+
+// 引用txid:index的输入的位置，没有时返回-1
+func (p *PartialTransation) findInput(txid []byte, index int) int {
+	for i, vin := range p.Tx.Vin {
+		if bytes.Equal(vin.TXid, txid) && vin.Voutindex == index {
+			return i
+		}
+	}
+	return -1
+}
+
+// 第i个输入已有签名的签名类型
+func (p *PartialTransation) sigHashTypes(i int) []byte {
+	var types []byte
+	if sigScript := p.Tx.Vin[i].ScriptSig; sigScript != nil {
+		if pushes := scriptPushes(sigScript); len(pushes) != 0 && len(pushes[0]) != 0 {
+			types = append(types, pushes[0][len(pushes[0])-1])
+		}
+	}
+	for _, sig := range p.Inputs[i].Sigs {
+		if len(sig) != 0 {
+			types = append(types, sig[len(sig)-1])
+		}
+	}
+	return types
+}
+
+// 加入输入会使不带ANYONECANPAY的签名失效
+func (p *PartialTransation) checkCanAddInputs() error {
+	for i := range p.Tx.Vin {
+		for _, hashType := range p.sigHashTypes(i) {
+			if hashType&SIGHASH_ANYONECANPAY == 0 {
+				return fmt.Errorf("input %d is signed with %s, adding inputs would invalidate it", i, sigHashTypeString(hashType))
+			}
+		}
+	}
+	return nil
+}
+
+func (p *PartialTransation) Encode() string {
+	var encoded bytes.Buffer
+	err := gob.NewEncoder(&encoded).Encode(p)
+	checkErr(err)
+	return psbtPrefix + base64.StdEncoding.EncodeToString(encoded.Bytes())
+}
+
+// 解码并检查附带的交易确实是输入引用的交易，防止离线签名者被错误的金额欺骗
+func DecodePartialTransation(data string) (*PartialTransation, error) {
+	data = strings.TrimSpace(data)
+	if !strings.HasPrefix(data, psbtPrefix) {
+		return nil, errors.New("not a partially signed transation")
+	}
+	raw, err := base64.StdEncoding.DecodeString(data[len(psbtPrefix):])
+	if err != nil {
+		return nil, err
+	}
+
+	var p PartialTransation
+	err = gob.NewDecoder(bytes.NewReader(raw)).Decode(&p)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(p.Tx.ID, p.Tx.unsignedHash()) {
+		return nil, fmt.Errorf("transation id %x does not match its content", p.Tx.ID)
+	}
+	if p.Tx.IsCoinBase() {
+		return nil, errors.New("coinbase transation can not be signed offline")
+	}
+
+	prevTXs := p.prevTXs()
+	for id, prevTX := range prevTXs {
+		if !bytes.Equal(prevTX.ID, prevTX.unsignedHash()) {
+			return nil, fmt.Errorf("previous transation %s does not match its content", id)
+		}
+	}
+	for i, vin := range p.Tx.Vin {
+		prevTX, ok := prevTXs[hex.EncodeToString(vin.TXid)]
+		if !ok || vin.Voutindex < 0 || vin.Voutindex >= len(prevTX.Vout) {
+			return nil, fmt.Errorf("input %d: previous output %x:%d is missing", i, vin.TXid, vin.Voutindex)
+		}
+	}
+
+	if p.Inputs == nil {
+		p.Inputs = make([]psbtInput, len(p.Tx.Vin))
+	}
+	if len(p.Inputs) != len(p.Tx.Vin) {
+		return nil, fmt.Errorf("%d inputs but %d input records", len(p.Tx.Vin), len(p.Inputs))
+	}
+	for i, input := range p.Inputs {
+		scriptHash := extractScriptHash(p.prevOut(i).ScriptPubKey)
+		if input.RedeemScript != nil && (scriptHash == nil || !bytes.Equal(HashPubKey(input.RedeemScript), scriptHash)) {
+			return nil, fmt.Errorf("input %d: redeem script does not match the previous output", i)
+		}
+	}
+	return &p, nil
+}
+
+func ReadPartialTransation(file string) (*PartialTransation, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	return DecodePartialTransation(string(data))
+}
+
+func (p *PartialTransation) WriteFile(file string) error {
+	return ioutil.WriteFile(file, []byte(p.Encode()+"\n"), 0600)
+}
+
+func (p *PartialTransation) prevTXs() map[string]Transation {
+	prevTXs := make(map[string]Transation)
+	for _, prevTX := range p.PrevTXs {
+		prevTXs[hex.EncodeToString(prevTX.ID)] = prevTX
+	}
+	return prevTXs
+}
+
+// 第i个输入花费的输出
+func (p *PartialTransation) prevOut(i int) TXOutput {
+	vin := p.Tx.Vin[i]
+	return p.prevTXs()[hex.EncodeToString(vin.TXid)].Vout[vin.Voutindex]
+}
+
+// 输入总额减去输出总额
+func (p *PartialTransation) Fee() int {
+	fee := 0
+	for i := range p.Tx.Vin {
+		fee += p.prevOut(i).Value
+	}
+	for _, out := range p.Tx.Vout {
+		fee -= out.Value
+	}
+	return fee
+}
+
+// 设置交易的锁定时间，必须在签名之前
+func (p *PartialTransation) SetLockTime(lockTime uint32) error {
+	for i, vin := range p.Tx.Vin {
+		if vin.ScriptSig != nil || len(p.Inputs[i].Sigs) != 0 {
+			return errors.New("can not change lock time after signing")
+		}
+	}
+	p.Tx.LockTime = lockTime
+	p.Tx.ID = p.Tx.unsignedHash()
+	return nil
+}
+
+// 第i个输入签名覆盖的脚本：花费脚本哈希输出时为赎回脚本，否则为锁定脚本
+func (p *PartialTransation) signScript(i int) []byte {
+	script := p.prevOut(i).ScriptPubKey
+	if extractScriptHash(script) != nil {
+		script = p.Inputs[i].RedeemScript
+	}
+	return script
+}
+
+// 第i个输入是时间锁时返回签名覆盖的脚本与公钥哈希
+func (p *PartialTransation) timeLock(i int) ([]byte, []byte) {
+	script := p.signScript(i)
+	_, _, pubkeyHash, ok := extractTimeLock(script)
+	if !ok {
+		return nil, nil
+	}
+	return script, pubkeyHash
+}
+
+// 第i个输入是多重签名时返回签名覆盖的脚本与门限、公钥
+func (p *PartialTransation) multiSig(i int) ([]byte, int, [][]byte) {
+	script := p.signScript(i)
+	m, pubKeys, ok := extractMultiSig(script)
+	if !ok {
+		return nil, 0, nil
+	}
+	return script, m, pubKeys
+}
+
+// 用私钥以hashType签名属于它的输入，返回签名的输入个数。
+// 每个输入的签名只覆盖交易本身与它引用的输出，不受其他输入的签名影响，所以可以分别签名后合并
+func (p *PartialTransation) Sign(privkey ecdsa.PrivateKey, hashType byte) int {
+	signed := p.Tx
+	signed.Vin = make([]TXInput, len(p.Tx.Vin))
+	copy(signed.Vin, p.Tx.Vin)
+	signed.SignHashType(privkey, p.prevTXs(), hashType)
+
+	n := 0
+	for i, vin := range signed.Vin {
+		if !bytes.Equal(vin.ScriptSig, p.Tx.Vin[i].ScriptSig) {
+			p.Tx.Vin[i].ScriptSig = vin.ScriptSig
+			n++
+		}
+	}
+
+	pubKey := append(privkey.PublicKey.X.Bytes(), privkey.PublicKey.Y.Bytes()...)
+	for i := range p.Tx.Vin {
+		if p.Tx.Vin[i].ScriptSig != nil {
+			continue
+		}
+		script, _, pubKeys := p.multiSig(i)
+		if lockScript, pubkeyHash := p.timeLock(i); lockScript != nil && bytes.Equal(HashPubKey(pubKey), pubkeyHash) {
+			script, pubKeys = lockScript, [][]byte{pubKey}
+		}
+		for _, key := range pubKeys {
+			if !bytes.Equal(key, pubKey) {
+				continue
+			}
+			sig := p.Tx.signatureFor(i, script, privkey, hashType)
+			if sig == nil {
+				continue
+			}
+			if p.Inputs[i].Sigs == nil {
+				p.Inputs[i].Sigs = make(map[string][]byte)
+			}
+			p.Inputs[i].Sigs[hex.EncodeToString(key)] = sig
+			n++
+		}
+	}
+	return n
+}
+
+// 用钱包中的私钥以hashType签名所有能签名的输入
+func (p *PartialTransation) SignWithWallet(ws *Wallets, hashType byte) (int, error) {
+	if ws.IsLocked() {
+		return 0, errWalletLocked
+	}
+
+	n := 0
+	signed := make(map[string]bool)
+	for i := range p.Tx.Vin {
+		var addresses []string
+		prevOut := p.prevOut(i)
+		if pubkeyHash := prevOut.pubkeyHash(); pubkeyHash != nil {
+			addresses = append(addresses, pubkeyHashToAddress(pubkeyHash))
+		}
+		_, _, pubKeys := p.multiSig(i)
+		for _, key := range pubKeys {
+			addresses = append(addresses, pubkeyHashToAddress(HashPubKey(key)))
+		}
+		if script, pubkeyHash := p.timeLock(i); script != nil {
+			addresses = append(addresses, pubkeyHashToAddress(pubkeyHash))
+		}
+
+		for _, address := range addresses {
+			wallet := ws.WalletsStore[address]
+			if wallet == nil || signed[address] {
+				continue
+			}
+			signed[address] = true
+			n += p.Sign(wallet.PrivateKey, hashType)
+		}
+	}
+	return n, nil
+}
+
+// 合并其他签名者对同一笔交易的签名。
+// 交易不同时，如果输出与锁定时间相同、双方的签名都带ANYONECANPAY，就合并双方的输入，例如众筹的多个出资
+func (p *PartialTransation) Combine(other *PartialTransation) error {
+	if !bytes.Equal(p.Tx.ID, other.Tx.ID) {
+		if err := p.addInputsFrom(other); err != nil {
+			return fmt.Errorf("can not combine different transations %x and %x: %s", p.Tx.ID, other.Tx.ID, err)
+		}
+	}
+	for j, vin := range other.Tx.Vin {
+		i := p.findInput(vin.TXid, vin.Voutindex)
+		if p.Tx.Vin[i].ScriptSig == nil {
+			p.Tx.Vin[i].ScriptSig = vin.ScriptSig
+		}
+		for key, sig := range other.Inputs[j].Sigs {
+			if p.Inputs[i].Sigs == nil {
+				p.Inputs[i].Sigs = make(map[string][]byte)
+			}
+			if _, ok := p.Inputs[i].Sigs[key]; !ok {
+				p.Inputs[i].Sigs[key] = sig
+			}
+		}
+	}
+	return nil
+}
+
+// 把other中没有的输入加入交易，签名由Combine合并
+func (p *PartialTransation) addInputsFrom(other *PartialTransation) error {
+	if p.Tx.LockTime != other.Tx.LockTime || len(p.Tx.Vout) != len(other.Tx.Vout) {
+		return errors.New("outputs or lock time differ")
+	}
+	for i, out := range p.Tx.Vout {
+		if out.Value != other.Tx.Vout[i].Value || !bytes.Equal(out.ScriptPubKey, other.Tx.Vout[i].ScriptPubKey) {
+			return errors.New("outputs or lock time differ")
+		}
+	}
+	if err := p.checkCanAddInputs(); err != nil {
+		return err
+	}
+	if err := other.checkCanAddInputs(); err != nil {
+		return err
+	}
+
+	prevTXs := p.prevTXs()
+	for _, prevTX := range other.PrevTXs {
+		if _, ok := prevTXs[hex.EncodeToString(prevTX.ID)]; !ok {
+			p.PrevTXs = append(p.PrevTXs, prevTX)
+		}
+	}
+	for _, vin := range other.Tx.Vin {
+		if p.findInput(vin.TXid, vin.Voutindex) >= 0 {
+			continue
+		}
+		p.Tx.Vin = append(p.Tx.Vin, TXInput{vin.TXid, vin.Voutindex, nil, vin.Sequence})
+		p.Inputs = append(p.Inputs, psbtInput{RedeemScript: other.Inputs[other.findInput(vin.TXid, vin.Voutindex)].RedeemScript})
+	}
+	p.Tx.ID = p.Tx.unsignedHash()
+	return nil
+}
+
+// 所有输入都已签名并通过验证时返回可以广播的交易，多重签名输入按公钥顺序取前m个签名
+func (p *PartialTransation) Finalize() (*Transation, error) {
+	if len(p.Tx.Vin) == 0 {
+		return nil, errors.New("transation has no inputs")
+	}
+	if fee := p.Fee(); fee < 0 {
+		return nil, fmt.Errorf("inputs are %d short of the outputs", -fee)
+	}
+	tx := p.Tx
+	tx.Vin = make([]TXInput, len(p.Tx.Vin))
+	copy(tx.Vin, p.Tx.Vin)
+
+	for i, vin := range tx.Vin {
+		if vin.ScriptSig != nil {
+			continue
+		}
+		if script, _ := p.timeLock(i); script != nil {
+			sigScript, err := p.timeLockSigScript(i)
+			if err != nil {
+				return nil, err
+			}
+			tx.Vin[i].ScriptSig = sigScript
+			continue
+		}
+		script, m, pubKeys := p.multiSig(i)
+		if script == nil {
+			return nil, fmt.Errorf("input %d is not signed", i)
+		}
+
+		var sigs [][]byte
+		for _, key := range pubKeys {
+			if sig, ok := p.Inputs[i].Sigs[hex.EncodeToString(key)]; ok && len(sigs) < m {
+				sigs = append(sigs, sig)
+			}
+		}
+		if len(sigs) < m {
+			return nil, fmt.Errorf("input %d has %d of %d signatures", i, len(sigs), m)
+		}
+		tx.Vin[i].ScriptSig = multiSigSigScript(sigs)
+		if p.Inputs[i].RedeemScript != nil {
+			tx.Vin[i].ScriptSig = payToScriptHashSigScript(tx.Vin[i].ScriptSig, p.Inputs[i].RedeemScript)
+		}
+	}
+
+	if !tx.Verify(p.prevTXs()) {
+		return nil, errors.New("invalid signature")
+	}
+	return &tx, nil
+}
+
+// 时间锁输入的解锁脚本：签名、公钥，花费脚本哈希输出时再加上赎回脚本
+func (p *PartialTransation) timeLockSigScript(i int) ([]byte, error) {
+	for key, sig := range p.Inputs[i].Sigs {
+		pubKey, err := hex.DecodeString(key)
+		if err != nil {
+			return nil, err
+		}
+		sigScript := payToPubkeyHashSigScript(sig, pubKey)
+		if p.Inputs[i].RedeemScript != nil {
+			sigScript = payToScriptHashSigScript(sigScript, p.Inputs[i].RedeemScript)
+		}
+		return sigScript, nil
+	}
+	return nil, fmt.Errorf("input %d is not signed", i)
+}
+
+// 签名之前给用户核对的摘要
+func (p *PartialTransation) String() string {
+	var lines []string
+
+	lines = append(lines, fmt.Sprintf("Transation %x", p.Tx.ID))
+	for i, vin := range p.Tx.Vin {
+		status := "unsigned"
+		if vin.ScriptSig != nil {
+			status = "signed"
+		} else if script, m, _ := p.multiSig(i); script != nil {
+			status = fmt.Sprintf("%d/%d signatures", len(p.Inputs[i].Sigs), m)
+		} else if len(p.Inputs[i].Sigs) != 0 {
+			status = "signed"
+		}
+		for _, hashType := range p.sigHashTypes(i) {
+			if hashType != SIGHASH_ALL {
+				status += "  " + sigHashTypeString(hashType)
+				break
+			}
+		}
+		if vin.Sequence&sequenceLockTimeDisabled == 0 && vin.Sequence&sequenceLockTimeMask != 0 {
+			status += fmt.Sprintf("  sequence %#x", vin.Sequence)
+		}
+		prevOut := p.prevOut(i)
+		lines = append(lines, fmt.Sprintf("  input %d: %x:%d  %s  %d  %s", i, vin.TXid, vin.Voutindex,
+			prevOut.address(), prevOut.Value, status))
+	}
+	for i, out := range p.Tx.Vout {
+		lines = append(lines, fmt.Sprintf("  output %d: %s  %d", i, out.address(), out.Value))
+	}
+	if p.Tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("  locktime: %s", lockTimeString(p.Tx.LockTime)))
+	}
+	if fee := p.Fee(); fee < 0 {
+		lines = append(lines, fmt.Sprintf("  missing: %d", -fee))
+	} else {
+		lines = append(lines, fmt.Sprintf("  fee: %d", fee))
+	}
+	return strings.Join(lines, "\n")
+}
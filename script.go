@@ -0,0 +1,802 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/big"
+	"strconv"
+	"strings"
+)
+
+// 脚本：输出带有锁定脚本，输入带有解锁脚本。验证时先执行解锁脚本，
+// 再用得到的栈执行锁定脚本，结束时栈顶为真才能花费。
+// 操作码与比特币相同，只实现了其中的一部分，执行时限制脚本大小、元素大小、操作数与栈深度
+
+// 操作码
+const (
+	OP_0         = 0x00
+	OP_PUSHDATA1 = 0x4c
+	OP_PUSHDATA2 = 0x4d
+	OP_1NEGATE   = 0x4f
+	OP_1         = 0x51
+	OP_16        = 0x60
+	OP_NOP       = 0x61
+
+	OP_IF     = 0x63
+	OP_NOTIF  = 0x64
+	OP_ELSE   = 0x67
+	OP_ENDIF  = 0x68
+	OP_VERIFY = 0x69
+	OP_RETURN = 0x6a
+
+	OP_DROP = 0x75
+	OP_DUP  = 0x76
+	OP_SWAP = 0x7c
+	OP_SIZE = 0x82
+
+	OP_EQUAL       = 0x87
+	OP_EQUALVERIFY = 0x88
+
+	OP_1ADD        = 0x8b
+	OP_1SUB        = 0x8c
+	OP_NOT         = 0x91
+	OP_ADD         = 0x93
+	OP_SUB         = 0x94
+	OP_BOOLAND     = 0x9a
+	OP_BOOLOR      = 0x9b
+	OP_NUMEQUAL    = 0x9c
+	OP_LESSTHAN    = 0x9f
+	OP_GREATERTHAN = 0xa0
+	OP_WITHIN      = 0xa5
+
+	OP_CHECKLOCKTIMEVERIFY = 0xb1
+	OP_CHECKSEQUENCEVERIFY = 0xb2
+
+	OP_SHA256              = 0xa8
+	OP_HASH160             = 0xa9
+	OP_HASH256             = 0xaa
+	OP_CHECKSIG            = 0xac
+	OP_CHECKSIGVERIFY      = 0xad
+	OP_CHECKMULTISIG       = 0xae
+	OP_CHECKMULTISIGVERIFY = 0xaf
+)
+
+// 限制
+const (
+	maxScriptSize        = 10000
+	maxScriptElementSize = 520
+	maxScriptOps         = 201 // 不含数据压栈
+	maxStackSize         = 1000
+	maxScriptNumLen      = 4
+	maxMultiSigKeys      = 20
+)
+
+var opcodeNames = map[byte]string{
+	OP_0: "OP_0", OP_PUSHDATA1: "OP_PUSHDATA1", OP_PUSHDATA2: "OP_PUSHDATA2", OP_1NEGATE: "OP_1NEGATE", OP_NOP: "OP_NOP",
+	OP_IF: "OP_IF", OP_NOTIF: "OP_NOTIF", OP_ELSE: "OP_ELSE", OP_ENDIF: "OP_ENDIF", OP_VERIFY: "OP_VERIFY", OP_RETURN: "OP_RETURN",
+	OP_DROP: "OP_DROP", OP_DUP: "OP_DUP", OP_SWAP: "OP_SWAP", OP_SIZE: "OP_SIZE",
+	OP_EQUAL: "OP_EQUAL", OP_EQUALVERIFY: "OP_EQUALVERIFY",
+	OP_1ADD: "OP_1ADD", OP_1SUB: "OP_1SUB", OP_NOT: "OP_NOT", OP_ADD: "OP_ADD", OP_SUB: "OP_SUB",
+	OP_BOOLAND: "OP_BOOLAND", OP_BOOLOR: "OP_BOOLOR", OP_NUMEQUAL: "OP_NUMEQUAL",
+	OP_LESSTHAN: "OP_LESSTHAN", OP_GREATERTHAN: "OP_GREATERTHAN", OP_WITHIN: "OP_WITHIN",
+	OP_SHA256: "OP_SHA256", OP_HASH160: "OP_HASH160", OP_HASH256: "OP_HASH256",
+	OP_CHECKSIG: "OP_CHECKSIG", OP_CHECKSIGVERIFY: "OP_CHECKSIGVERIFY",
+	OP_CHECKMULTISIG: "OP_CHECKMULTISIG", OP_CHECKMULTISIGVERIFY: "OP_CHECKMULTISIGVERIFY",
+	OP_CHECKLOCKTIMEVERIFY: "OP_CHECKLOCKTIMEVERIFY", OP_CHECKSEQUENCEVERIFY: "OP_CHECKSEQUENCEVERIFY",
+}
+
+var errScriptFailed = errors.New("script evaluated to false")
+
+// 解析出的一条指令，数据压栈指令的data为压入的数据
+type scriptOp struct {
+	code byte
+	data []byte
+}
+
+func (op scriptOp) isPush() bool {
+	return op.code <= OP_16 && op.code != 0x50
+}
+
+func parseScript(script []byte) ([]scriptOp, error) {
+	var ops []scriptOp
+	for i := 0; i < len(script); {
+		code := script[i]
+		i++
+
+		var n int
+		switch {
+		case code > OP_0 && code < OP_PUSHDATA1:
+			n = int(code)
+		case code == OP_PUSHDATA1:
+			if i+1 > len(script) {
+				return nil, errors.New("script truncated in OP_PUSHDATA1")
+			}
+			n = int(script[i])
+			i++
+		case code == OP_PUSHDATA2:
+			if i+2 > len(script) {
+				return nil, errors.New("script truncated in OP_PUSHDATA2")
+			}
+			n = int(script[i]) | int(script[i+1])<<8
+			i += 2
+		default:
+			ops = append(ops, scriptOp{code: code})
+			continue
+		}
+
+		if i+n > len(script) {
+			return nil, fmt.Errorf("push of %d bytes past end of script", n)
+		}
+		ops = append(ops, scriptOp{code, script[i : i+n]})
+		i += n
+	}
+	return ops, nil
+}
+
+// 脚本是否只包含数据压栈
+func isPushOnly(script []byte) bool {
+	ops, err := parseScript(script)
+	if err != nil {
+		return false
+	}
+	for _, op := range ops {
+		if !op.isPush() {
+			return false
+		}
+	}
+	return true
+}
+
+// 脚本中压入的所有数据
+func scriptPushes(script []byte) [][]byte {
+	ops, _ := parseScript(script)
+	var pushes [][]byte
+	for _, op := range ops {
+		if len(op.data) > 0 {
+			pushes = append(pushes, op.data)
+		}
+	}
+	return pushes
+}
+
+// 反汇编，用于打印
+func DisasmScript(script []byte) string {
+	ops, err := parseScript(script)
+
+	var parts []string
+	for _, op := range ops {
+		switch {
+		case op.data != nil:
+			parts = append(parts, hex.EncodeToString(op.data))
+		case op.code >= OP_1 && op.code <= OP_16:
+			parts = append(parts, fmt.Sprintf("OP_%d", op.code-OP_1+1))
+		case opcodeNames[op.code] != "":
+			parts = append(parts, opcodeNames[op.code])
+		default:
+			parts = append(parts, fmt.Sprintf("OP_UNKNOWN%d", op.code))
+		}
+	}
+	if err != nil {
+		parts = append(parts, "[error]")
+	}
+	return strings.Join(parts, " ")
+}
+
+// 汇编，DisasmScript的逆过程：操作码写名字，OP_1到OP_16写作OP_N，数据写十六进制
+func AssembleScript(asm string) ([]byte, error) {
+	codes := make(map[string]byte)
+	for code, name := range opcodeNames {
+		codes[name] = code
+	}
+
+	b := NewScriptBuilder()
+	for _, token := range strings.Fields(asm) {
+		if code, ok := codes[token]; ok && code != OP_PUSHDATA1 && code != OP_PUSHDATA2 {
+			b.AddOp(code)
+			continue
+		}
+		if strings.HasPrefix(token, "OP_") {
+			n, err := strconv.Atoi(token[3:])
+			if err != nil || n < 1 || n > 16 {
+				return nil, fmt.Errorf("unknown opcode %s", token)
+			}
+			b.AddInt64(int64(n))
+			continue
+		}
+		data, err := hex.DecodeString(token)
+		if err != nil || len(data) == 0 {
+			return nil, fmt.Errorf("%q is neither an opcode nor hex data", token)
+		}
+		if len(data) > maxScriptElementSize {
+			return nil, fmt.Errorf("push of %d bytes, at most %d", len(data), maxScriptElementSize)
+		}
+		b.AddData(data)
+	}
+
+	script := b.Script()
+	if len(script) > maxScriptSize {
+		return nil, fmt.Errorf("script is %d bytes, at most %d", len(script), maxScriptSize)
+	}
+	return script, nil
+}
+
+// 构造脚本
+type ScriptBuilder struct {
+	script []byte
+}
+
+func NewScriptBuilder() *ScriptBuilder {
+	return &ScriptBuilder{}
+}
+
+func (b *ScriptBuilder) AddOp(code byte) *ScriptBuilder {
+	b.script = append(b.script, code)
+	return b
+}
+
+func (b *ScriptBuilder) AddData(data []byte) *ScriptBuilder {
+	n := len(data)
+	switch {
+	case n == 0:
+		b.script = append(b.script, OP_0)
+	case n < OP_PUSHDATA1:
+		b.script = append(b.script, byte(n))
+	case n <= 0xff:
+		b.script = append(b.script, OP_PUSHDATA1, byte(n))
+	default:
+		b.script = append(b.script, OP_PUSHDATA2, byte(n), byte(n>>8))
+	}
+	b.script = append(b.script, data...)
+	return b
+}
+
+func (b *ScriptBuilder) AddInt64(n int64) *ScriptBuilder {
+	switch {
+	case n == 0:
+		return b.AddOp(OP_0)
+	case n == -1:
+		return b.AddOp(OP_1NEGATE)
+	case n >= 1 && n <= 16:
+		return b.AddOp(byte(OP_1 + n - 1))
+	}
+	return b.AddData(encodeScriptNum(n))
+}
+
+func (b *ScriptBuilder) Script() []byte {
+	return b.script
+}
+
+// 脚本中的数字：小端序，最高字节的最高位为符号位
+func encodeScriptNum(n int64) []byte {
+	if n == 0 {
+		return nil
+	}
+	negative := n < 0
+	if negative {
+		n = -n
+	}
+
+	var result []byte
+	for n > 0 {
+		result = append(result, byte(n&0xff))
+		n >>= 8
+	}
+	if result[len(result)-1]&0x80 != 0 {
+		extra := byte(0x00)
+		if negative {
+			extra = 0x80
+		}
+		result = append(result, extra)
+	} else if negative {
+		result[len(result)-1] |= 0x80
+	}
+	return result
+}
+
+func decodeScriptNum(data []byte, maxLen int) (int64, error) {
+	if len(data) > maxLen {
+		return 0, fmt.Errorf("script number of %d bytes is too long", len(data))
+	}
+	// 要求最短编码，否则同一个数字有多种写法
+	if len(data) > 0 && data[len(data)-1]&0x7f == 0 {
+		if len(data) == 1 || data[len(data)-2]&0x80 == 0 {
+			return 0, errors.New("script number is not minimally encoded")
+		}
+	}
+	if len(data) == 0 {
+		return 0, nil
+	}
+
+	var n int64
+	for i, b := range data {
+		n |= int64(b) << uint(8*i)
+	}
+	if data[len(data)-1]&0x80 != 0 {
+		n &^= int64(0x80) << uint(8*(len(data)-1))
+		return -n, nil
+	}
+	return n, nil
+}
+
+// 空数组、全零以及负零为假
+func castToBool(data []byte) bool {
+	for i, b := range data {
+		if b != 0 {
+			return !(i == len(data)-1 && b == 0x80)
+		}
+	}
+	return false
+}
+
+func boolBytes(b bool) []byte {
+	if b {
+		return []byte{1}
+	}
+	return nil
+}
+
+// 脚本执行环境：被验证的交易、当前输入以及签名时替换进输入的脚本
+type scriptEngine struct {
+	tx         *Transation
+	inputIndex int
+	subscript  []byte
+
+	stack [][]byte
+	ops   int
+}
+
+func (e *scriptEngine) push(data []byte) error {
+	if len(data) > maxScriptElementSize {
+		return fmt.Errorf("stack element of %d bytes is too large", len(data))
+	}
+	e.stack = append(e.stack, data)
+	if len(e.stack) > maxStackSize {
+		return errors.New("stack is too deep")
+	}
+	return nil
+}
+
+func (e *scriptEngine) pop() ([]byte, error) {
+	if len(e.stack) == 0 {
+		return nil, errors.New("pop from empty stack")
+	}
+	top := e.stack[len(e.stack)-1]
+	e.stack = e.stack[:len(e.stack)-1]
+	return top, nil
+}
+
+func (e *scriptEngine) popNum() (int64, error) {
+	data, err := e.pop()
+	if err != nil {
+		return 0, err
+	}
+	return decodeScriptNum(data, maxScriptNumLen)
+}
+
+func (e *scriptEngine) popBool() (bool, error) {
+	data, err := e.pop()
+	return castToBool(data), err
+}
+
+// 执行一段脚本，栈在执行之间保留
+func (e *scriptEngine) execute(script []byte) error {
+	if len(script) > maxScriptSize {
+		return fmt.Errorf("script of %d bytes is too large", len(script))
+	}
+	ops, err := parseScript(script)
+	if err != nil {
+		return err
+	}
+
+	var cond []bool // 条件分支，全部为真时才执行
+	executing := func() bool {
+		for _, c := range cond {
+			if !c {
+				return false
+			}
+		}
+		return true
+	}
+
+	for _, op := range ops {
+		if len(op.data) > maxScriptElementSize {
+			return fmt.Errorf("push of %d bytes is too large", len(op.data))
+		}
+		if !op.isPush() {
+			e.ops++
+			if e.ops > maxScriptOps {
+				return errors.New("too many operations in script")
+			}
+		}
+
+		switch op.code {
+		case OP_IF, OP_NOTIF:
+			branch := false
+			if executing() {
+				v, err := e.popBool()
+				if err != nil {
+					return err
+				}
+				branch = v == (op.code == OP_IF)
+			}
+			cond = append(cond, branch)
+			continue
+		case OP_ELSE:
+			if len(cond) == 0 {
+				return errors.New("OP_ELSE without OP_IF")
+			}
+			cond[len(cond)-1] = !cond[len(cond)-1]
+			continue
+		case OP_ENDIF:
+			if len(cond) == 0 {
+				return errors.New("OP_ENDIF without OP_IF")
+			}
+			cond = cond[:len(cond)-1]
+			continue
+		}
+		if !executing() {
+			continue
+		}
+
+		if err := e.step(op); err != nil {
+			return err
+		}
+	}
+	if len(cond) != 0 {
+		return errors.New("OP_IF without OP_ENDIF")
+	}
+	return nil
+}
+
+func (e *scriptEngine) step(op scriptOp) error {
+	switch {
+	case op.code == OP_0:
+		return e.push(nil)
+	case op.data != nil:
+		return e.push(op.data)
+	case op.code == OP_1NEGATE:
+		return e.push(encodeScriptNum(-1))
+	case op.code >= OP_1 && op.code <= OP_16:
+		return e.push(encodeScriptNum(int64(op.code - OP_1 + 1)))
+	}
+
+	switch op.code {
+	case OP_NOP:
+		return nil
+	case OP_VERIFY:
+		v, err := e.popBool()
+		if err != nil {
+			return err
+		}
+		if !v {
+			return errScriptFailed
+		}
+		return nil
+	case OP_RETURN:
+		return errors.New("OP_RETURN")
+
+	case OP_DROP:
+		_, err := e.pop()
+		return err
+	case OP_DUP:
+		if len(e.stack) == 0 {
+			return errors.New("OP_DUP on empty stack")
+		}
+		return e.push(e.stack[len(e.stack)-1])
+	case OP_SWAP:
+		if len(e.stack) < 2 {
+			return errors.New("OP_SWAP needs two items")
+		}
+		n := len(e.stack)
+		e.stack[n-1], e.stack[n-2] = e.stack[n-2], e.stack[n-1]
+		return nil
+	case OP_SIZE:
+		if len(e.stack) == 0 {
+			return errors.New("OP_SIZE on empty stack")
+		}
+		return e.push(encodeScriptNum(int64(len(e.stack[len(e.stack)-1]))))
+
+	case OP_EQUAL, OP_EQUALVERIFY:
+		a, err := e.pop()
+		if err != nil {
+			return err
+		}
+		b, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.pushResult(op.code == OP_EQUALVERIFY, bytes.Equal(a, b))
+
+	case OP_1ADD, OP_1SUB, OP_NOT:
+		a, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.code {
+		case OP_1ADD:
+			return e.push(encodeScriptNum(a + 1))
+		case OP_1SUB:
+			return e.push(encodeScriptNum(a - 1))
+		}
+		return e.push(boolBytes(a == 0))
+
+	case OP_ADD, OP_SUB, OP_BOOLAND, OP_BOOLOR, OP_NUMEQUAL, OP_LESSTHAN, OP_GREATERTHAN:
+		b, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		a, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		switch op.code {
+		case OP_ADD:
+			return e.push(encodeScriptNum(a + b))
+		case OP_SUB:
+			return e.push(encodeScriptNum(a - b))
+		case OP_BOOLAND:
+			return e.push(boolBytes(a != 0 && b != 0))
+		case OP_BOOLOR:
+			return e.push(boolBytes(a != 0 || b != 0))
+		case OP_NUMEQUAL:
+			return e.push(boolBytes(a == b))
+		case OP_LESSTHAN:
+			return e.push(boolBytes(a < b))
+		}
+		return e.push(boolBytes(a > b))
+	case OP_WITHIN:
+		hi, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		lo, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		x, err := e.popNum()
+		if err != nil {
+			return err
+		}
+		return e.push(boolBytes(lo <= x && x < hi))
+
+	case OP_SHA256, OP_HASH160, OP_HASH256:
+		data, err := e.pop()
+		if err != nil {
+			return err
+		}
+		switch op.code {
+		case OP_SHA256:
+			hash := sha256.Sum256(data)
+			return e.push(hash[:])
+		case OP_HASH160:
+			return e.push(HashPubKey(data))
+		}
+		first := sha256.Sum256(data)
+		second := sha256.Sum256(first[:])
+		return e.push(second[:])
+
+	case OP_CHECKSIG, OP_CHECKSIGVERIFY:
+		pubKey, err := e.pop()
+		if err != nil {
+			return err
+		}
+		sig, err := e.pop()
+		if err != nil {
+			return err
+		}
+		return e.pushResult(op.code == OP_CHECKSIGVERIFY, e.checkSig(sig, pubKey))
+	case OP_CHECKMULTISIG, OP_CHECKMULTISIGVERIFY:
+		ok, err := e.checkMultiSig()
+		if err != nil {
+			return err
+		}
+		return e.pushResult(op.code == OP_CHECKMULTISIGVERIFY, ok)
+
+	case OP_CHECKLOCKTIMEVERIFY:
+		return e.checkLockTime()
+	case OP_CHECKSEQUENCEVERIFY:
+		return e.checkSequence()
+	}
+	return fmt.Errorf("unknown opcode 0x%02x", op.code)
+}
+
+// 栈顶的锁定时间，不出栈。锁定时间可以超过4字节的数字范围，最多5字节
+func (e *scriptEngine) peekLockTime() (uint32, error) {
+	if len(e.stack) == 0 {
+		return 0, errors.New("lock time check on empty stack")
+	}
+	n, err := decodeScriptNum(e.stack[len(e.stack)-1], 5)
+	if err != nil {
+		return 0, err
+	}
+	if n < 0 || n > 0xffffffff {
+		return 0, fmt.Errorf("lock time %d out of range", n)
+	}
+	return uint32(n), nil
+}
+
+// 交易的锁定时间不早于栈顶的时间，且类型相同（都是高度或都是时间），输入的锁定时间没有被序号禁用
+func (e *scriptEngine) checkLockTime() error {
+	lockTime, err := e.peekLockTime()
+	if err != nil {
+		return err
+	}
+	txLockTime := e.tx.LockTime
+	if (lockTime < lockTimeThreshold) != (txLockTime < lockTimeThreshold) {
+		return errors.New("lock time type mismatch")
+	}
+	if txLockTime < lockTime {
+		return fmt.Errorf("transation lock time %d is before %d", txLockTime, lockTime)
+	}
+	if e.tx.Vin[e.inputIndex].Sequence == sequenceFinal {
+		return errors.New("lock time disabled by final sequence")
+	}
+	return nil
+}
+
+// 输入的相对锁定不短于栈顶的值，且单位相同。栈顶设置了禁用位时相当于OP_NOP
+func (e *scriptEngine) checkSequence() error {
+	lock, err := e.peekLockTime()
+	if err != nil {
+		return err
+	}
+	if lock&sequenceLockTimeDisabled != 0 {
+		return nil
+	}
+	sequence := e.tx.Vin[e.inputIndex].Sequence
+	if sequence&sequenceLockTimeDisabled != 0 {
+		return errors.New("relative lock time disabled by sequence")
+	}
+	if lock&sequenceLockTimeIsSeconds != sequence&sequenceLockTimeIsSeconds {
+		return errors.New("relative lock time type mismatch")
+	}
+	if sequence&sequenceLockTimeMask < lock&sequenceLockTimeMask {
+		return fmt.Errorf("relative lock %d is shorter than %d", sequence&sequenceLockTimeMask, lock&sequenceLockTimeMask)
+	}
+	return nil
+}
+
+// 结果压栈，verify为真时改为检查结果
+func (e *scriptEngine) pushResult(verify, result bool) error {
+	if !verify {
+		return e.push(boolBytes(result))
+	}
+	if !result {
+		return errScriptFailed
+	}
+	return nil
+}
+
+func (e *scriptEngine) checkSig(sig, pubKey []byte) bool {
+	// r与s各32字节，最后一个字节是签名类型
+	if len(sig) != 65 || !validSigHashType(sig[64]) {
+		return false
+	}
+	key, err := parsePubKey(pubKey)
+	if err != nil {
+		return false
+	}
+	r := new(big.Int).SetBytes(sig[:32])
+	s := new(big.Int).SetBytes(sig[32:64])
+	if !isLowS(key.Curve, s) {
+		return false
+	}
+	hash := e.tx.sigHash(e.inputIndex, e.subscript, sig[64])
+	if hash == nil {
+		return false
+	}
+	return ecdsa.Verify(key, hash, r, s)
+}
+
+// 栈上依次为 <签名1>...<签名m> m <公钥1>...<公钥n> n（栈顶）。
+// 签名必须按公钥的顺序排列，每个公钥最多匹配一个签名。
+// 与比特币不同，不会多弹出一个无用的元素
+func (e *scriptEngine) checkMultiSig() (bool, error) {
+	n, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if n < 0 || n > maxMultiSigKeys {
+		return false, fmt.Errorf("multisig with %d public keys", n)
+	}
+	e.ops += int(n)
+	if e.ops > maxScriptOps {
+		return false, errors.New("too many operations in script")
+	}
+	pubKeys := make([][]byte, n)
+	for i := n - 1; i >= 0; i-- {
+		if pubKeys[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	m, err := e.popNum()
+	if err != nil {
+		return false, err
+	}
+	if m < 0 || m > n {
+		return false, fmt.Errorf("multisig requires %d of %d signatures", m, n)
+	}
+	sigs := make([][]byte, m)
+	for i := m - 1; i >= 0; i-- {
+		if sigs[i], err = e.pop(); err != nil {
+			return false, err
+		}
+	}
+
+	// 剩下的签名不能多于剩下的公钥
+	k := 0
+	for _, sig := range sigs {
+		for k < len(pubKeys) && !e.checkSig(sig, pubKeys[k]) {
+			k++
+		}
+		if k == len(pubKeys) {
+			return false, nil
+		}
+		k++
+	}
+	return true, nil
+}
+
+// 公钥是x与y坐标直接拼接的，坐标前面的零字节被省略，长度不足64字节时逐个尝试分割位置
+func parsePubKey(data []byte) (*ecdsa.PublicKey, error) {
+	curve := elliptic.P256()
+	for xLen := 32; xLen >= 1; xLen-- {
+		yLen := len(data) - xLen
+		if yLen < 1 || yLen > 32 {
+			continue
+		}
+		x := new(big.Int).SetBytes(data[:xLen])
+		y := new(big.Int).SetBytes(data[xLen:])
+		if curve.IsOnCurve(x, y) {
+			return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+		}
+	}
+	return nil, fmt.Errorf("invalid public key %x", data)
+}
+
+// 验证输入的解锁脚本能否解锁它引用的输出的锁定脚本
+func VerifyScript(scriptSig, scriptPubKey []byte, tx *Transation, inputIndex int) error {
+	// 解锁脚本只能压入数据，否则第三方可以在不影响签名的情况下改写它
+	if !isPushOnly(scriptSig) {
+		return errors.New("unlocking script is not push only")
+	}
+
+	e := &scriptEngine{tx: tx, inputIndex: inputIndex, subscript: scriptPubKey}
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	if err := e.execute(scriptPubKey); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return errScriptFailed
+	}
+	if extractScriptHash(scriptPubKey) == nil {
+		return nil
+	}
+
+	// 脚本哈希：锁定脚本只检查了解锁脚本最后压入的赎回脚本的哈希，
+	// 再用解锁脚本剩下的数据执行赎回脚本，签名覆盖的是赎回脚本
+	e = &scriptEngine{tx: tx, inputIndex: inputIndex}
+	if err := e.execute(scriptSig); err != nil {
+		return err
+	}
+	redeemScript, err := e.pop()
+	if err != nil {
+		return err
+	}
+	e.subscript = redeemScript
+	if err := e.execute(redeemScript); err != nil {
+		return err
+	}
+	if len(e.stack) == 0 || !castToBool(e.stack[len(e.stack)-1]) {
+		return errScriptFailed
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func mustAssemble(t *testing.T, asm string) []byte {
+	script, err := AssembleScript(asm)
+	if err != nil {
+		t.Fatalf("%s: %s", asm, err)
+	}
+	return script
+}
+
+func TestVerifyScript(t *testing.T) {
+	large := NewScriptBuilder().AddData(make([]byte, maxScriptElementSize+1)).Script()
+	tests := []struct {
+		name      string
+		scriptSig string
+		scriptPub string
+		raw       []byte // 不为空时代替scriptPub，用于汇编无法表示的脚本
+		err       string // 为空时脚本有效
+	}{
+		{"true", "OP_1", "", nil, ""},
+		{"arithmetic", "OP_2 OP_3", "OP_ADD OP_5 OP_EQUAL", nil, ""},
+		{"wrong sum", "OP_2 OP_3", "OP_ADD OP_6 OP_EQUAL", nil, "evaluated to false"},
+		{"within", "OP_5 OP_1 OP_10", "OP_WITHIN", nil, ""},
+		{"if branch", "OP_1", "OP_IF OP_2 OP_ELSE OP_0 OP_ENDIF", nil, ""},
+		{"else branch", "OP_0", "OP_IF OP_1 OP_ELSE OP_0 OP_ENDIF", nil, "evaluated to false"},
+		{"unbalanced if", "OP_1", "OP_IF OP_1", nil, "without OP_ENDIF"},
+		{"else without if", "OP_1", "OP_ELSE", nil, "without OP_IF"},
+		{"sha256 preimage", "616263", "OP_SHA256 ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad OP_EQUAL", nil, ""},
+		{"wrong preimage", "616264", "OP_SHA256 ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad OP_EQUAL", nil, "evaluated to false"},
+		{"negative zero is false", "80", "", nil, "evaluated to false"},
+		{"empty stack", "", "OP_DROP", nil, "empty stack"},
+		{"OP_RETURN", "OP_1", "OP_RETURN", nil, "OP_RETURN"},
+		{"non-minimal number", "0100", "OP_1ADD", nil, "minimally encoded"},
+		{"number too long", "0102030405", "OP_1ADD", nil, "too long"},
+		{"verify fails", "OP_0", "OP_VERIFY OP_1", nil, "evaluated to false"},
+		{"unlocking script not push only", "OP_1 OP_DUP", "OP_EQUAL", nil, "push only"},
+		{"unknown opcode", "OP_1", "", []byte{0xff}, "unknown opcode"},
+		{"truncated push", "OP_1", "", []byte{OP_PUSHDATA1}, "truncated"},
+		{"push past end", "OP_1", "", []byte{0x05, 0x01}, "past end"},
+		{"element too large", "OP_1", "", large, "too large"},
+		{"too many operations", "OP_1", "", bytes.Repeat([]byte{OP_NOP}, maxScriptOps+1), "too many operations"},
+	}
+	tx := &Transation{Vin: []TXInput{{make([]byte, 32), 0, nil, 0}}}
+	for _, test := range tests {
+		scriptPub := test.raw
+		if scriptPub == nil {
+			scriptPub = mustAssemble(t, test.scriptPub)
+		}
+		err := VerifyScript(mustAssemble(t, test.scriptSig), scriptPub, tx, 0)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
+
+func TestVerifyScriptSignatures(t *testing.T) {
+	keys := []*Wallet{NewWallet(), NewWallet(), NewWallet()}
+	other := NewWallet()
+	redeemScript, err := multiSigScript(2, [][]byte{keys[0].PublicKey, keys[1].PublicKey, keys[2].PublicKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// 多重签名脚本中的公钥是排序过的，签名要按同样的顺序排列
+	_, sorted, _ := extractMultiSig(redeemScript)
+	signers := make([]*Wallet, len(sorted))
+	for i, pubKey := range sorted {
+		for _, w := range keys {
+			if bytes.Equal(w.PublicKey, pubKey) {
+				signers[i] = w
+			}
+		}
+	}
+
+	tx := &Transation{Vin: []TXInput{{make([]byte, 32), 0, nil, 0}}, Vout: []TXOutput{*NewTXOutput(10, string(other.GetAddress()))}}
+	p2pkh := payToPubkeyHashScript(HashPubKey(keys[0].PublicKey))
+	p2sh := payToScriptHashScript(HashPubKey(redeemScript))
+	p2pkhSig := tx.signatureFor(0, p2pkh, keys[0].PrivateKey, SIGHASH_ALL)
+	multiSig := func(ws ...*Wallet) []byte {
+		var sigs [][]byte
+		for _, w := range ws {
+			sigs = append(sigs, tx.signatureFor(0, redeemScript, w.PrivateKey, SIGHASH_ALL))
+		}
+		return payToScriptHashSigScript(multiSigSigScript(sigs), redeemScript)
+	}
+	otherRedeem, _ := multiSigScript(1, [][]byte{other.PublicKey})
+
+	tests := []struct {
+		name      string
+		scriptSig []byte
+		scriptPub []byte
+		err       string // 为空时脚本有效
+	}{
+		{"p2pkh", payToPubkeyHashSigScript(p2pkhSig, keys[0].PublicKey), p2pkh, ""},
+		{"p2pkh wrong key", payToPubkeyHashSigScript(p2pkhSig, other.PublicKey), p2pkh, "evaluated to false"},
+		{"p2pkh signature for another script", payToPubkeyHashSigScript(tx.signatureFor(0, p2sh, keys[0].PrivateKey, SIGHASH_ALL), keys[0].PublicKey), p2pkh, "evaluated to false"},
+		{"p2sh 2-of-3", multiSig(signers[0], signers[2]), p2sh, ""},
+		{"p2sh 2-of-3 other pair", multiSig(signers[1], signers[2]), p2sh, ""},
+		{"p2sh signatures out of order", multiSig(signers[2], signers[0]), p2sh, "evaluated to false"},
+		{"p2sh same key twice", multiSig(signers[0], signers[0]), p2sh, "evaluated to false"},
+		{"p2sh too few signatures", multiSig(signers[0]), p2sh, "empty stack"},
+		{"p2sh signature by outsider", multiSig(signers[0], other), p2sh, "evaluated to false"},
+		{"p2sh wrong redeem script", payToScriptHashSigScript(multiSigSigScript(nil), otherRedeem), p2sh, "evaluated to false"},
+		{"bare multisig", multiSigSigScript([][]byte{tx.signatureFor(0, redeemScript, signers[0].PrivateKey, SIGHASH_ALL), tx.signatureFor(0, redeemScript, signers[1].PrivateKey, SIGHASH_ALL)}), redeemScript, ""},
+	}
+	for _, test := range tests {
+		err := VerifyScript(test.scriptSig, test.scriptPub, tx, 0)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -0,0 +1,362 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/gob"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// 节点之间的加密方式
+const (
+	secureOff     = "off"     // 只使用明文
+	securePrefer  = "prefer"  // 优先使用TLS，对方不支持时退回明文
+	secureRequire = "require" // 只接受TLS连接
+)
+
+const tlsRecordHandshake = 0x16 // TLS握手记录的第一个字节，明文消息以指令的ASCII字符开头
+
+const handshakeTimeout = 5 * time.Second
+
+// 节点身份密钥与已固定的节点公钥的存储位置
+func nodeKeyFile(nodeID string) string {
+	return fmt.Sprintf("node_%s.key", nodeID)
+}
+
+func peerPinFile(nodeID string) string {
+	return fmt.Sprintf("peers_%s.dat", nodeID)
+}
+
+// 读取节点的身份密钥，不存在时生成一个新的
+func loadNodeKey(file string) (*ecdsa.PrivateKey, error) {
+	if data, err := ioutil.ReadFile(file); err == nil {
+		block, _ := pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("%s is not a PEM file", file)
+		}
+		return x509.ParseECPrivateKey(block.Bytes)
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return nil, err
+	}
+	data := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der})
+	return key, ioutil.WriteFile(file, data, 0600)
+}
+
+// 用身份密钥生成自签名证书。证书每次启动都重新生成，对方固定的是其中的公钥
+func selfSignedCert(key *ecdsa.PrivateKey, address string) (tls.Certificate, error) {
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: address},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(10 * 365 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
+
+// 证书公钥的指纹
+func certFingerprint(cert *x509.Certificate) []byte {
+	hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return hash[:]
+}
+
+// 已固定的节点公钥，第一次连接时记录，之后公钥变化的连接都会被拒绝
+type peerPins struct {
+	mu   sync.Mutex
+	file string
+	Pins map[string][]byte // 键-节点地址 值-公钥指纹
+}
+
+var errPinMismatch = errors.New("peer identity does not match pinned key")
+
+func loadPeerPins(file string) (*peerPins, error) {
+	pins := &peerPins{file: file, Pins: make(map[string][]byte)}
+
+	data, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return pins, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = gob.NewDecoder(bytes.NewReader(data)).Decode(pins)
+	return pins, err
+}
+
+func (p *peerPins) has(addr string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.Pins[addr] != nil
+}
+
+// 检查addr的公钥指纹，第一次见到时固定下来。只能在主动连接addr时调用：
+// 这时对方确实在addr上监听，而接收到的连接中对方声称的地址是可以伪造的
+func (p *peerPins) pin(addr string, fingerprint []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pinned := p.Pins[addr]
+	if pinned != nil {
+		if bytes.Compare(pinned, fingerprint) != 0 {
+			return errPinMismatch
+		}
+		return nil
+	}
+
+	p.Pins[addr] = fingerprint
+	fmt.Printf("pinned identity of %s: %x\n", addr, fingerprint)
+
+	var content bytes.Buffer
+	err := gob.NewEncoder(&content).Encode(p)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(p.file, content.Bytes(), 0600)
+}
+
+// 检查addr的公钥指纹是否与固定的一致，addr还没有固定时不做记录
+func (p *peerPins) check(addr string, fingerprint []byte) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	pinned := p.Pins[addr]
+	if pinned != nil && bytes.Compare(pinned, fingerprint) != 0 {
+		return errPinMismatch
+	}
+	return nil
+}
+
+// 在其他传输层之上加一层TLS。双方都出示自签名证书，身份由固定的公钥确认
+type secureTransport struct {
+	inner Transport
+	mode  string
+	cert  tls.Certificate
+	pins  *peerPins
+}
+
+func newSecureTransport(inner Transport, mode, address, nodeID string) (*secureTransport, error) {
+	key, err := loadNodeKey(nodeKeyFile(nodeID))
+	if err != nil {
+		return nil, err
+	}
+	cert, err := selfSignedCert(key, address)
+	if err != nil {
+		return nil, err
+	}
+	pins, err := loadPeerPins(peerPinFile(nodeID))
+	if err != nil {
+		return nil, err
+	}
+	return &secureTransport{inner, mode, cert, pins}, nil
+}
+
+func (t *secureTransport) Listen(addr string) (net.Listener, error) {
+	ln, err := t.inner.Listen(addr)
+	if err != nil {
+		return nil, err
+	}
+	return &secureListener{ln, t}, nil
+}
+
+// 先尝试TLS握手；mode为prefer且对方从未以TLS连接过时，握手失败退回明文
+func (t *secureTransport) Dial(addr string) (net.Conn, error) {
+	conn, err := t.inner.Dial(addr)
+	if err != nil || t.mode == secureOff {
+		return conn, err
+	}
+
+	tc := tls.Client(conn, t.clientConfig(addr))
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	err = tc.Handshake()
+	if err == nil {
+		conn.SetDeadline(time.Time{})
+		return tc, nil
+	}
+	tc.Close()
+
+	if t.mode == secureRequire || t.pins.has(addr) {
+		return nil, err
+	}
+	fmt.Printf("%s does not support TLS, falling back to plaintext\n", addr)
+	return t.inner.Dial(addr)
+}
+
+func (t *secureTransport) clientConfig(addr string) *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		MinVersion:   tls.VersionTLS13,
+		// 证书是自签名的，不走CA校验，而是与固定的公钥比较
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(raw [][]byte, _ [][]*x509.Certificate) error {
+			cert, err := x509.ParseCertificate(raw[0])
+			if err != nil {
+				return err
+			}
+			return t.pins.pin(addr, certFingerprint(cert))
+		},
+	}
+}
+
+func (t *secureTransport) serverConfig() *tls.Config {
+	return &tls.Config{
+		Certificates: []tls.Certificate{t.cert},
+		MinVersion:   tls.VersionTLS13,
+		ClientAuth:   tls.RequireAnyClientCert,
+	}
+}
+
+type secureListener struct {
+	net.Listener
+	t *secureTransport
+}
+
+func (l *secureListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &sniffConn{Conn: conn, t: l.t}, nil
+}
+
+// 在第一次读写时根据第一个字节判断对方使用TLS还是明文
+type sniffConn struct {
+	net.Conn
+	t     *secureTransport
+	once  sync.Once
+	inner net.Conn // 协商后的连接，*tls.Conn或者明文连接
+	err   error
+
+	readDeadline time.Time // 调用方设置的读取期限，握手结束后恢复
+}
+
+func (c *sniffConn) SetReadDeadline(t time.Time) error {
+	c.readDeadline = t
+	return c.Conn.SetReadDeadline(t)
+}
+
+func (c *sniffConn) negotiate() {
+	c.Conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	var first [1]byte
+	_, err := io.ReadFull(c.Conn, first[:])
+	if err != nil {
+		c.err = err
+		return
+	}
+	prefixed := &prefixConn{c.Conn, io.MultiReader(bytes.NewReader(first[:]), c.Conn)}
+
+	if first[0] == tlsRecordHandshake && c.t.mode != secureOff {
+		tc := tls.Server(prefixed, c.t.serverConfig())
+		if err := tc.Handshake(); err != nil {
+			c.err = err
+			return
+		}
+		c.Conn.SetDeadline(time.Time{})
+		c.Conn.SetReadDeadline(c.readDeadline)
+		c.inner = tc
+		return
+	}
+	if c.t.mode == secureRequire {
+		c.err = errors.New("plaintext connection refused")
+		return
+	}
+	c.Conn.SetDeadline(time.Time{})
+	c.Conn.SetReadDeadline(c.readDeadline)
+	c.inner = prefixed
+}
+
+func (c *sniffConn) Read(b []byte) (int, error) {
+	c.once.Do(c.negotiate)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.inner.Read(b)
+}
+
+func (c *sniffConn) Write(b []byte) (int, error) {
+	c.once.Do(c.negotiate)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.inner.Write(b)
+}
+
+func (c *sniffConn) Close() error {
+	if tc, ok := c.inner.(*tls.Conn); ok {
+		return tc.Close()
+	}
+	return c.Conn.Close()
+}
+
+// 确认对方的身份与它在消息中声称的节点地址一致。固定公钥的节点只能通过TLS连接发来消息，
+// 否则任何人都可以用明文冒充它；还没有固定的地址不在这里固定，要等主动连接它时再固定
+func (c *sniffConn) verifyPeer(addr string) error {
+	tc, ok := c.inner.(*tls.Conn)
+	if !ok {
+		if c.t.mode != secureOff && c.t.pins.has(addr) {
+			return errors.New("plaintext connection from pinned peer refused")
+		}
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return errors.New("peer presented no certificate")
+	}
+	return c.t.pins.check(addr, certFingerprint(certs[0]))
+}
+
+// 连接对方的TLS证书公钥的指纹，明文连接返回nil
+func tlsFingerprint(conn net.Conn) []byte {
+	if sc, ok := conn.(*sniffConn); ok {
+		conn = sc.inner
+	}
+	tc, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	certs := tc.ConnectionState().PeerCertificates
+	if len(certs) == 0 {
+		return nil
+	}
+	return certFingerprint(certs[0])
+}
+
+// 读取时先返回已经读出的字节
+type prefixConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *prefixConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
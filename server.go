@@ -3,10 +3,13 @@ package main
 import (
 	"bytes"
 	"encoding/gob"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
+	"sync"
+	"time"
 )
 
 // 我们的实例中，用端口号的不同来区分节点
@@ -15,6 +18,8 @@ type Version struct {
 	Version    int    // 版本号
 	BestHeight int32  // 区块最高的高度
 	AddrFrom   string // 发送者地址
+	Compact    bool   // 是否希望以紧凑区块的形式接收新区块
+	Light      bool   // 是否为只同步区块头的轻节点
 }
 
 type inv struct {
@@ -34,15 +39,132 @@ type blocksend struct {
 	Block    []byte
 }
 
+type txsend struct {
+	AddrFrom   string
+	Transation []byte
+}
+
+type getheaders struct {
+	AddrFrom string
+	Locator  [][]byte // 请求方的区块定位器
+	HashStop []byte   // 为空时表示尽可能多地返回
+}
+
+type headers struct {
+	AddrFrom string
+	Headers  [][]byte // 序列化的区块头
+}
+
 const commandLength = 12
 
-const nodeVersion = 0x00
+const nodeVersion = 0x01
+
+const maxHeadersPerMsg = 2000 // 每条headers消息最多携带的区块头数量
+
+const maxLocatorSize = 101 // 区块定位器最多包含的哈希数量
+
+const maxBlockTransations = 10000 // 单个区块最多包含的交易数量
+
+const minMempoolTxs = 2 // 交易池中的交易达到该数量时矿工开始挖矿
+
+const maxBlocksInFlightPerPeer = 16 // 每个节点同时下载的区块数量上限
+
+const blockDownloadWindow = 1024 // 只下载已验证区块头链中最前面的这些区块
+
+const blockStallTimeout = 30 * time.Second // 超过这个时间还没收到的区块会交给其他节点下载
+
+const maxMessageSize = 32 << 20 // 单条消息的最大字节数
+
+const messageReadTimeout = time.Minute // 读取一条消息的最长时间，防止对方占住连接
+
+// 正在下载的区块
+type blockRequest struct {
+	peer string
+	time time.Time
+}
+
+// 区块头优先同步的状态
+type syncState struct {
+	mu          sync.Mutex
+	headerChain []*BlockHeader          // 最佳链上已验证但区块体尚未连接的区块头，按高度升序
+	headerIndex map[string]*BlockHeader // 键-区块哈希 值-已验证但区块体尚未连接的区块头，包括分叉上的
+	inFlight    map[string]blockRequest // 键-区块哈希 值-下载请求
+	received    map[string]*Block       // 已下载但还不能按顺序连接的区块
+	peerHeights map[string]int32        // 键-节点地址 值-该节点声明的最高高度
+}
+
+func newSyncState() *syncState {
+	return &syncState{
+		headerIndex: make(map[string]*BlockHeader),
+		inFlight:    make(map[string]blockRequest),
+		received:    make(map[string]*Block),
+		peerHeights: make(map[string]int32),
+	}
+}
+
+var defaultSeeds = []string{"localhost:3000"} // 新节点启动时连接的节点
+
+// 一个P2P节点，保存节点运行所需的全部状态，同一个进程中可以运行多个节点
+type Server struct {
+	address      string // 存储本区块运行的网络地址
+	minerAddress string // 矿工地址，为空时不挖矿
+	bc           *Blockchain
+	transport    Transport
+	banFile      string
+	bansOnce     sync.Once
+	bans         *BanList
+	listener     net.Listener
+
+	nodesMu    sync.Mutex
+	knownNodes []string        // 存储已经探测到的网络
+	lightPeers map[string]bool // 轻节点，只向它们发送区块通知，也不从它们下载区块
+
+	mempoolMu    sync.Mutex
+	mempool      map[string]*Transation // 交易池，键-交易id 值-尚未打包的交易
+	mempoolSpent map[string]string      // 键-交易池中的交易花费的输出（交易id:索引） 值-花费它的交易id
 
-var blockInTranit [][]byte
+	chainSync *syncState
 
-var knownNodes = []string{"localhost:3000"} // 存储已经探测到的网络
+	compact       bool // 是否使用紧凑区块广播新区块
+	compactMu     sync.Mutex
+	compactPeers  map[string]bool          // 声明支持紧凑区块的节点
+	partialBlocks map[string]*partialBlock // 键-区块哈希 值-等待缺失交易的区块
+
+	scoresMu sync.Mutex
+	scores   map[string]int // 键-节点地址 值-累计的不良行为分数
+
+	filtersMu sync.Mutex
+	filters   map[string]*BloomFilter // 键-轻节点的身份（见peerKey） 值-它加载的布隆过滤器
+
+	walletMu   sync.Mutex
+	walletTxs  *WalletTxSet // 启动时钱包中地址的交易集合，没有钱包时为nil
+	wallet     *Wallets     // 启动时读取的钱包，没有钱包时为nil
+	walletLock *time.Timer  // 解锁到期时锁定钱包
+
+	control     net.Listener // 本机的控制端口
+	controlFile string       // 控制端口的cookie文件
+}
 
-var nodeAddress string // 存储本区块运行的网络地址
+// 创建节点，seeds是启动时连接的节点
+func NewServer(address, minerAddress string, bc *Blockchain, transport Transport, seeds []string) *Server {
+	return &Server{
+		address:       address,
+		minerAddress:  minerAddress,
+		bc:            bc,
+		transport:     transport,
+		banFile:       banFile,
+		knownNodes:    append([]string{}, seeds...),
+		lightPeers:    make(map[string]bool),
+		mempool:       make(map[string]*Transation),
+		mempoolSpent:  make(map[string]string),
+		chainSync:     newSyncState(),
+		compact:       true,
+		compactPeers:  make(map[string]bool),
+		partialBlocks: make(map[string]*partialBlock),
+		scores:        make(map[string]int),
+		filters:       make(map[string]*BloomFilter),
+	}
+}
 
 func (ver *Version) String() {
 	fmt.Println("Version:", ver.Version)
@@ -50,46 +172,143 @@ func (ver *Version) String() {
 	fmt.Println("AddrFrom:", ver.AddrFrom)
 }
 
-// 开启服务器，nodeID代表port，minerAddress 代表矿工地址
-func startServer(nodeID, minerAddress string, bc *Blockchain) {
-	nodeAddress = fmt.Sprintf("localhost:%s", nodeID) // 构建当前节点地址
-	ln, err := net.Listen("tcp", nodeAddress)
+// 开启服务器，nodeID代表port，minerAddress 代表矿工地址，secure 代表节点之间的加密方式
+func startServer(nodeID, minerAddress string, compact bool, secure string, bc *Blockchain) {
+	address := fmt.Sprintf("localhost:%s", nodeID) // 构建当前节点地址
+
+	var transport Transport = tcpTransport{}
+	if secure != secureOff {
+		st, err := newSecureTransport(transport, secure, address, nodeID)
+		checkErr(err)
+		transport = st
+	}
+
+	s := NewServer(address, minerAddress, bc, transport, defaultSeeds)
+	s.compact = compact
+
+	// 钱包锁定时也可以跟踪，地址与公钥是明文保存的。节点启动时钱包总是锁定，
+	// 用walletpassphrase解锁，密钥只保存在节点的内存中
+	if wallets, err := NewWallets(); err == nil {
+		wallets.Lock()
+		s.wallet = wallets
+		txs := wallets.TxSet(bc)
+		s.walletTxs = &txs
+		s.syncWallet()
+	}
+
+	err := s.startControl(nodeID)
 	checkErr(err)
-	defer ln.Close()
+	err = s.Start()
+	checkErr(err)
+}
 
-	//bc := NewBlockchain("1NpxpZkBYd3uYJGMcpzFs6q65WPrr1cDaM")
+// 开始监听并处理连接，直到Stop被调用
+func (s *Server) Start() error {
+	ln, err := s.transport.Listen(s.address)
+	if err != nil {
+		return err
+	}
+	s.nodesMu.Lock()
+	s.listener = ln
+	s.nodesMu.Unlock()
+	defer ln.Close()
 
-	if nodeAddress != knownNodes[0] {
-		sendVersion(knownNodes[0], bc) //向knownNodes[0](已经探测到的网络)发送自己的版本信息Version{}
+	//向已经探测到的网络发送自己的版本信息Version{}
+	for _, node := range s.nodes() {
+		if node != s.address {
+			s.sendVersion(node)
+		}
 	}
 
 	for {
 		conn, err := ln.Accept()
+		if err != nil {
+			return nil
+		}
 
-		checkErr(err)
+		go s.handleConnection(conn)
+	}
+}
 
-		go handleConnection(conn, bc)
+// 停止监听
+func (s *Server) Stop() {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
 
+	if s.listener != nil {
+		s.listener.Close()
 	}
-
+	s.stopControl()
 }
 
 // addr是目标地址
-func sendVersion(addr string, bc *Blockchain) {
-	bestHeight := bc.GetBestHeight()
+func (s *Server) sendVersion(addr string) {
+	bestHeight := s.bc.GetBestHeight()
 
-	payload := gobEncode(Version{nodeVersion, bestHeight, nodeAddress})
+	payload := gobEncode(Version{nodeVersion, bestHeight, s.address, s.compact, false})
 
 	request := append(commandToBytes("version"), payload...)
 
-	sendData(addr, request)
+	s.sendData(addr, request)
 
 }
 
-func handleConnection(conn net.Conn, bc *Blockchain) {
-	request, err := ioutil.ReadAll(conn)
+// 读取一条消息，限制大小与时间
+func readMessage(conn net.Conn) ([]byte, error) {
+	conn.SetReadDeadline(time.Now().Add(messageReadTimeout))
 
-	checkErr(err)
+	request, err := ioutil.ReadAll(io.LimitReader(conn, maxMessageSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(request) > maxMessageSize {
+		return nil, misbehave(scoreOversized, "message larger than %d bytes", maxMessageSize)
+	}
+	return request, nil
+}
+
+func (s *Server) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	request, err := readMessage(conn)
+
+	// 不良行为记在连接确认过的身份上，见peerKey
+	peer := peerKey(conn, messageSender(request, ""))
+	if s.isBanned(peer) {
+		return
+	}
+	if perr, ok := err.(*peerError); ok {
+		s.Misbehaving(peer, perr.score, perr.reason)
+		return
+	}
+	if err != nil {
+		fmt.Printf("read from %s failed: %s\n", conn.RemoteAddr(), err)
+		return
+	}
+	// 对方连接后什么也没有发送
+	if len(request) == 0 {
+		return
+	}
+
+	if ac, ok := conn.(authenticatedConn); ok {
+		from := messageSender(request, conn.RemoteAddr().String())
+		if err := ac.verifyPeer(from); err != nil {
+			fmt.Printf("reject message from %s: %s\n", from, err)
+			return
+		}
+	}
+
+	if len(request) < commandLength {
+		s.Misbehaving(peer, scoreMalformed, "message too short")
+		return
+	}
+
+	// 任何由对方数据引起的panic都不能让节点崩溃
+	defer func() {
+		if r := recover(); r != nil {
+			s.Misbehaving(peer, scoreMalformed, fmt.Sprint(r))
+		}
+	}()
 
 	// 获取指令
 	command := bytesToCommand(request[:commandLength])
@@ -97,20 +316,60 @@ func handleConnection(conn net.Conn, bc *Blockchain) {
 	switch command {
 	case "version":
 		fmt.Printf("\nstr:获取version\n")
-		handleVersion(request, bc)
+		err = s.handleVersion(request)
 
-	case "getblocks":
-		handleGetBlock(request, bc)
+	case "getheaders":
+		err = s.handleGetHeaders(request)
+	case "headers":
+		err = s.handleHeaders(request)
 	case "inv":
-		handleInv(request, bc)
+		err = s.handleInv(request)
 	case "getdata":
-		handleGetData(request, bc)
+		err = s.handleGetData(request)
 	case "block":
-		handleBlock(request, bc)
+		err = s.handleBlock(request)
+	case "tx":
+		err = s.handleTx(request)
+	case "cmpctblock":
+		err = s.handleCmpctBlock(request, peer)
+	case "getblocktxn":
+		err = s.handleGetBlockTxn(request)
+	case "blocktxn":
+		err = s.handleBlockTxn(request, peer)
+	case "getmerkle":
+		err = s.handleGetMerkle(request, peer)
+	case "filterload":
+		err = s.handleFilterLoad(request, peer)
+	case "filteradd":
+		err = s.handleFilterAdd(request, peer)
+	case "filterclear":
+		err = s.handleFilterClear(request, peer)
+	default:
+		err = misbehave(scoreUnknownCmd, "unknown command %q", command)
+	}
+
+	if perr, ok := err.(*peerError); ok && perr != nil {
+		s.Misbehaving(peer, perr.score, perr.reason)
+	} else if err != nil {
+		fmt.Printf("handle %s from %s failed: %s\n", command, messageSender(request, peer), err)
 	}
 }
 
-func handleVersion(request []byte, bc *Blockchain) {
+// 从消息中取出发送者的地址，所有消息体都带有AddrFrom字段
+func messageSender(request []byte, remote string) string {
+	var payload struct{ AddrFrom string }
+
+	if len(request) < commandLength {
+		return remote
+	}
+	dec := gob.NewDecoder(bytes.NewReader(request[commandLength:]))
+	if err := dec.Decode(&payload); err != nil || payload.AddrFrom == "" {
+		return remote
+	}
+	return payload.AddrFrom
+}
+
+func (s *Server) handleVersion(request []byte) error {
 	var buff bytes.Buffer
 	var payload Version
 	buff.Write(request[commandLength:])
@@ -118,30 +377,77 @@ func handleVersion(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 
 	err := dec.Decode(&payload)
-	checkErr(err)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed version: %s", err)
+	}
 	payload.String()
-	myBestHeight := bc.GetBestHeight()      // 本区块的高度
+	myBestHeight := s.bc.GetBestHeight()    // 本区块的高度
 	foreignBestHeight := payload.BestHeight // 外部节点传递的进来的区块高度
 
+	if payload.Light {
+		s.nodesMu.Lock()
+		s.lightPeers[payload.AddrFrom] = true
+		s.nodesMu.Unlock()
+	} else {
+		s.chainSync.setPeerHeight(payload.AddrFrom, foreignBestHeight)
+	}
+	s.setCompactPeer(payload.AddrFrom, payload.Compact)
+
+	known := s.nodeIsKnow(payload.AddrFrom)
+	if !known {
+		s.addNode(payload.AddrFrom)
+	}
+
 	if myBestHeight < foreignBestHeight {
 
-		sendGetBlock(payload.AddrFrom) // 向外部节点发送获取区块请求
+		s.sendGetHeaders(payload.AddrFrom, s.chainSync.locator(s.bc)) // 先向外部节点请求区块头
 
-	} else {
+	} else if !known {
+
+		// 只回复第一次见到的节点，避免双方高度相同时无休止地互发version
+		s.sendVersion(payload.AddrFrom)
+
+	}
+	return nil
+}
+
+func (s *Server) handleGetHeaders(request []byte) error {
+	var buff bytes.Buffer
+	var payload getheaders
+
+	buff.Write(request[commandLength:])
 
-		sendVersion(payload.AddrFrom, bc)
+	dec := gob.NewDecoder(&buff)
+
+	err := dec.Decode(&payload)
 
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed getheaders: %s", err)
 	}
 
-	if !nodeIsKnow(payload.AddrFrom) {
-		knownNodes = append(knownNodes, payload.AddrFrom)
+	if len(payload.Locator) > maxLocatorSize {
+		return misbehave(scoreOversized, "locator with %d hashes", len(payload.Locator))
 	}
 
+	hs := s.bc.GetHeadersAfter(payload.Locator, payload.HashStop, maxHeadersPerMsg)
+	s.sendHeaders(payload.AddrFrom, hs)
+	return nil
 }
 
-func handleGetBlock(request []byte, bc *Blockchain) {
+func (s *Server) sendHeaders(addr string, hs []*BlockHeader) {
+	var data [][]byte
+	for _, h := range hs {
+		data = append(data, h.Serialize())
+	}
+	payload := gobEncode(headers{s.address, data})
+	request := append(commandToBytes("headers"), payload...)
+
+	s.sendData(addr, request)
+}
+
+func (s *Server) handleHeaders(request []byte) error {
 	var buff bytes.Buffer
-	var payload getblocks
+	var payload headers
 
 	buff.Write(request[commandLength:])
 
@@ -149,21 +455,270 @@ func handleGetBlock(request []byte, bc *Blockchain) {
 
 	err := dec.Decode(&payload)
 
-	checkErr(err)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed headers: %s", err)
+	}
 
-	block := bc.getblockhash()
-	sendInv(payload.Addrfrom, "block", block)
+	fmt.Printf("Recieve %d headers\n", len(payload.Headers))
+
+	if len(payload.Headers) == 0 {
+		return nil
+	}
+	if len(payload.Headers) > maxHeadersPerMsg {
+		return misbehave(scoreOversized, "headers message with %d headers", len(payload.Headers))
+	}
+
+	var hs []*BlockHeader
+	for _, data := range payload.Headers {
+		h, err := ParseHeader(data)
+		if err != nil {
+			return misbehave(scoreMalformed, "headers message: %s", err)
+		}
+		hs = append(hs, h)
+	}
+
+	if perr := s.chainSync.addHeaders(s.bc, hs); perr != nil {
+		return perr
+	}
+	s.chainSync.setPeerHeight(payload.AddrFrom, hs[len(hs)-1].Height)
+
+	// 对方的区块头可能还没有发完，从收到的最后一个区块头继续请求，对方在分叉上时也能接着同步
+	if len(payload.Headers) == maxHeadersPerMsg {
+		s.sendGetHeaders(payload.AddrFrom, s.chainSync.locatorFrom(s.bc, hs[len(hs)-1].Hash))
+	}
+
+	s.requestBlocks()
+	return nil
+}
+
+func (s *Server) sendGetHeaders(addr string, locator [][]byte) {
+	payload := gobEncode(getheaders{s.address, locator, nil})
+
+	request := append(commandToBytes("getheaders"), payload...)
+
+	s.sendData(addr, request)
+}
+
+// 记录节点声明的高度，下载区块时只向高度足够的节点请求
+func (cs *syncState) setPeerHeight(addr string, height int32) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	if height > cs.peerHeights[addr] {
+		cs.peerHeights[addr] = height
+	}
+}
+
+// 当前已知的最佳链的区块定位器，包含尚未下载区块体的区块头
+func (cs *syncState) locator(bc *Blockchain) [][]byte {
+	cs.mu.Lock()
+	tip := bc.Tip()
+	if n := len(cs.headerChain); n > 0 {
+		tip = cs.headerChain[n-1].Hash
+	}
+	cs.mu.Unlock()
+
+	return cs.locatorFrom(bc, tip)
+}
+
+// 从tip开始的区块定位器，tip可以是尚未下载区块体的区块头，也可以在分叉上
+func (cs *syncState) locatorFrom(bc *Blockchain, tip []byte) [][]byte {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	var chain [][]byte
+	hash := tip
+	for h := cs.headerIndex[hex.EncodeToString(hash)]; h != nil; h = cs.headerIndex[hex.EncodeToString(hash)] {
+		chain = append(chain, h.Hash)
+		hash = h.PrevBlockHash
+	}
+	chain = append(chain, bc.getblockhashFrom(hash)...)
+
+	return buildLocator(chain)
+}
+
+// 验证区块头的工作量证明与连接关系，通过后记录下来。
+// 区块头可以连接到任何已知的区块头，对方在分叉上不算不良行为；分叉比当前的最佳链高时切换到分叉，
+// 只有连接不到任何已知区块头时才记为不良行为
+func (cs *syncState) addHeaders(bc *Blockchain, hs []*BlockHeader) *peerError {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	for _, h := range hs {
+		if h == nil {
+			return misbehave(scoreMalformed, "empty header")
+		}
+		// 区块头中没有高度，已知的区块头沿用记录的高度，新的区块头由前一个区块头推出
+		if known := cs.headerIndex[hex.EncodeToString(h.Hash)]; known != nil {
+			h.Height = known.Height
+			continue
+		}
+		if known, err := bc.GetHeader(h.Hash); err == nil {
+			h.Height = known.Height
+			continue
+		}
+
+		var prevHeight int32
+		if prev := cs.headerIndex[hex.EncodeToString(h.PrevBlockHash)]; prev != nil {
+			prevHeight = prev.Height
+		} else if prev, err := bc.GetHeader(h.PrevBlockHash); err == nil {
+			prevHeight = prev.Height
+		} else {
+			return misbehave(scoreUnconnected, "header %x has unknown parent %x", h.Hash, h.PrevBlockHash)
+		}
+
+		h.Height = prevHeight + 1
+		if !h.Validate() {
+			return misbehave(scoreInvalidHeader, "header %x has invalid proof of work", h.Hash)
+		}
+		cs.headerIndex[hex.EncodeToString(h.Hash)] = h
+
+		n := len(cs.headerChain)
+		if n > 0 && bytes.Equal(cs.headerChain[n-1].Hash, h.PrevBlockHash) {
+			cs.headerChain = append(cs.headerChain, h)
+		} else if (n > 0 && h.Height > cs.headerChain[n-1].Height) || (n == 0 && h.Height > bc.GetBestHeight()) {
+			cs.switchHeaderChain(h)
+		}
+	}
+	return nil
+}
+
+// 把待下载的区块头链换成以tip结尾的分叉，分叉从本地已有的区块开始
+func (cs *syncState) switchHeaderChain(tip *BlockHeader) {
+	var chain []*BlockHeader
+	for h := tip; h != nil; h = cs.headerIndex[hex.EncodeToString(h.PrevBlockHash)] {
+		chain = append([]*BlockHeader{h}, chain...)
+	}
+	fmt.Printf("switching header chain to fork %x at height %d\n", tip.Hash, tip.Height)
+	cs.headerChain = chain
+}
+
+// 把下载窗口内还没有请求的区块分配给各个节点并行下载
+func (s *Server) requestBlocks() {
+	cs := s.chainSync
+
+	requests := make(map[string][][]byte) // 键-节点地址 值-要向它请求的区块哈希
+
+	cs.mu.Lock()
+	load := make(map[string]int) // 键-节点地址 值-正在从它下载的区块数量
+	for hash, req := range cs.inFlight {
+		// 下载超时的区块重新分配
+		if time.Since(req.time) > blockStallTimeout {
+			delete(cs.inFlight, hash)
+			continue
+		}
+		load[req.peer]++
+	}
+
+	for i, h := range cs.headerChain {
+		if i >= blockDownloadWindow {
+			break
+		}
+		hash := hex.EncodeToString(h.Hash)
+		if _, ok := cs.inFlight[hash]; ok || cs.received[hash] != nil {
+			continue
+		}
+
+		// 选择高度足够且负载最小的节点
+		peer := ""
+		for addr, height := range cs.peerHeights {
+			if height < h.Height || load[addr] >= maxBlocksInFlightPerPeer {
+				continue
+			}
+			if peer == "" || load[addr] < load[peer] {
+				peer = addr
+			}
+		}
+		if peer == "" {
+			break
+		}
+
+		load[peer]++
+		cs.inFlight[hash] = blockRequest{peer, time.Now()}
+		requests[peer] = append(requests[peer], h.Hash)
+	}
+	cs.mu.Unlock()
+
+	failed := false
+	for peer, hashes := range requests {
+		for _, hash := range hashes {
+			if s.sendGetData(peer, "block", hash) != nil {
+				cs.dropPeer(peer)
+				failed = true
+				break
+			}
+		}
+	}
+
+	// 不可用节点的区块已经释放，交给其他节点
+	if failed {
+		s.requestBlocks()
+	}
 }
 
-func sendInv(addr string, kind string, items [][]byte) {
-	inventory := inv{nodeAddress, kind, items}
+// 节点不可用时，释放分配给它的区块
+func (cs *syncState) dropPeer(addr string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	delete(cs.peerHeights, addr)
+	for hash, req := range cs.inFlight {
+		if req.peer == addr {
+			delete(cs.inFlight, hash)
+		}
+	}
+}
+
+// 接收同步中的区块，按区块头链的顺序连接到本地区块链。
+// 返回值表示该区块是否属于当前的同步过程，以及同步是否已经全部完成
+func (cs *syncState) receiveBlock(bc *Blockchain, block *Block) (bool, bool, *peerError) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+
+	hash := hex.EncodeToString(block.Hash)
+	header := cs.headerIndex[hash]
+	if header == nil {
+		return false, false, nil
+	}
+	delete(cs.inFlight, hash)
+
+	if bytes.Compare(header.Merkleroot, block.Merkleroot) != 0 || !block.ValidateMerkleRoot() {
+		return true, false, misbehave(scoreInvalidBlock, "block %x does not match its header", block.Hash)
+	}
+	block.Height = header.Height
+	cs.received[hash] = block
+
+	for len(cs.headerChain) > 0 {
+		next := hex.EncodeToString(cs.headerChain[0].Hash)
+		b := cs.received[next]
+		if b == nil {
+			break
+		}
+		if err := bc.AddBlock(b); err != nil {
+			// 区块头有效但区块无效，放弃整个同步，之后从其他节点重新同步区块头
+			cs.headerChain = nil
+			cs.headerIndex = make(map[string]*BlockHeader)
+			cs.received = make(map[string]*Block)
+			return true, false, misbehave(scoreInvalidBlock, "block %x: %s", b.Hash, err)
+		}
+
+		delete(cs.received, next)
+		delete(cs.headerIndex, next)
+		cs.headerChain = cs.headerChain[1:]
+	}
+
+	return true, len(cs.headerChain) == 0, nil
+}
+
+func (s *Server) sendInv(addr string, kind string, items [][]byte) {
+	inventory := inv{s.address, kind, items}
 	payload := gobEncode(inventory)
 	request := append(commandToBytes("inv"), payload...)
 
-	sendData(addr, request)
+	s.sendData(addr, request)
 }
 
-func handleInv(request []byte, bc *Blockchain) {
+func (s *Server) handleInv(request []byte) error {
 	var buff bytes.Buffer
 
 	var payload inv
@@ -173,28 +728,37 @@ func handleInv(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 
-	checkErr(err)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed inv: %s", err)
+	}
 
 	fmt.Printf("Recieve inventory %d , %s", len(payload.Items), payload.Type)
 
-	if payload.Type == "block" {
-		blockInTranit = payload.Items // 将外部节点传递进来的所有区块的哈希值存储
-		blockHash := payload.Items[0] // 最近的区块哈希
-		sendGetData(payload.AddrFrom, "block", blockHash)
+	if payload.Type == "tx" {
+		for _, id := range payload.Items {
+			s.mempoolMu.Lock()
+			_, known := s.mempool[hex.EncodeToString(id)]
+			s.mempoolMu.Unlock()
 
-		newInTransit := [][]byte{}
+			if !known {
+				s.sendGetData(payload.AddrFrom, "tx", id)
+			}
+		}
+	}
 
-		// 将最近的区块从blockInTranit中删除
-		for _, b := range blockInTranit {
-			if bytes.Compare(b, blockHash) != 0 {
-				newInTransit = append(newInTransit, b)
+	if payload.Type == "block" {
+		// 只要有未知的区块，就先向对方请求区块头
+		for _, hash := range payload.Items {
+			if !s.bc.HasBlock(hash) {
+				s.sendGetHeaders(payload.AddrFrom, s.chainSync.locator(s.bc))
+				break
 			}
 		}
-		blockInTranit = newInTransit
 	}
+	return nil
 }
 
-func handleBlock(request []byte, bc *Blockchain) {
+func (s *Server) handleBlock(request []byte) error {
 	var buff bytes.Buffer
 
 	var payload blocksend
@@ -204,71 +768,322 @@ func handleBlock(request []byte, bc *Blockchain) {
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
 
-	checkErr(err)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed block: %s", err)
+	}
 
 	blockdata := payload.Block
 
-	block := DeserializeBlock(blockdata)
-	bc.AddBlock(block)
+	block, err := ParseBlock(blockdata)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed block: %s", err)
+	}
 	fmt.Println("Recieve a new Block")
 
-	if len(blockInTranit) > 0 {
-		blockHash := blockInTranit[0]
-		sendGetData(payload.AddrFrom, "block", blockHash)
-		blockInTranit = blockInTranit[1:]
+	if !block.Header().Validate() {
+		return misbehave(scoreInvalidBlock, "block %x has invalid proof of work", block.Hash)
+	}
+
+	syncing, done, perr := s.chainSync.receiveBlock(s.bc, block)
+	if perr != nil {
+		s.requestBlocks()
+		return perr
+	}
+
+	if !syncing {
+		// 不在同步过程中的新区块
+		return s.acceptBlock(block, payload.AddrFrom)
+	}
+
+	if done {
+		set := UTXOSet{s.bc}
+		set.Reindex()
+		s.syncWallet()
+	} else {
+		s.requestBlocks()
+	}
+	return nil
+}
+
+// 接收其他节点广播的新区块：父区块已知时添加到区块链并继续广播，否则先同步区块头
+func (s *Server) acceptBlock(block *Block, from string) error {
+	if s.bc.HasBlock(block.Hash) {
+		return nil
+	}
+
+	if !s.bc.HasBlock(block.PrevBlockHash) {
+		s.sendGetHeaders(from, s.chainSync.locator(s.bc))
+		return nil
+	}
+
+	extendsTip := bytes.Compare(block.PrevBlockHash, s.bc.Tip()) == 0
+
+	if err := s.bc.AddBlock(block); err != nil {
+		return misbehave(scoreInvalidBlock, "block %x: %s", block.Hash, err)
+	}
+
+	set := UTXOSet{s.bc}
+	if extendsTip {
+		set.update(block)
 	} else {
-		set := UTXOSet{bc}
 		set.Reindex()
 	}
+	s.syncWallet()
+
+	s.removeFromMempool(block.Transations)
+	s.announceBlock(block, from)
+	return nil
 }
 
-func handleGetData(request []byte, bc *Blockchain) {
+func (s *Server) handleGetData(request []byte) error {
 	var buff bytes.Buffer
 	var payload getdata
 
-	buff.Write(request[:commandLength])
+	buff.Write(request[commandLength:])
 	dec := gob.NewDecoder(&buff)
 	err := dec.Decode(&payload)
-	checkErr(err)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed getdata: %s", err)
+	}
 	if payload.Type == "block" {
-		block, err := bc.GetBlock([]byte(payload.ID))
-		checkErr(err)
-		sendBlock(payload.AddrFrom, &block)
+		block, err := s.bc.GetBlock([]byte(payload.ID))
+		if err != nil {
+			fmt.Printf("%s requested unknown block %x\n", payload.AddrFrom, payload.ID)
+			return nil
+		}
+		s.sendBlock(payload.AddrFrom, &block)
 	}
+	if payload.Type == "tx" {
+		s.mempoolMu.Lock()
+		tx := s.mempool[hex.EncodeToString(payload.ID)]
+		s.mempoolMu.Unlock()
 
+		if tx != nil {
+			s.sendTx(payload.AddrFrom, tx)
+		}
+	}
+	return nil
 }
 
-func sendBlock(addr string, block *Block) {
-	data := blocksend{nodeAddress, block.Serialize()}
-	payload := gobEncode(data)
-	request := append(commandToBytes("block"), payload...)
+func (s *Server) sendTx(addr string, tx *Transation) {
+	payload := gobEncode(txsend{s.address, tx.Serialize()})
+	request := append(commandToBytes("tx"), payload...)
 
-	sendData(addr, request)
+	s.sendData(addr, request)
 }
 
-func sendGetData(addr string, kind string, id []byte) {
-	payload := gobEncode(getdata{nodeAddress, kind, id})
+// 接收交易，验证后放入交易池并通知其他节点；矿工在交易足够多时挖出新区块
+func (s *Server) handleTx(request []byte) error {
+	var buff bytes.Buffer
+	var payload txsend
 
-	request := append(commandToBytes("getdata"), payload...)
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed tx: %s", err)
+	}
 
-	sendData(addr, request)
+	tx, err := ParseTransation(payload.Transation)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed transation: %s", err)
+	}
+
+	txID := hex.EncodeToString(tx.ID)
+
+	s.mempoolMu.Lock()
+	_, known := s.mempool[txID]
+	s.mempoolMu.Unlock()
+	if known {
+		return nil
+	}
+
+	if tx.IsCoinBase() {
+		return misbehave(scoreInvalidBlock, "relayed coinbase transation %x", tx.ID)
+	}
+	// 引用的输出已经被花费或者还不知道时，可能只是对方的链与本地不同，不算不良行为
+	if err := s.checkUnspent(tx); err != nil {
+		return fmt.Errorf("transation %x: %s", tx.ID, err)
+	}
+	if err := s.bc.VerifyTransation(tx); err != nil {
+		return misbehave(scoreInvalidBlock, "invalid transation %x: %s", tx.ID, err)
+	}
+	if err := tx.checkDataOutputs(); err != nil {
+		return misbehave(scoreInvalidBlock, "invalid transation %x: %s", tx.ID, err)
+	}
+	// 锁定时间还没到的交易不是无效交易，只是暂时不接收
+	if err := s.bc.CheckNextBlockLockTimes(tx); err != nil {
+		return err
+	}
+
+	s.mempoolMu.Lock()
+	if conflict := s.mempoolConflict(tx); conflict != "" {
+		s.mempoolMu.Unlock()
+		return fmt.Errorf("transation %x spends the same output as mempool transation %s", tx.ID, conflict)
+	}
+	s.mempool[txID] = tx
+	for _, vin := range tx.Vin {
+		s.mempoolSpent[outpointKey(vin.TXid, vin.Voutindex)] = txID
+	}
+	size := len(s.mempool)
+	s.mempoolMu.Unlock()
+
+	if s.walletTxs != nil {
+		s.walletMu.Lock()
+		s.walletTxs.AddUnconfirmed(tx)
+		s.walletMu.Unlock()
+	}
+
+	for _, node := range s.nodes() {
+		if node != s.address && node != payload.AddrFrom {
+			s.sendInv(node, "tx", [][]byte{tx.ID})
+		}
+	}
+
+	if s.minerAddress != "" && size >= minMempoolTxs {
+		s.mineMempool()
+	}
+	return nil
 }
 
-type getblocks struct {
-	Addrfrom string
+// 交易池中的所有交易
+func (s *Server) mempoolTransations() []*Transation {
+	s.mempoolMu.Lock()
+	defer s.mempoolMu.Unlock()
+
+	var txs []*Transation
+	for _, tx := range s.mempool {
+		txs = append(txs, tx)
+	}
+	return txs
+}
+
+// 从交易池中删除已经打包的交易，以及与它们花费同一个输出的交易。
+// 被删除的交易在钱包中还没有确认时，从钱包中一起删除
+func (s *Server) removeFromMempool(txs []*Transation) {
+	var dropped [][]byte
+
+	s.mempoolMu.Lock()
+	for _, tx := range txs {
+		dropped = append(dropped, s.dropMempoolTx(hex.EncodeToString(tx.ID))...)
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, vin := range tx.Vin {
+			if conflict, ok := s.mempoolSpent[outpointKey(vin.TXid, vin.Voutindex)]; ok {
+				dropped = append(dropped, s.dropMempoolTx(conflict)...)
+			}
+		}
+	}
+	s.mempoolMu.Unlock()
+
+	if s.walletTxs == nil {
+		return
+	}
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+	for _, id := range dropped {
+		s.walletTxs.RemoveUnconfirmed(id)
+	}
+}
+
+// 返回被删除的交易的id，调用方持有mempoolMu
+func (s *Server) dropMempoolTx(txID string) [][]byte {
+	tx := s.mempool[txID]
+	if tx == nil {
+		return nil
+	}
+	delete(s.mempool, txID)
+	for _, vin := range tx.Vin {
+		delete(s.mempoolSpent, outpointKey(vin.TXid, vin.Voutindex))
+	}
+	return [][]byte{tx.ID}
+}
+
+func outpointKey(txid []byte, index int) string {
+	return fmt.Sprintf("%x:%d", txid, index)
+}
+
+// 交易的所有输入引用的输出都必须在UTXO集合中
+func (s *Server) checkUnspent(tx *Transation) error {
+	set := UTXOSet{s.bc}
+	for i, vin := range tx.Vin {
+		if !set.IsUnspent(vin.TXid, vin.Voutindex) {
+			return fmt.Errorf("input %d: output %x:%d is already spent or unknown", i, vin.TXid, vin.Voutindex)
+		}
+	}
+	return nil
+}
+
+// 交易池中与tx花费同一个输出的交易id，没有时返回空，调用方持有mempoolMu
+func (s *Server) mempoolConflict(tx *Transation) string {
+	for _, vin := range tx.Vin {
+		if other, ok := s.mempoolSpent[outpointKey(vin.TXid, vin.Voutindex)]; ok {
+			return other
+		}
+	}
+	return ""
+}
+
+// 让钱包交易集合跟上当前的主链
+func (s *Server) syncWallet() {
+	if s.walletTxs == nil {
+		return
+	}
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	s.walletTxs.Sync()
+}
+
+// 把交易池中验证通过的交易与coinbase交易一起打包成新区块，并广播给其他节点
+func (s *Server) mineMempool() {
+	var txs []*Transation
+
+	// 交易池中的交易互不冲突，只需要检查引用的输出没有被新的区块花费
+	for _, tx := range s.mempoolTransations() {
+		if s.checkUnspent(tx) != nil || s.bc.VerifyTransation(tx) != nil {
+			s.removeFromMempool([]*Transation{tx})
+		} else if s.bc.CheckNextBlockLockTimes(tx) == nil {
+			txs = append(txs, tx)
+		}
+	}
+	if len(txs) == 0 {
+		return
+	}
+
+	coinbase := NewCoinbaseTX(s.minerAddress, fmt.Sprintf("mined by %s at %d", s.address, time.Now().UnixNano()))
+	txs = append([]*Transation{coinbase}, txs...)
+
+	newBlock := s.bc.MineBlock(txs)
+	set := UTXOSet{s.bc}
+	set.update(newBlock)
+	s.syncWallet()
+	fmt.Printf("mined block %x\n", newBlock.Hash)
+
+	s.removeFromMempool(txs)
+	s.announceBlock(newBlock, "")
+}
+
+func (s *Server) sendBlock(addr string, block *Block) {
+	data := blocksend{s.address, block.Serialize()}
+	payload := gobEncode(data)
+	request := append(commandToBytes("block"), payload...)
+
+	s.sendData(addr, request)
 }
 
-func sendGetBlock(addr string) {
-	payload := gobEncode(getblocks{nodeAddress})
+func (s *Server) sendGetData(addr string, kind string, id []byte) error {
+	payload := gobEncode(getdata{s.address, kind, id})
 
-	request := append(commandToBytes("getblocks"), payload...)
+	request := append(commandToBytes("getdata"), payload...)
 
-	sendData(addr, request)
+	return s.sendData(addr, request)
 }
 
 // 查看传入地址是否在knownNodes（已知节点）集合中
-func nodeIsKnow(addr string) bool {
-	for _, node := range knownNodes {
+func (s *Server) nodeIsKnow(addr string) bool {
+	for _, node := range s.nodes() {
 		if node == addr {
 			return true
 		}
@@ -276,29 +1091,67 @@ func nodeIsKnow(addr string) bool {
 	return false
 }
 
+// 已知节点的副本
+func (s *Server) nodes() []string {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	return append([]string{}, s.knownNodes...)
+}
+
+func (s *Server) addNode(addr string) {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	s.knownNodes = append(s.knownNodes, addr)
+}
+
+// 从knownNodes中剔除节点
+func (s *Server) isLightPeer(addr string) bool {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	return s.lightPeers[addr]
+}
+
+func (s *Server) removeNode(addr string) {
+	s.nodesMu.Lock()
+	defer s.nodesMu.Unlock()
+
+	var updateNodes []string
+
+	for _, node := range s.knownNodes {
+		if node != addr {
+			updateNodes = append(updateNodes, node)
+		}
+	}
+	s.knownNodes = updateNodes
+}
+
 // addr是目标地址
-func sendData(addr string, data []byte) {
-	conn, err := net.Dial("tcp", addr)
+func (s *Server) sendData(addr string, data []byte) error {
+	conn, err := s.transport.Dial(addr)
 	if err != nil {
 		fmt.Printf("%s is not available\n", addr)
 
 		// 剔除不可用节点
-		var updateNodes []string
-
-		for _, node := range knownNodes {
-			if node != addr {
-				updateNodes = append(updateNodes, node)
-			}
-		}
-		knownNodes = updateNodes
+		s.removeNode(addr)
+		return err
 	}
 
 	defer conn.Close()
 
-	_, err = io.Copy(conn, bytes.NewReader(data))
+	// 主动连接时对方确实在addr上监听，TLS连接还可以确认对方的公钥，被封禁的节点也从已知节点中剔除
+	fingerprint := tlsFingerprint(conn)
+	if s.isBanned(addr) || fingerprint != nil && s.isBanned(fingerprintKey(fingerprint)) {
+		s.removeNode(addr)
+		s.chainSync.dropPeer(addr)
+		return fmt.Errorf("%s is banned", addr)
+	}
 
-	checkErr(err)
+	_, err = io.Copy(conn, bytes.NewReader(data))
 
+	return err
 }
 
 func commandToBytes(command string) []byte {
@@ -321,6 +1174,8 @@ func bytesToCommand(bytes []byte) string {
 	return fmt.Sprintf("%s", command)
 }
 
+// P2P消息的外层仍然用gob编码：消息只在节点之间传递，不参与任何hash，编码不同只会让消息解析失败。
+// 消息中的交易、区块与区块头是按encoding.go编码好的[]byte，gob只负责把它们与地址等字段打包在一起
 func gobEncode(data interface{}) []byte {
 
 	var buff bytes.Buffer
@@ -340,10 +1195,39 @@ func gobEncode(data interface{}) []byte {
 	case getdata:
 		err := enc.Encode(&t)
 		checkErr(err)
-	case getblocks:
+	case getheaders:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case headers:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case txsend:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case cmpctblock:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case getblocktxn:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case blocktxn:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case getmerkle:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case merkleblock:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case filterload:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case filteradd:
+		err := enc.Encode(&t)
+		checkErr(err)
+	case filterclear:
 		err := enc.Encode(&t)
 		checkErr(err)
-		
 	}
 
 	return buff.Bytes()
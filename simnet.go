@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// 模拟网络中运行的一组节点，共用同一个创世区块
+type SimCluster struct {
+	Network *SimNetwork
+	Servers []*Server
+	Wallet  *Wallet // 创世区块coinbase输出的所有者
+	dir     string
+}
+
+// 在同一个进程中启动n个节点，每个节点使用临时目录下自己的数据库与封禁列表，
+// 节点sim:0作为种子节点，其他节点启动时向它发送version
+func NewSimCluster(n int, seed int64) (*SimCluster, error) {
+	dir, err := ioutil.TempDir("", "simnet")
+	if err != nil {
+		return nil, err
+	}
+
+	wallet := NewWallet()
+	genesis := NewGensisBlock([]*Transation{NewCoinbaseTX(string(wallet.GetAddress()), genesisData)})
+
+	c := &SimCluster{Network: NewSimNetwork(seed), Wallet: wallet, dir: dir}
+	seeds := []string{simNodeAddress(0)}
+
+	for i := 0; i < n; i++ {
+		addr := simNodeAddress(i)
+		bc := OpenBlockchain(filepath.Join(dir, fmt.Sprintf("node%d.db", i)), func() *Block {
+			return genesis
+		})
+
+		s := NewServer(addr, "", bc, c.Network.Transport(addr), seeds)
+		s.banFile = filepath.Join(dir, fmt.Sprintf("node%d.ban", i))
+		c.Servers = append(c.Servers, s)
+	}
+
+	// 种子节点先开始监听，其他节点的version才不会被拒绝
+	for i, s := range c.Servers {
+		go s.Start()
+		if i == 0 {
+			c.waitListening(s.address)
+		}
+	}
+	return c, nil
+}
+
+func simNodeAddress(i int) string {
+	return fmt.Sprintf("sim:%d", i)
+}
+
+func (c *SimCluster) waitListening(addr string) {
+	for {
+		c.Network.mu.Lock()
+		ln := c.Network.listeners[addr]
+		c.Network.mu.Unlock()
+
+		if ln != nil {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// 第i个节点挖出一个包含coinbase交易与txs的区块并广播
+func (c *SimCluster) Mine(i int, txs ...*Transation) *Block {
+	s := c.Servers[i]
+
+	wallet := NewWallet()
+	coinbase := NewCoinbaseTX(string(wallet.GetAddress()), fmt.Sprintf("sim block by %s at %d", s.address, time.Now().UnixNano()))
+
+	block := s.bc.MineBlock(append([]*Transation{coinbase}, txs...))
+	set := UTXOSet{s.bc}
+	set.update(block)
+
+	s.announceBlock(block, "")
+	return block
+}
+
+// 所有节点的最新区块是否相同
+func (c *SimCluster) Converged() bool {
+	for _, s := range c.Servers[1:] {
+		if bytes.Compare(s.bc.Tip(), c.Servers[0].bc.Tip()) != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// 等待所有节点同步到同一个最新区块，超时返回false
+func (c *SimCluster) WaitConverged(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+
+	for time.Now().Before(deadline) {
+		if c.Converged() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return c.Converged()
+}
+
+// 停止所有节点并删除临时数据
+func (c *SimCluster) Close() {
+	for _, s := range c.Servers {
+		s.Stop()
+		s.bc.Close()
+	}
+	os.RemoveAll(c.dir)
+}
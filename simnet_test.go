@@ -0,0 +1,105 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+const simTestTimeout = 30 * time.Second
+
+// 启动模拟网络中的节点，等待它们都与种子节点完成握手
+func startSimCluster(t *testing.T, n int) *SimCluster {
+	cluster, err := NewSimCluster(n, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(cluster.Close)
+
+	deadline := time.Now().Add(simTestTimeout)
+	for len(cluster.Servers[0].nodes()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("seed node knows %d of %d nodes", len(cluster.Servers[0].nodes()), n)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return cluster
+}
+
+func checkConverged(t *testing.T, cluster *SimCluster, height int32) {
+	if !cluster.WaitConverged(simTestTimeout) {
+		for _, s := range cluster.Servers {
+			t.Logf("%s height %d tip %x", s.address, s.bc.GetBestHeight(), s.bc.Tip())
+		}
+		t.Fatal("nodes did not converge")
+	}
+	if got := cluster.Servers[0].bc.GetBestHeight(); got != height {
+		t.Fatalf("converged on height %d, want %d", got, height)
+	}
+}
+
+func TestSimNetConverges(t *testing.T) {
+	cluster := startSimCluster(t, 4)
+	cluster.Network.SetConditions(10*time.Millisecond, 10*time.Millisecond, 0)
+
+	for i := 0; i < 5; i++ {
+		cluster.Mine(0)
+	}
+	checkConverged(t, cluster, 5)
+}
+
+func TestSimNetPartitionHeals(t *testing.T) {
+	cluster := startSimCluster(t, 4)
+	cluster.Network.SetConditions(10*time.Millisecond, 10*time.Millisecond, 0)
+
+	// 两个分区各自挖矿，左边的链更长
+	left := []string{simNodeAddress(0), simNodeAddress(1)}
+	right := []string{simNodeAddress(2), simNodeAddress(3)}
+	cluster.Network.Partition(left, right)
+	for i := 0; i < 2; i++ {
+		cluster.Mine(3)
+	}
+	for i := 0; i < 5; i++ {
+		cluster.Mine(0)
+	}
+	cluster.Network.Heal()
+
+	// 恢复连通后的新区块把右边的节点带到最长链上
+	cluster.Mine(0)
+	checkConverged(t, cluster, 6)
+}
+
+func TestSimNetPartitionHealsWithSpends(t *testing.T) {
+	cluster := startSimCluster(t, 4)
+	cluster.Network.SetConditions(10*time.Millisecond, 10*time.Millisecond, 0)
+	w := cluster.Wallet
+	addr := string(w.GetAddress())
+	genesis, err := cluster.Servers[0].bc.GetBlock(cluster.Servers[0].bc.Tip())
+	if err != nil {
+		t.Fatal(err)
+	}
+	coinbase := genesis.Transations[0]
+
+	// 两个分区都花费创世区块的输出，左边还花费了只在左边的链上的输出，并且链更长
+	left := []string{simNodeAddress(0), simNodeAddress(1)}
+	right := []string{simNodeAddress(2), simNodeAddress(3)}
+	cluster.Network.Partition(left, right)
+	rightSpend := testSpend(w, coinbase, 0, addr, 95)
+	cluster.Mine(3, rightSpend)
+	cluster.Mine(3, testSpend(w, rightSpend, 0, addr, 90))
+
+	leftSpend := testSpend(w, coinbase, 0, addr, 80)
+	leftChild := testSpend(w, leftSpend, 0, addr, 70)
+	cluster.Mine(0, leftSpend)
+	cluster.Mine(0, leftChild)
+	cluster.Mine(0)
+	cluster.Network.Heal()
+
+	cluster.Mine(0)
+	checkConverged(t, cluster, 4)
+	for _, s := range cluster.Servers {
+		set := UTXOSet{s.bc}
+		if !set.IsUnspent(leftChild.ID, 0) || set.IsUnspent(rightSpend.ID, 0) {
+			t.Fatalf("%s did not switch its UTXO set to the longer chain", s.address)
+		}
+	}
+}
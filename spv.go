@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"sync"
+
+	"github.com/boltdb/bolt"
+)
+
+// 轻节点（SPV）：只同步区块头，通过默克尔证明确认与钱包有关的交易确实被打包进了区块
+
+const lightHeaderBucket = "headers"
+const lightTxBucket = "wallettxs"
+
+// 轻节点数据库文件，nodeID代表port
+func lightDBFile(nodeID string) string {
+	return fmt.Sprintf("light_%s.db", nodeID)
+}
+
+type getmerkle struct {
+	AddrFrom     string
+	BlockHash    []byte
+	PubkeyHashes [][]byte // 轻节点关心的公钥哈希，为空时使用对方通过filterload加载的布隆过滤器
+}
+
+// 匹配的交易以及它的默克尔证明
+type txProof struct {
+	Transation []byte
+	Proof      MerkleProof
+}
+
+type merkleblock struct {
+	AddrFrom string
+	Header   []byte // 序列化的区块头
+	Matches  []txProof
+}
+
+// 轻节点保存的与钱包有关的交易
+type walletTx struct {
+	BlockHash  []byte
+	Height     int32
+	Transation []byte
+}
+
+// 交易是否向pubkeyHashes中的某个公钥哈希支付，或者花费了属于它们的输出
+func txMatches(tx *Transation, pubkeyHashes [][]byte) bool {
+	for _, pkh := range pubkeyHashes {
+		for _, out := range tx.Vout {
+			if out.CanBeUnlockedWith(pkh) {
+				return true
+			}
+		}
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			if in.canUnlockOutputWith(pkh) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// 全节点：返回区块头以及区块中与对方公钥哈希或布隆过滤器匹配的交易和它们的默克尔证明，
+// 过滤器按连接确认过的身份peer查找
+func (s *Server) handleGetMerkle(request []byte, peer string) error {
+	var buff bytes.Buffer
+	var payload getmerkle
+
+	buff.Write(request[commandLength:])
+	dec := gob.NewDecoder(&buff)
+	err := dec.Decode(&payload)
+	if err != nil {
+		return misbehave(scoreMalformed, "malformed getmerkle: %s", err)
+	}
+
+	block, err := s.bc.GetBlock(payload.BlockHash)
+	if err != nil {
+		fmt.Printf("%s requested unknown block %x\n", payload.AddrFrom, payload.BlockHash)
+		return nil
+	}
+
+	match := func(tx *Transation) bool {
+		return txMatches(tx, payload.PubkeyHashes)
+	}
+	if len(payload.PubkeyHashes) == 0 {
+		s.filtersMu.Lock()
+		defer s.filtersMu.Unlock()
+
+		filter := s.filters[peer]
+		if filter == nil {
+			fmt.Printf("%s requested merkleblock without loading a filter\n", peer)
+		}
+		match = func(tx *Transation) bool {
+			return filter != nil && filter.MatchTxAndUpdate(tx)
+		}
+	}
+
+	mb := merkleblock{AddrFrom: s.address, Header: block.Header().Serialize()}
+	for _, tx := range block.Transations {
+		if !match(tx) {
+			continue
+		}
+		proof, err := block.MerkleProof(tx.ID)
+		checkErr(err)
+		mb.Matches = append(mb.Matches, txProof{tx.Serialize(), *proof})
+	}
+
+	s.sendData(payload.AddrFrom, append(commandToBytes("merkleblock"), gobEncode(mb)...))
+	return nil
+}
+
+// 轻节点，区块头与钱包交易保存在自己的数据库中，不保存完整的区块
+type LightClient struct {
+	address      string
+	transport    Transport
+	db           *bolt.DB
+	seeds        []string
+	pubkeyHashes [][]byte     // 钱包中所有地址的公钥哈希
+	filter       *BloomFilter // 不为nil时只把布隆过滤器交给全节点，不直接暴露公钥哈希
+
+	mu       sync.Mutex // 保证区块头按顺序处理
+	listener net.Listener
+}
+
+func NewLightClient(address, file string, transport Transport, seeds []string, pubkeyHashes [][]byte) *LightClient {
+	db, err := bolt.Open(file, 0600, nil)
+	checkErr(err)
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists([]byte(lightHeaderBucket))
+		checkErr(err)
+		_, err = tx.CreateBucketIfNotExists([]byte(lightTxBucket))
+		checkErr(err)
+		return nil
+	})
+	checkErr(err)
+	migrateLightStore(db)
+
+	return &LightClient{
+		address:      address,
+		transport:    transport,
+		db:           db,
+		seeds:        seeds,
+		pubkeyHashes: pubkeyHashes,
+	}
+}
+
+// 改用误报率为fpRate的布隆过滤器向全节点请求交易。误报率越高，
+// 全节点返回的无关交易越多，也就越难判断哪些地址属于这个轻节点
+func (lc *LightClient) UseBloomFilter(fpRate float64) {
+	var tweak [4]byte
+	_, err := rand.Read(tweak[:])
+	checkErr(err)
+
+	filter := NewBloomFilter(len(lc.pubkeyHashes), fpRate, binary.LittleEndian.Uint32(tweak[:]))
+	for _, pkh := range lc.pubkeyHashes {
+		filter.Add(pkh)
+	}
+	lc.filter = filter
+}
+
+// 开始监听，并向种子节点发送version
+func (lc *LightClient) Start() error {
+	ln, err := lc.transport.Listen(lc.address)
+	if err != nil {
+		return err
+	}
+	lc.mu.Lock()
+	lc.listener = ln
+	lc.mu.Unlock()
+	defer ln.Close()
+
+	for _, node := range lc.seeds {
+		lc.sendVersion(node)
+	}
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			return nil
+		}
+		go lc.handleConnection(conn)
+	}
+}
+
+func (lc *LightClient) Stop() {
+	lc.mu.Lock()
+	defer lc.mu.Unlock()
+
+	if lc.listener != nil {
+		lc.listener.Close()
+	}
+	lc.db.Close()
+}
+
+func (lc *LightClient) sendData(addr string, command string, payload interface{}) {
+	conn, err := lc.transport.Dial(addr)
+	if err != nil {
+		fmt.Printf("%s is not available\n", addr)
+		return
+	}
+	defer conn.Close()
+
+	conn.Write(append(commandToBytes(command), gobEncode(payload)...))
+}
+
+// 在version之前加载过滤器，之后请求的merkleblock都按它匹配
+func (lc *LightClient) sendVersion(addr string) {
+	if lc.filter != nil {
+		lc.sendData(addr, "filterload", filterload{lc.address, *lc.filter})
+	}
+
+	height := int32(-1)
+	if tip := lc.tip(); tip != nil {
+		height = tip.Height
+	}
+	lc.sendData(addr, "version", Version{nodeVersion, height, lc.address, false, true})
+}
+
+func (lc *LightClient) handleConnection(conn net.Conn) {
+	defer conn.Close()
+
+	request, err := readMessage(conn)
+	if err != nil || len(request) < commandLength {
+		return
+	}
+
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("drop message from %s: %v\n", conn.RemoteAddr(), r)
+		}
+	}()
+
+	command := bytesToCommand(request[:commandLength])
+	dec := gob.NewDecoder(bytes.NewReader(request[commandLength:]))
+
+	switch command {
+	case "version":
+		var payload Version
+		checkErr(dec.Decode(&payload))
+		lc.handleVersion(payload)
+	case "headers":
+		var payload headers
+		checkErr(dec.Decode(&payload))
+		lc.handleHeaders(payload)
+	case "merkleblock":
+		var payload merkleblock
+		checkErr(dec.Decode(&payload))
+		lc.handleMerkleBlock(payload)
+	case "inv":
+		var payload inv
+		checkErr(dec.Decode(&payload))
+		if payload.Type == "block" {
+			lc.sendData(payload.AddrFrom, "getheaders", getheaders{lc.address, lc.locator(), nil})
+		}
+	}
+}
+
+func (lc *LightClient) handleVersion(payload Version) {
+	height := int32(-1)
+	if tip := lc.tip(); tip != nil {
+		height = tip.Height
+	}
+	if payload.BestHeight > height {
+		lc.sendData(payload.AddrFrom, "getheaders", getheaders{lc.address, lc.locator(), nil})
+	}
+}
+
+// 最新的区块头，还没有任何区块头时返回nil
+func (lc *LightClient) tip() *BlockHeader {
+	var tip *BlockHeader
+
+	err := lc.db.View(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(lightHeaderBucket))
+		if hash := b.Get([]byte("l")); hash != nil {
+			tip = deserializeHeaderWithHeight(b.Get(hash))
+		}
+		return nil
+	})
+	checkErr(err)
+	return tip
+}
+
+func (lc *LightClient) header(hash []byte) *BlockHeader {
+	var header *BlockHeader
+
+	err := lc.db.View(func(tx *bolt.Tx) error {
+		if data := tx.Bucket([]byte(lightHeaderBucket)).Get(hash); data != nil {
+			header = deserializeHeaderWithHeight(data)
+		}
+		return nil
+	})
+	checkErr(err)
+	return header
+}
+
+// 从最新的区块头沿着PrevBlockHash构建区块定位器；没有区块头时为空，全节点会从创世区块开始返回
+func (lc *LightClient) locator() [][]byte {
+	var chain [][]byte
+
+	for h := lc.tip(); h != nil; h = lc.header(h.PrevBlockHash) {
+		chain = append(chain, h.Hash)
+		if len(h.PrevBlockHash) == 0 {
+			break
+		}
+	}
+	if len(chain) == 0 {
+		return nil
+	}
+	return buildLocator(chain)
+}
+
+// 验证并保存区块头，然后为每个新的区块头请求默克尔区块
+func (lc *LightClient) handleHeaders(payload headers) {
+	lc.mu.Lock()
+	var added []*BlockHeader
+
+	for _, data := range payload.Headers {
+		h, err := ParseHeader(data)
+		if err != nil {
+			fmt.Printf("malformed header from %s: %s\n", payload.AddrFrom, err)
+			break
+		}
+		if lc.header(h.Hash) != nil {
+			continue
+		}
+
+		if len(h.PrevBlockHash) == 0 {
+			// 第一次同步时信任对方的创世区块
+			if lc.tip() != nil {
+				fmt.Printf("reject genesis header %x from %s\n", h.Hash, payload.AddrFrom)
+				break
+			}
+			fmt.Printf("genesis block %x\n", h.Hash)
+		} else {
+			prev := lc.header(h.PrevBlockHash)
+			if prev == nil {
+				fmt.Printf("header %x from %s does not connect\n", h.Hash, payload.AddrFrom)
+				break
+			}
+			h.Height = prev.Height + 1
+		}
+		if !h.Validate() {
+			fmt.Printf("header %x from %s has invalid proof of work\n", h.Hash, payload.AddrFrom)
+			break
+		}
+
+		err = lc.db.Update(func(tx *bolt.Tx) error {
+			b := tx.Bucket([]byte(lightHeaderBucket))
+			err := b.Put(h.Hash, h.serializeWithHeight())
+			checkErr(err)
+
+			// 最长链上的区块头作为最新区块头
+			last := b.Get([]byte("l"))
+			if last == nil || h.Height > deserializeHeaderWithHeight(b.Get(last)).Height {
+				err = b.Put([]byte("l"), h.Hash)
+				checkErr(err)
+			}
+			return nil
+		})
+		checkErr(err)
+		added = append(added, h)
+	}
+	lc.mu.Unlock()
+
+	if len(added) > 0 {
+		fmt.Printf("synced headers to height %d\n", added[len(added)-1].Height)
+	}
+	if len(payload.Headers) == maxHeadersPerMsg {
+		lc.sendData(payload.AddrFrom, "getheaders", getheaders{lc.address, lc.locator(), nil})
+	}
+
+	pubkeyHashes := lc.pubkeyHashes
+	if lc.filter != nil {
+		pubkeyHashes = nil
+	}
+	for _, h := range added {
+		lc.sendData(payload.AddrFrom, "getmerkle", getmerkle{lc.address, h.Hash, pubkeyHashes})
+	}
+}
+
+// 用已保存的区块头中的merkle根验证每一笔交易的默克尔证明，通过后保存
+func (lc *LightClient) handleMerkleBlock(payload merkleblock) {
+	h, err := ParseHeader(payload.Header)
+	if err != nil {
+		fmt.Printf("malformed merkleblock from %s: %s\n", payload.AddrFrom, err)
+		return
+	}
+	header := lc.header(h.Hash)
+	if header == nil {
+		fmt.Printf("merkleblock for unknown header %x\n", h.Hash)
+		return
+	}
+
+	for _, m := range payload.Matches {
+		tx, err := ParseTransation(m.Transation)
+		if err != nil || !m.Proof.Verify(header.Merkleroot, tx.ID) {
+			fmt.Printf("invalid merkle proof in block %x from %s\n", header.Hash, payload.AddrFrom)
+			return
+		}
+		if !txMatches(tx, lc.pubkeyHashes) {
+			continue
+		}
+
+		wtx := walletTx{header.Hash, header.Height, tx.Serialize()}
+		err = lc.db.Update(func(btx *bolt.Tx) error {
+			var buff bytes.Buffer
+			err := gob.NewEncoder(&buff).Encode(wtx)
+			checkErr(err)
+			return btx.Bucket([]byte(lightTxBucket)).Put(tx.ID, buff.Bytes())
+		})
+		checkErr(err)
+		fmt.Printf("proved transation %x in block %d\n", tx.ID, header.Height)
+	}
+
+	for _, pkh := range lc.pubkeyHashes {
+		fmt.Printf("balance of %x: %d\n", pkh, lc.Balance(pkh))
+	}
+}
+
+// 钱包中所有已证明的交易
+func (lc *LightClient) Transations() []*Transation {
+	var txs []*Transation
+
+	err := lc.db.View(func(btx *bolt.Tx) error {
+		return btx.Bucket([]byte(lightTxBucket)).ForEach(func(k, v []byte) error {
+			var wtx walletTx
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&wtx)
+			checkErr(err)
+
+			tx, err := ParseTransation(wtx.Transation)
+			checkErr(err)
+			txs = append(txs, tx)
+			return nil
+		})
+	})
+	checkErr(err)
+	return txs
+}
+
+// 根据已证明的交易计算pubkeyHash的余额：属于它的输出中没有被这些交易花费掉的部分
+func (lc *LightClient) Balance(pubkeyHash []byte) int {
+	txs := lc.Transations()
+
+	spent := make(map[string]bool) // 键-交易id:输出索引
+	for _, tx := range txs {
+		if tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range tx.Vin {
+			spent[fmt.Sprintf("%s:%d", hex.EncodeToString(in.TXid), in.Voutindex)] = true
+		}
+	}
+
+	balance := 0
+	for _, tx := range txs {
+		for i, out := range tx.Vout {
+			if out.CanBeUnlockedWith(pubkeyHash) && !spent[fmt.Sprintf("%s:%d", hex.EncodeToString(tx.ID), i)] {
+				balance += out.Value
+			}
+		}
+	}
+	return balance
+}
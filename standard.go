@@ -0,0 +1,261 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+// 标准脚本模板
+
+// P2PKH锁定脚本：OP_DUP OP_HASH160 <公钥哈希> OP_EQUALVERIFY OP_CHECKSIG
+func payToPubkeyHashScript(pubkeyHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_DUP).AddOp(OP_HASH160).AddData(pubkeyHash).
+		AddOp(OP_EQUALVERIFY).AddOp(OP_CHECKSIG).Script()
+}
+
+// P2PKH解锁脚本：<签名> <公钥>
+func payToPubkeyHashSigScript(sig, pubKey []byte) []byte {
+	return NewScriptBuilder().AddData(sig).AddData(pubKey).Script()
+}
+
+// 锁定脚本是P2PKH时返回其中的公钥哈希，否则返回nil
+func extractPubkeyHash(script []byte) []byte {
+	if len(script) == 25 && script[0] == OP_DUP && script[1] == OP_HASH160 && script[2] == 20 &&
+		script[23] == OP_EQUALVERIFY && script[24] == OP_CHECKSIG {
+		return script[3:23]
+	}
+	return nil
+}
+
+// 锁定脚本的类型
+func scriptClass(script []byte) string {
+	switch {
+	case extractPubkeyHash(script) != nil:
+		return "pubkeyhash"
+	case extractScriptHash(script) != nil:
+		return "scripthash"
+	}
+	if _, _, ok := extractMultiSig(script); ok {
+		return "multisig"
+	}
+	if _, _, _, ok := extractTimeLock(script); ok {
+		return "timelock"
+	}
+	if _, ok := extractHTLC(script); ok {
+		return "htlc"
+	}
+	if _, ok := extractNullData(script); ok {
+		return "nulldata"
+	}
+	return "nonstandard"
+}
+
+// 输出锁定到的公钥哈希，非P2PKH输出返回nil
+func (out *TXOutput) pubkeyHash() []byte {
+	return extractPubkeyHash(out.ScriptPubKey)
+}
+
+// 输出的地址，非标准脚本返回反汇编
+func (out *TXOutput) address() string {
+	if pubkeyHash := out.pubkeyHash(); pubkeyHash != nil {
+		return pubkeyHashToAddress(pubkeyHash)
+	}
+	if scriptHash := extractScriptHash(out.ScriptPubKey); scriptHash != nil {
+		return scriptHashToAddress(scriptHash)
+	}
+	return DisasmScript(out.ScriptPubKey)
+}
+
+// P2PKH解锁脚本中的公钥，其他脚本返回nil
+func (in *TXInput) pubKey() []byte {
+	pushes := scriptPushes(in.ScriptSig)
+	if len(pushes) != 2 {
+		return nil
+	}
+	return pushes[1]
+}
+
+// M-of-N多重签名锁定脚本：m <公钥1>...<公钥n> n OP_CHECKMULTISIG，公钥按字节排序，
+// 同一组公钥与门限总是得到同一个脚本与地址
+func multiSigScript(m int, pubKeys [][]byte) ([]byte, error) {
+	n := len(pubKeys)
+	if n == 0 || n > 16 || m < 1 || m > n {
+		return nil, fmt.Errorf("invalid %d-of-%d multisig, need 1 <= m <= n <= 16", m, n)
+	}
+
+	sorted := make([][]byte, n)
+	copy(sorted, pubKeys)
+	sort.Slice(sorted, func(i, j int) bool { return bytes.Compare(sorted[i], sorted[j]) < 0 })
+
+	b := NewScriptBuilder().AddInt64(int64(m))
+	for i, pubKey := range sorted {
+		if _, err := parsePubKey(pubKey); err != nil {
+			return nil, err
+		}
+		if i > 0 && bytes.Equal(pubKey, sorted[i-1]) {
+			return nil, fmt.Errorf("duplicate public key %x", pubKey)
+		}
+		b.AddData(pubKey)
+	}
+	return b.AddInt64(int64(n)).AddOp(OP_CHECKMULTISIG).Script(), nil
+}
+
+// 锁定脚本是多重签名时返回门限与公钥
+func extractMultiSig(script []byte) (int, [][]byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) < 4 || ops[len(ops)-1].code != OP_CHECKMULTISIG {
+		return 0, nil, false
+	}
+	small := func(op scriptOp) int {
+		if op.code >= OP_1 && op.code <= OP_16 {
+			return int(op.code-OP_1) + 1
+		}
+		return 0
+	}
+
+	m, n := small(ops[0]), small(ops[len(ops)-2])
+	if m == 0 || n == 0 || m > n || len(ops) != n+3 {
+		return 0, nil, false
+	}
+	var pubKeys [][]byte
+	for _, op := range ops[1 : n+1] {
+		if op.data == nil {
+			return 0, nil, false
+		}
+		pubKeys = append(pubKeys, op.data)
+	}
+	return m, pubKeys, true
+}
+
+// 多重签名解锁脚本：<签名1>...<签名m>，签名按公钥的顺序排列
+func multiSigSigScript(sigs [][]byte) []byte {
+	b := NewScriptBuilder()
+	for _, sig := range sigs {
+		b.AddData(sig)
+	}
+	return b.Script()
+}
+
+// 脚本哈希锁定脚本：OP_HASH160 <赎回脚本的哈希> OP_EQUAL
+func payToScriptHashScript(scriptHash []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_HASH160).AddData(scriptHash).AddOp(OP_EQUAL).Script()
+}
+
+// 脚本哈希解锁脚本：在赎回脚本的解锁脚本后面加上赎回脚本本身
+func payToScriptHashSigScript(sigScript, redeemScript []byte) []byte {
+	return append(append([]byte{}, sigScript...), NewScriptBuilder().AddData(redeemScript).Script()...)
+}
+
+// 锁定脚本是脚本哈希时返回其中的哈希，否则返回nil
+func extractScriptHash(script []byte) []byte {
+	if len(script) == 23 && script[0] == OP_HASH160 && script[1] == 20 && script[22] == OP_EQUAL {
+		return script[2:22]
+	}
+	return nil
+}
+
+// 时间锁脚本：<锁定> OP_CHECKLOCKTIMEVERIFY（relative时为OP_CHECKSEQUENCEVERIFY） OP_DROP 加上P2PKH脚本，
+// 锁定解除之前私钥的主人也不能花费，用于分期解锁
+func timeLockScript(lock uint32, relative bool, pubkeyHash []byte) []byte {
+	check := byte(OP_CHECKLOCKTIMEVERIFY)
+	if relative {
+		check = OP_CHECKSEQUENCEVERIFY
+	}
+	b := NewScriptBuilder().AddInt64(int64(lock)).AddOp(check).AddOp(OP_DROP)
+	return append(b.Script(), payToPubkeyHashScript(pubkeyHash)...)
+}
+
+// 脚本是时间锁脚本时返回锁定、是否为相对锁定与公钥哈希
+func extractTimeLock(script []byte) (uint32, bool, []byte, bool) {
+	ops, err := parseScript(script)
+	if err != nil || len(ops) != 8 || len(script) < 25 {
+		return 0, false, nil, false
+	}
+	lock, ok := lockTimeOp(ops[0])
+	if !ok {
+		return 0, false, nil, false
+	}
+
+	// 与重新构造的脚本逐字节相同才算，排除非最短编码等变体
+	pubkeyHash := extractPubkeyHash(script[len(script)-25:])
+	relative := ops[1].code == OP_CHECKSEQUENCEVERIFY
+	if pubkeyHash == nil || !bytes.Equal(script, timeLockScript(lock, relative, pubkeyHash)) {
+		return 0, false, nil, false
+	}
+	return lock, relative, pubkeyHash, true
+}
+
+// 压入锁定时间的指令中的数值，必须为正
+func lockTimeOp(op scriptOp) (uint32, bool) {
+	var lock int64
+	switch {
+	case op.code >= OP_1 && op.code <= OP_16:
+		lock = int64(op.code-OP_1) + 1
+	case op.data != nil:
+		n, err := decodeScriptNum(op.data, 5)
+		if err != nil {
+			return 0, false
+		}
+		lock = n
+	}
+	if lock <= 0 || lock > 0xffffffff {
+		return 0, false
+	}
+	return uint32(lock), true
+}
+
+const maxDataCarrierSize = 80 // 数据输出中数据的最大字节数
+
+const maxNullDataScriptSize = maxDataCarrierSize + 3 // 数据输出锁定脚本的最大字节数：OP_RETURN、OP_PUSHDATA1、长度与数据
+
+// 数据输出的锁定脚本：OP_RETURN <数据>，执行到OP_RETURN就失败，可以证明永远不能花费
+func nullDataScript(data []byte) []byte {
+	return NewScriptBuilder().AddOp(OP_RETURN).AddData(data).Script()
+}
+
+// 锁定脚本是数据输出时返回其中的数据
+func extractNullData(script []byte) ([]byte, bool) {
+	if len(script) == 0 || script[0] != OP_RETURN {
+		return nil, false
+	}
+	ops, err := parseScript(script)
+	if err != nil || len(ops) > 2 {
+		return nil, false
+	}
+	if len(ops) == 1 {
+		return nil, true
+	}
+	if ops[1].code > OP_PUSHDATA2 {
+		return nil, false
+	}
+	return ops[1].data, true
+}
+
+// 永远不能花费的输出，不需要放进UTXO集合
+func isUnspendable(script []byte) bool {
+	return len(script) > 0 && script[0] == OP_RETURN || len(script) > maxScriptSize
+}
+
+// 数据输出的规则，交易池与区块都要遵守：以OP_RETURN开头的输出都是数据输出，不管后面是什么。
+// 最多一个数据输出，整个锁定脚本不超过maxNullDataScriptSize字节，金额必须为0
+func (tx *Transation) checkDataOutputs() error {
+	count := 0
+	for i, out := range tx.Vout {
+		if len(out.ScriptPubKey) == 0 || out.ScriptPubKey[0] != OP_RETURN {
+			continue
+		}
+		count++
+		if count > 1 {
+			return errors.New("more than one data output")
+		}
+		if len(out.ScriptPubKey) > maxNullDataScriptSize {
+			return fmt.Errorf("data output %d has a %d byte script, limit is %d", i, len(out.ScriptPubKey), maxNullDataScriptSize)
+		}
+		if out.Value != 0 {
+			return fmt.Errorf("data output %d burns %d coins", i, out.Value)
+		}
+	}
+	return nil
+}
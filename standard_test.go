@@ -0,0 +1,35 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestCheckDataOutputs(t *testing.T) {
+	p2pkh := payToPubkeyHashScript(make([]byte, 20))
+	tests := []struct {
+		name string
+		outs []TXOutput
+		err  string // 为空时交易有效
+	}{
+		{"no data output", []TXOutput{{10, p2pkh, -1}}, ""},
+		{"bare OP_RETURN", []TXOutput{{0, []byte{OP_RETURN}, -1}}, ""},
+		{"largest data", []TXOutput{{0, nullDataScript(make([]byte, maxDataCarrierSize)), -1}}, ""},
+		{"data too large", []TXOutput{{0, nullDataScript(make([]byte, maxDataCarrierSize+1)), -1}}, "byte script"},
+		{"non-push data too large", []TXOutput{{0, append([]byte{OP_RETURN}, bytes.Repeat([]byte{OP_DUP}, maxNullDataScriptSize)...), -1}}, "byte script"},
+		{"non-push data burns coins", []TXOutput{{5, []byte{OP_RETURN, OP_DUP}, -1}}, "burns"},
+		{"data burns coins", []TXOutput{{1, nullDataScript([]byte("x")), -1}}, "burns"},
+		{"two data outputs", []TXOutput{{0, nullDataScript([]byte("a")), -1}, {0, []byte{OP_RETURN, OP_DUP}, -1}}, "more than one"},
+	}
+	for _, test := range tests {
+		tx := &Transation{Vout: test.outs}
+		err := tx.checkDataOutputs()
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%s: %s", test.name, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%s: got %v, want %q", test.name, err, test.err)
+		}
+	}
+}
@@ -6,7 +6,6 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/gob"
 	"encoding/hex"
 	"fmt"
 	"log"
@@ -19,25 +18,26 @@ const subsidy = 100
 
 //交易
 type Transation struct {
-	ID   []byte     // 交易的hash值（唯一标识符）
+	ID   []byte     // 交易id（唯一标识符），不包含解锁脚本的交易的hash，见unsignedHash
 	Vin  []TXInput  // 交易中所有的输入
 	Vout []TXOutput // 交易中所有的输出
 
+	LockTime uint32 // 锁定时间，之前不能打包进区块，0为不锁定
 }
 
 //输入
 type TXInput struct {
 	TXid      []byte // 引用的output所在的交易的id
 	Voutindex int    // 引用的output在其交易中的索引
-	Signature []byte // 私钥签名，用于解锁utxo
-	PubKey    []byte // 公钥
+	ScriptSig []byte // 解锁脚本，P2PKH为签名与公钥，是见证数据，不在交易id中；coinbase交易中为任意数据，在交易id中
+	Sequence  uint32 // 序号，低16位为相对锁定，0为不锁定
 }
 
 //输出
 type TXOutput struct {
 
-	Value      int    // 收益金额
-	PubkeyHash []byte // 公钥hash（ripemd160(sha256(publickey))）
+	Value        int    // 收益金额
+	ScriptPubKey []byte // 锁定脚本，地址对应P2PKH脚本
 	index 		int		// 在交易当中的索引，目前初始化为-1
 
 }
@@ -46,11 +46,11 @@ type TXOutputs struct {
 	Outputs []TXOutput
 }
 
-// address是比特币地址
+// address是比特币地址或多重签名地址
 func (out *TXOutput) Lock(address []byte) {
-	decodeAddress := base58Decode(address)
-	publicKeyHash := decodeAddress[1 : len(decodeAddress)-4]
-	out.PubkeyHash = publicKeyHash
+	script, err := addressToScript(string(address))
+	checkErr(err)
+	out.ScriptPubKey = script
 }
 
 //打印
@@ -63,38 +63,61 @@ func (tx Transation) String() string {
 		lines = append(lines, fmt.Sprintf("     Input %d:", i))
 		lines = append(lines, fmt.Sprintf("       TXID:      %x", input.TXid))
 		lines = append(lines, fmt.Sprintf("       Out:       %d", input.Voutindex))
-		lines = append(lines, fmt.Sprintf("       Signature: %x", input.Signature))
+		lines = append(lines, fmt.Sprintf("       Script:    %s", DisasmScript(input.ScriptSig)))
+		if input.Sequence != 0 {
+			lines = append(lines, fmt.Sprintf("       Sequence:  %#x", input.Sequence))
+		}
 	}
 
 	for i, output := range tx.Vout {
 		lines = append(lines, fmt.Sprintf("     Output %d:", i))
 		lines = append(lines, fmt.Sprintf("       Value:  %d", output.Value))
-		lines = append(lines, fmt.Sprintf("       Script: %x", output.PubkeyHash))
+		lines = append(lines, fmt.Sprintf("       Script: %s", DisasmScript(output.ScriptPubKey)))
+	}
+	if tx.LockTime != 0 {
+		lines = append(lines, fmt.Sprintf("     LockTime: %s", lockTimeString(tx.LockTime)))
 	}
 
 	return strings.Join(lines, "\n")
 }
 
-//序列化
+//序列化，编码格式见encoding.go，不包含交易id
 func (tx Transation) Serialize() []byte {
-	var encoded bytes.Buffer
-	enc := gob.NewEncoder(&encoded)
-
-	err := enc.Encode(tx)
-
-	checkErr(err)
-
-	return encoded.Bytes()
+	var e encoder
+	e.writeTransation(&tx)
+	return e.Bytes()
 }
 
-//计算交易的hash值
-func (tx *Transation) Hash() []byte {
+//反序列化来自其他节点的交易，交易id由内容计算
+func ParseTransation(data []byte) (*Transation, error) {
+	dec := decoder{data: data}
+	tx := dec.readTransation()
+	if err := dec.finish(); err != nil {
+		return nil, fmt.Errorf("malformed transation: %s", err)
+	}
+	tx.ID = tx.unsignedHash()
+	return tx, nil
+}
 
+// 交易id在签名之前计算，不包含输入中的解锁脚本。coinbase交易的输入中是数据，包含在id中
+func (tx *Transation) unsignedHash() []byte {
+	if tx.IsCoinBase() {
+		return tx.WitnessHash()
+	}
 	txcopy := *tx
-	txcopy.ID = []byte{}
-
+	txcopy.Vin = make([]TXInput, len(tx.Vin))
+	copy(txcopy.Vin, tx.Vin)
+	for i := range txcopy.Vin {
+		txcopy.Vin[i].ScriptSig = nil
+	}
 	hash := sha256.Sum256(txcopy.Serialize())
+	return hash[:]
+}
 
+// 见证hash：包含解锁脚本的完整交易的hash，由区块的见证默克尔根承诺。
+// 解锁脚本是见证数据，修改签名只改变见证hash，不改变交易id
+func (tx *Transation) WitnessHash() []byte {
+	hash := sha256.Sum256(tx.Serialize())
 	return hash[:]
 }
 
@@ -107,67 +130,113 @@ func NewTXOutput(value int, address string) *TXOutput {
 
 //第一笔coinbase交易
 func NewCoinbaseTX(to string, data string) *Transation {
-	txin := TXInput{[]byte{}, -1, nil, []byte(data)}
+	txin := TXInput{[]byte{}, -1, []byte(data), 0}
 	txout := NewTXOutput(subsidy, to)
 
-	tx := Transation{nil, []TXInput{txin}, []TXOutput{*txout}}
+	tx := Transation{nil, []TXInput{txin}, []TXOutput{*txout}, 0}
 
-	tx.ID = tx.Hash()
+	tx.ID = tx.unsignedHash()
 
 	return &tx
 }
 
+// 输出是否以P2PKH锁定到pubkeyhash
 func (out *TXOutput) CanBeUnlockedWith(pubkeyhash []byte) bool {
-	return bytes.Compare(out.PubkeyHash, pubkeyhash) == 0
+	return bytes.Compare(out.pubkeyHash(), pubkeyhash) == 0 && pubkeyhash != nil
 }
 
+// 输入是否以P2PKH解锁脚本花费pubkeyhash的输出
 func (in *TXInput) canUnlockOutputWith(pubkeyhash []byte) bool {
-	lockinghash := HashPubKey(in.PubKey)
-	return bytes.Compare(lockinghash, pubkeyhash) == 0
+	lockinghash := HashPubKey(in.pubKey())
+	return in.pubKey() != nil && bytes.Compare(lockinghash, pubkeyhash) == 0
 }
 
 func (tx Transation) IsCoinBase() bool {
 	return len(tx.Vin) == 1 && len(tx.Vin[0].TXid) == 0 && tx.Vin[0].Voutindex == -1
 }
 
-func NewUTXOTransation(from, to string, amount int, bc *Blockchain) *Transation {
-	var inputs []TXInput
+// 构造向payments付款的交易，未签名，fee为手续费。找零超过粉尘时付给from
+func NewPaymentTransation(from string, payments []Payment, bc *Blockchain, selector CoinSelector, fees FeePolicy) (*Transation, int, error) {
 	var outputs []TXOutput
 
-	wallets, err := NewWallets()
-	checkErr(err)
+	amount, err := validatePayments(payments)
+	if err != nil {
+		return nil, 0, err
+	}
+	for _, payment := range payments {
+		outputs = append(outputs, *NewTXOutput(payment.Amount, payment.Address))
+	}
+	return newFundedTransation(from, outputs, amount, bc, selector, fees)
+}
 
-	wallet := wallets.GetWallet(from)
-	pubkey := wallet.PublicKey
-	acc, validoutputs := bc.FindSpendableOutputs(HashPubKey(pubkey), amount)
+// 构造在数据输出中嵌入data的交易，未签名，手续费由from支付
+func NewDataTransation(from string, data []byte, bc *Blockchain, selector CoinSelector, fees FeePolicy) (*Transation, int, error) {
+	if len(data) > maxDataCarrierSize {
+		return nil, 0, fmt.Errorf("data of %d bytes exceeds the limit of %d bytes", len(data), maxDataCarrierSize)
+	}
+	outputs := []TXOutput{{0, nullDataScript(data), -1}}
+	return newFundedTransation(from, outputs, 0, bc, selector, fees)
+}
+
+// 从from的未花费输出中选币支付outputs与手续费，找零付给from
+func newFundedTransation(from string, outputs []TXOutput, amount int, bc *Blockchain, selector CoinSelector, fees FeePolicy) (*Transation, int, error) {
+	var inputs []TXInput
+
+	script, err := addressToScript(from)
+	if err != nil {
+		return nil, 0, err
+	}
+	coins := bc.FindCoins(script)
 
-	if acc < amount {
-		log.Panic("Error:Not enough funds")
+	selected, err := selector.Select(coins, amount, len(outputs), fees)
+	if err != nil {
+		return nil, 0, err
+	}
+	fee, change, err := fees.Change(selected, amount, len(outputs))
+	if err != nil {
+		return nil, 0, err
 	}
-	for txid, outs := range validoutputs {
-		txID, err := hex.DecodeString(txid)
 
-		checkErr(err)
+	for _, coin := range selected {
+		input := TXInput{coin.TxID, coin.Index, nil, 0}
+		inputs = append(inputs, input)
+	}
 
-		for _, out := range outs {
-			input := TXInput{txID, out, nil, wallet.PublicKey}
-			inputs = append(inputs, input)
-		}
+	if change > 0 {
+		outputs = append(outputs, *NewTXOutput(change, from))
 	}
-	outputs = append(outputs, *NewTXOutput(amount, to))
 
-	if acc > amount {
-		outputs = append(outputs, *NewTXOutput(acc-amount, from))
+	tx := Transation{nil, inputs, outputs, 0}
+	tx.ID = tx.unsignedHash()
+	return &tx, fee, nil
+}
+
+// 构造并签名付款交易
+func NewUTXOTransation(from string, payments []Payment, bc *Blockchain, selector CoinSelector, fees FeePolicy) *Transation {
+	wallets, err := NewWallets()
+	checkErr(err)
+
+	wallet := wallets.GetWallet(from)
+	if wallet.PrivateKey.D == nil {
+		log.Panic(errWalletLocked)
 	}
 
-	tx := Transation{nil, inputs, outputs}
-	tx.ID = tx.Hash()
-	bc.SignTransation(&tx, wallet.PrivateKey)
-	return &tx
+	tx, fee, err := NewPaymentTransation(from, payments, bc, selector, fees)
+	checkErr(err)
+	fmt.Printf("spending %d outputs to %d payments, fee %d\n", len(tx.Vin), len(payments), fee)
+
+	bc.SignTransation(tx, wallet.PrivateKey)
+	return tx
 }
 
-// 对交易签名，参数：私钥、该笔交易引用的其他交易
+// 对交易签名，参数：私钥、该笔交易引用的其他交易。
+// 只签名锁定到这个私钥的P2PKH输入，其他输入保持不变
 func (tx *Transation) Sign(privkey ecdsa.PrivateKey, prevTXs map[string]Transation) {
+	tx.SignHashType(privkey, prevTXs, SIGHASH_ALL)
+}
+
+// 与Sign相同，签名覆盖的范围由签名类型决定
+func (tx *Transation) SignHashType(privkey ecdsa.PrivateKey, prevTXs map[string]Transation, hashType byte) {
 	if tx.IsCoinBase() {
 		return
 	}
@@ -178,76 +247,202 @@ func (tx *Transation) Sign(privkey ecdsa.PrivateKey, prevTXs map[string]Transati
 		}
 	}
 
-	// 将当前交易复制一份
-	txcopy := tx.TrimmedCopy()
+	pubKey := append(privkey.PublicKey.X.Bytes(), privkey.PublicKey.Y.Bytes()...)
+	pubkeyHash := HashPubKey(pubKey)
 
 	// 遍历当前交易的所有输入
-	for inID, vin := range txcopy.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.TXid)]
+	for inID, vin := range tx.Vin {
+		prevOut := prevTXs[hex.EncodeToString(vin.TXid)].Vout[vin.Voutindex]
+		if !prevOut.CanBeUnlockedWith(pubkeyHash) {
+			continue
+		}
 
-		txcopy.Vin[inID].Signature = nil
-		txcopy.Vin[inID].PubKey = prevTX.Vout[vin.Voutindex].PubkeyHash	// 将当前输入的公钥设置为其所引用的输出的公钥哈希
+		signature := tx.signatureFor(inID, prevOut.ScriptPubKey, privkey, hashType)
+		if signature == nil {
+			continue
+		}
+		tx.Vin[inID].ScriptSig = payToPubkeyHashSigScript(signature, pubKey)
+	}
+}
 
-		txcopy.ID = txcopy.Hash()
-		r, s, err := ecdsa.Sign(rand.Reader, &privkey, txcopy.ID)
-		checkErr(err)
-		signature := append(r.Bytes(), s.Bytes()...)
+// 签名类型，附在签名的最后一个字节，决定签名覆盖交易的哪些部分：
+// ALL覆盖所有输入与输出；NONE不覆盖输出；SINGLE只覆盖与输入索引相同的输出。
+// 加上ANYONECANPAY时只覆盖当前输入，其他人可以继续添加输入，例如众筹交易中每个出资人只签名自己的输入
+const (
+	SIGHASH_ALL          = 0x01
+	SIGHASH_NONE         = 0x02
+	SIGHASH_SINGLE       = 0x03
+	SIGHASH_ANYONECANPAY = 0x80
+)
 
-		tx.Vin[inID].Signature = signature
+func validSigHashType(hashType byte) bool {
+	base := hashType &^ SIGHASH_ANYONECANPAY
+	return base >= SIGHASH_ALL && base <= SIGHASH_SINGLE
+}
 
+// 解析"ALL"、"NONE|ANYONECANPAY"这样的签名类型，不区分大小写。ALL、NONE、SINGLE最多出现一个
+func parseSigHashType(s string) (byte, error) {
+	var hashType byte
+	for _, name := range strings.Split(strings.ToUpper(s), "|") {
+		var base byte
+		switch strings.TrimSpace(name) {
+		case "ALL":
+			base = SIGHASH_ALL
+		case "NONE":
+			base = SIGHASH_NONE
+		case "SINGLE":
+			base = SIGHASH_SINGLE
+		case "ANYONECANPAY":
+			hashType |= SIGHASH_ANYONECANPAY
+			continue
+		default:
+			return 0, fmt.Errorf("unknown signature hash type %q", name)
+		}
+		if hashType&^SIGHASH_ANYONECANPAY != 0 {
+			return 0, fmt.Errorf("invalid signature hash type %q", s)
+		}
+		hashType |= base
+	}
+	if hashType&^SIGHASH_ANYONECANPAY == 0 {
+		hashType |= SIGHASH_ALL
 	}
+	if !validSigHashType(hashType) {
+		return 0, fmt.Errorf("invalid signature hash type %q", s)
+	}
+	return hashType, nil
 }
 
-func (tx *Transation) Verify(prevTXs map[string]Transation) bool {
-
-	if tx.IsCoinBase() {
-		return true
+func sigHashTypeString(hashType byte) string {
+	names := map[byte]string{SIGHASH_ALL: "ALL", SIGHASH_NONE: "NONE", SIGHASH_SINGLE: "SINGLE"}
+	name, ok := names[hashType&^SIGHASH_ANYONECANPAY]
+	if !ok {
+		return fmt.Sprintf("%#x", hashType)
 	}
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		name += "|ANYONECANPAY"
+	}
+	return name
+}
 
-	// 遍历当前交易的所有输入，检查一下键值对都满足条件
-	for _, vin := range tx.Vin {
-		if prevTXs[hex.EncodeToString(vin.TXid)].ID == nil {
-			log.Panic("error")
+// 第inID个输入的签名哈希：清空所有输入的解锁脚本，把当前输入的解锁脚本替换为subscript（它引用的输出的锁定脚本），
+// 再按签名类型去掉签名不覆盖的部分，最后加上签名类型本身。
+// SINGLE的输入没有对应的输出时返回nil，这样的输入无法签名
+func (tx *Transation) sigHash(inID int, subscript []byte, hashType byte) []byte {
+	txcopy := tx.TrimmedCopy()
+	txcopy.Vin[inID].ScriptSig = subscript
+
+	switch hashType &^ SIGHASH_ANYONECANPAY {
+	case SIGHASH_NONE:
+		txcopy.Vout = nil
+	case SIGHASH_SINGLE:
+		if inID >= len(txcopy.Vout) {
+			return nil
+		}
+		// 之前的输出只保留位置，金额与脚本都不覆盖
+		txcopy.Vout = txcopy.Vout[:inID+1]
+		for i := 0; i < inID; i++ {
+			txcopy.Vout[i] = TXOutput{-1, nil, -1}
 		}
 	}
-	// 将当前交易复制一份
-	txcopy := tx.TrimmedCopy()
-
-	// 生成椭圆曲线
-	curve := elliptic.P256()
+	// 不覆盖输出时，其他输入的序号也不覆盖，它们的所有者可以自行修改
+	if base := hashType &^ SIGHASH_ANYONECANPAY; base == SIGHASH_NONE || base == SIGHASH_SINGLE {
+		for i := range txcopy.Vin {
+			if i != inID {
+				txcopy.Vin[i].Sequence = 0
+			}
+		}
+	}
+	if hashType&SIGHASH_ANYONECANPAY != 0 {
+		txcopy.Vin = txcopy.Vin[inID : inID+1]
+	}
 
-	// 遍历当前交易的所有输入
-	for inID, vin := range tx.Vin {
-		prevTX := prevTXs[hex.EncodeToString(vin.TXid)]	//返回当前输入引用的交易
-		txcopy.Vin[inID].Signature = nil	// 将当前输入的签名设置为nil
+	var e encoder
+	e.writeTransation(&txcopy)
+	e.writeUint32(uint32(hashType))
+	hash := sha256.Sum256(e.Bytes())
+	return hash[:]
+}
 
-		txcopy.Vin[inID].PubKey = prevTX.Vout[vin.Voutindex].PubkeyHash	// 将当前输入的公钥设置为其所引用的输出的公钥哈希
+// 用私钥对第inID个输入签名，r与s各占32字节，最后一个字节是签名类型；无法签名时返回nil
+func (tx *Transation) signatureFor(inID int, subscript []byte, privkey ecdsa.PrivateKey, hashType byte) []byte {
+	hash := tx.sigHash(inID, subscript, hashType)
+	if hash == nil {
+		return nil
+	}
+	r, s, err := ecdsa.Sign(rand.Reader, &privkey, hash)
+	checkErr(err)
+	s = lowS(privkey.Curve, s)
+	sig := append(r.FillBytes(make([]byte, 32)), s.FillBytes(make([]byte, 32))...)
+	return append(sig, hashType)
+}
 
-		txcopy.ID = txcopy.Hash()
+// (r, s)与(r, N-s)都是有效签名，任何人都可以把一个换成另一个。只接受s不大于N/2的签名，
+// 签名时把较大的s换成N-s
+func lowS(curve elliptic.Curve, s *big.Int) *big.Int {
+	n := curve.Params().N
+	if isLowS(curve, s) {
+		return s
+	}
+	return new(big.Int).Sub(n, s)
+}
 
-		r := big.Int{}
-		s := big.Int{}
+func isLowS(curve elliptic.Curve, s *big.Int) bool {
+	halfOrder := new(big.Int).Rsh(curve.Params().N, 1)
+	return s.Cmp(halfOrder) <= 0
+}
 
-		siglen := len(vin.Signature)
-		r.SetBytes(vin.Signature[:(siglen / 2)])
-		s.SetBytes(vin.Signature[(siglen / 2):])
+// 执行每个输入的解锁脚本与它引用的输出的锁定脚本
+func (tx *Transation) Verify(prevTXs map[string]Transation) bool {
 
-		x := big.Int{}
-		y := big.Int{}
+	if tx.IsCoinBase() {
+		return true
+	}
 
-		keylen := len(vin.PubKey)
+	// 遍历当前交易的所有输入，引用的交易都必须存在
+	var prevOuts []TXOutput
+	for _, vin := range tx.Vin {
+		prevTX := prevTXs[hex.EncodeToString(vin.TXid)] //返回当前输入引用的交易
+		if prevTX.ID == nil || vin.Voutindex < 0 || vin.Voutindex >= len(prevTX.Vout) {
+			return false
+		}
+		prevOuts = append(prevOuts, prevTX.Vout[vin.Voutindex])
+	}
+	return tx.verifyInputs(prevOuts)
+}
 
-		x.SetBytes(vin.PubKey[:(keylen / 2)])
-		y.SetBytes(vin.PubKey[(keylen / 2):])
+// 与Verify相同，prevOuts[i]是第i个输入花费的输出
+func (tx *Transation) verifyInputs(prevOuts []TXOutput) bool {
+	// 没有输入的交易不花费任何输出，不能凭空产生交易
+	if len(tx.Vin) == 0 || len(prevOuts) != len(tx.Vin) {
+		return false
+	}
 
-		rawPubkey := ecdsa.PublicKey{curve, &x, &y}
+	// 同一个输出不能被花费两次
+	spent := make(map[string]bool)
+	for _, vin := range tx.Vin {
+		outpoint := fmt.Sprintf("%x:%d", vin.TXid, vin.Voutindex)
+		if spent[outpoint] {
+			return false
+		}
+		spent[outpoint] = true
+	}
 
-		if ecdsa.Verify(&rawPubkey, txcopy.ID, &r, &s) == false {
+	// 遍历当前交易的所有输入
+	inputs := 0
+	for inID, vin := range tx.Vin {
+		if VerifyScript(vin.ScriptSig, prevOuts[inID].ScriptPubKey, tx, inID) != nil {
 			return false
 		}
-		txcopy.Vin[inID].PubKey = nil
+		inputs += prevOuts[inID].Value
 	}
-	return true
+	// 输出总额不能超过输入总额，差额是手续费
+	for _, out := range tx.Vout {
+		if out.Value < 0 {
+			return false
+		}
+		inputs -= out.Value
+	}
+	return inputs >= 0
 
 }
 
@@ -258,35 +453,37 @@ func (tx *Transation) TrimmedCopy() Transation {
 	var outputs []TXOutput
 
 	for _, vin := range tx.Vin {
-		inputs = append(inputs, TXInput{vin.TXid, vin.Voutindex, nil, nil})
+		inputs = append(inputs, TXInput{vin.TXid, vin.Voutindex, nil, vin.Sequence})
 	}
 	for _, vout := range tx.Vout {
-		outputs = append(outputs, TXOutput{vout.Value, vout.PubkeyHash,-1})
+		outputs = append(outputs, TXOutput{vout.Value, vout.ScriptPubKey,-1})
 	}
-	txCopy := Transation{tx.ID, inputs, outputs}
+	txCopy := Transation{tx.ID, inputs, outputs, tx.LockTime}
 	return txCopy
 }
 
 
 
+// 未花费输出连同它们在交易中的索引一起保存
 func (outs TXOutputs) SerializeTXOutputs() []byte {
-	var buff bytes.Buffer
-
-	enc := gob.NewEncoder(&buff)
-
-	err := enc.Encode(outs)
-	checkErr(err)
-	return buff.Bytes()
+	var e encoder
+	e.writeVarInt(uint64(len(outs.Outputs)))
+	for _, out := range outs.Outputs {
+		e.writeInt32(int32(out.index))
+		e.writeTXOutput(out)
+	}
+	return e.Bytes()
 }
+
 func DeserializeTXOutputs(data []byte) TXOutputs {
 	var outputs TXOutputs
-
-	dec := gob.NewDecoder(bytes.NewReader(data))
-
-	err := dec.Decode(&outputs)
-
-	checkErr(err)
-
+	dec := decoder{data: data}
+	for i, n := 0, dec.readCount(); i < n; i++ {
+		index := int(dec.readInt32())
+		out := dec.readTXOutput()
+		out.index = index
+		outputs.Outputs = append(outputs.Outputs, out)
+	}
+	checkErr(dec.finish())
 	return outputs
-
 }
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"bytes"
+	"encoding/hex"
+	"math/big"
+	"testing"
+)
+
+func TestTransationIDExcludesWitness(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	prev := NewCoinbaseTX(addr, "prev")
+	base := testSpend(w, prev, 0, addr, 50)
+
+	tests := []struct {
+		name          string
+		modify        func(tx *Transation)
+		sameID        bool
+		sameWitnessID bool
+	}{
+		{"unchanged", func(tx *Transation) {}, true, true},
+		{"re-signed", func(tx *Transation) {
+			tx.Sign(w.PrivateKey, map[string]Transation{hex.EncodeToString(prev.ID): *prev})
+		}, true, false},
+		{"unlocking script replaced", func(tx *Transation) { tx.Vin[0].ScriptSig = []byte{OP_1} }, true, false},
+		{"output value", func(tx *Transation) { tx.Vout[0].Value = 49 }, false, false},
+		{"sequence", func(tx *Transation) { tx.Vin[0].Sequence = 1 }, false, false},
+		{"lock time", func(tx *Transation) { tx.LockTime = 1 }, false, false},
+	}
+	for _, test := range tests {
+		tx, err := ParseTransation(base.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		test.modify(tx)
+		if got := bytes.Equal(tx.unsignedHash(), base.ID); got != test.sameID {
+			t.Errorf("%s: same id %v, want %v", test.name, got, test.sameID)
+		}
+		if got := bytes.Equal(tx.WitnessHash(), base.WitnessHash()); got != test.sameWitnessID {
+			t.Errorf("%s: same witness hash %v, want %v", test.name, got, test.sameWitnessID)
+		}
+
+		// 区块的默克尔根只跟随交易id，见证默克尔根跟随见证hash
+		tx.ID = tx.unsignedHash()
+		root, witnessRoot := merkleRoots([]*Transation{prev, base})
+		gotRoot, gotWitnessRoot := merkleRoots([]*Transation{prev, tx})
+		if bytes.Equal(root, gotRoot) != test.sameID || bytes.Equal(witnessRoot, gotWitnessRoot) != test.sameWitnessID {
+			t.Errorf("%s: merkle roots do not follow the hashes", test.name)
+		}
+	}
+
+	// coinbase的输入中是数据而不是签名，包含在id中
+	if bytes.Equal(NewCoinbaseTX(addr, "a").ID, NewCoinbaseTX(addr, "b").ID) {
+		t.Error("coinbase data is not committed by the id")
+	}
+}
+
+func TestLowS(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	prev := NewCoinbaseTX(addr, "prev")
+	prevTXs := map[string]Transation{hex.EncodeToString(prev.ID): *prev}
+	n := w.PrivateKey.Curve.Params().N
+	half := new(big.Int).Rsh(n, 1)
+
+	tests := []struct {
+		s   *big.Int
+		low bool
+	}{
+		{big.NewInt(1), true},
+		{half, true},
+		{new(big.Int).Add(half, big.NewInt(1)), false},
+		{new(big.Int).Sub(n, big.NewInt(1)), false},
+	}
+	for _, test := range tests {
+		if isLowS(w.PrivateKey.Curve, test.s) != test.low {
+			t.Errorf("isLowS(%x) = %v", test.s, !test.low)
+		}
+		if s := lowS(w.PrivateKey.Curve, test.s); !isLowS(w.PrivateKey.Curve, s) {
+			t.Errorf("lowS(%x) = %x is high", test.s, s)
+		}
+	}
+
+	// 把签名中的s换成N-s，签名在数学上仍然有效，但不再被接受
+	for i := 0; i < 8; i++ {
+		tx := testSpend(w, prev, 0, addr, 50)
+		if !tx.Verify(prevTXs) {
+			t.Fatal("low-s signature rejected")
+		}
+		pushes := scriptPushes(tx.Vin[0].ScriptSig)
+		sig := append([]byte{}, pushes[0]...)
+		s := new(big.Int).SetBytes(sig[32:64])
+		if !isLowS(w.PrivateKey.Curve, s) {
+			t.Fatalf("signed with high s %x", s)
+		}
+		new(big.Int).Sub(n, s).FillBytes(sig[32:64])
+		tx.Vin[0].ScriptSig = payToPubkeyHashSigScript(sig, pushes[1])
+		if tx.Verify(prevTXs) {
+			t.Fatal("high-s signature accepted")
+		}
+	}
+}
+
+func TestSigHashTypes(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	prevs := []*Transation{NewCoinbaseTX(addr, "a"), NewCoinbaseTX(addr, "b")}
+	script := prevs[0].Vout[0].ScriptPubKey
+	base := &Transation{nil, []TXInput{{prevs[0].ID, 0, nil, 0}, {prevs[1].ID, 0, nil, 0}},
+		[]TXOutput{*NewTXOutput(60, addr), *NewTXOutput(50, addr)}, 0}
+	base.ID = base.unsignedHash()
+
+	hashTypes := []byte{SIGHASH_ALL, SIGHASH_NONE, SIGHASH_SINGLE,
+		SIGHASH_ALL | SIGHASH_ANYONECANPAY, SIGHASH_NONE | SIGHASH_ANYONECANPAY, SIGHASH_SINGLE | SIGHASH_ANYONECANPAY}
+	tests := []struct {
+		name   string
+		modify func(tx *Transation)
+		valid  []bool // 依次对应hashTypes，修改之后第0个输入的签名是否仍然有效
+	}{
+		{"unchanged", func(tx *Transation) {}, []bool{true, true, true, true, true, true}},
+		{"output 0 value", func(tx *Transation) { tx.Vout[0].Value = 1 }, []bool{false, true, false, false, true, false}},
+		{"output 1 value", func(tx *Transation) { tx.Vout[1].Value = 1 }, []bool{false, true, true, false, true, true}},
+		{"extra output", func(tx *Transation) { tx.Vout = append(tx.Vout, *NewTXOutput(1, addr)) }, []bool{false, true, true, false, true, true}},
+		{"extra input", func(tx *Transation) { tx.Vin = append(tx.Vin, TXInput{prevs[1].ID, 1, nil, 0}) }, []bool{false, false, false, true, true, true}},
+		{"input 1 sequence", func(tx *Transation) { tx.Vin[1].Sequence = 1 }, []bool{false, true, true, true, true, true}},
+		{"input 0 sequence", func(tx *Transation) { tx.Vin[0].Sequence = 1 }, []bool{false, false, false, false, false, false}},
+		{"lock time", func(tx *Transation) { tx.LockTime = 1 }, []bool{false, false, false, false, false, false}},
+	}
+	for i, hashType := range hashTypes {
+		signed, err := ParseTransation(base.Serialize())
+		if err != nil {
+			t.Fatal(err)
+		}
+		sig := signed.signatureFor(0, script, w.PrivateKey, hashType)
+		signed.Vin[0].ScriptSig = payToPubkeyHashSigScript(sig, w.PublicKey)
+
+		for _, test := range tests {
+			tx, err := ParseTransation(signed.Serialize())
+			if err != nil {
+				t.Fatal(err)
+			}
+			test.modify(tx)
+			err = VerifyScript(tx.Vin[0].ScriptSig, script, tx, 0)
+			if (err == nil) != test.valid[i] {
+				t.Errorf("%s, %s: valid %v, want %v", sigHashTypeString(hashType), test.name, err == nil, test.valid[i])
+			}
+		}
+	}
+
+	// SINGLE的输入没有对应的输出时无法签名
+	single := &Transation{nil, base.Vin, base.Vout[:1], 0}
+	if single.signatureFor(1, script, w.PrivateKey, SIGHASH_SINGLE) != nil {
+		t.Error("SINGLE signed an input without a matching output")
+	}
+	// 未知的签名类型不被接受
+	sig := base.signatureFor(0, script, w.PrivateKey, SIGHASH_ALL)
+	sig[64] = 0x04
+	if VerifyScript(payToPubkeyHashSigScript(sig, w.PublicKey), script, base, 0) == nil {
+		t.Error("unknown signature hash type accepted")
+	}
+}
+
+func TestParseSigHashType(t *testing.T) {
+	tests := []struct {
+		s        string
+		hashType byte
+		ok       bool
+	}{
+		{"ALL", SIGHASH_ALL, true},
+		{"none", SIGHASH_NONE, true},
+		{"SINGLE|ANYONECANPAY", SIGHASH_SINGLE | SIGHASH_ANYONECANPAY, true},
+		{"ANYONECANPAY", SIGHASH_ALL | SIGHASH_ANYONECANPAY, true},
+		{"NONE|SINGLE", 0, false},
+		{"ALL|NONE", 0, false},
+		{"EVERYTHING", 0, false},
+	}
+	for _, test := range tests {
+		hashType, err := parseSigHashType(test.s)
+		if (err == nil) != test.ok || hashType != test.hashType {
+			t.Errorf("%s: got %#x, %v", test.s, hashType, err)
+		}
+		if test.ok {
+			if back, _ := parseSigHashType(sigHashTypeString(hashType)); back != hashType {
+				t.Errorf("%s: %s does not parse back", test.s, sigHashTypeString(hashType))
+			}
+		}
+	}
+}
@@ -0,0 +1,240 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// 节点之间收发消息的方式。每条消息占用一个连接：发送方写完后关闭连接，接收方读到EOF为止
+type Transport interface {
+	Listen(addr string) (net.Listener, error)
+	Dial(addr string) (net.Conn, error)
+}
+
+// 能够确认对方身份的连接
+type authenticatedConn interface {
+	// 检查连接对方的身份是否与其在消息中声称的节点地址一致
+	verifyPeer(addr string) error
+}
+
+// 基于TCP的真实网络
+type tcpTransport struct{}
+
+func (tcpTransport) Listen(addr string) (net.Listener, error) {
+	return net.Listen("tcp", addr)
+}
+
+func (tcpTransport) Dial(addr string) (net.Conn, error) {
+	return net.Dial("tcp", addr)
+}
+
+// 进程内的模拟网络，可以模拟延迟、乱序、丢包以及网络分区，
+// 用于在同一个进程中运行多个节点并检查它们能否同步到同一条链
+type SimNetwork struct {
+	mu         sync.Mutex
+	listeners  map[string]*simListener
+	partitions map[string]int // 键-节点地址 值-所在分区，不同分区之间的消息全部丢弃
+	latency    time.Duration  // 每条消息的固定延迟
+	jitter     time.Duration  // 随机附加的延迟，不为0时消息会乱序到达
+	dropRate   float64        // 消息被丢弃的概率
+	rand       *rand.Rand
+}
+
+func NewSimNetwork(seed int64) *SimNetwork {
+	return &SimNetwork{
+		listeners:  make(map[string]*simListener),
+		partitions: make(map[string]int),
+		rand:       rand.New(rand.NewSource(seed)),
+	}
+}
+
+// 设置网络状况
+func (n *SimNetwork) SetConditions(latency, jitter time.Duration, dropRate float64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.latency = latency
+	n.jitter = jitter
+	n.dropRate = dropRate
+}
+
+// 把节点划分为互相隔离的分区，没有列出的节点都在分区0中
+func (n *SimNetwork) Partition(groups ...[]string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.partitions = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			n.partitions[addr] = i + 1
+		}
+	}
+}
+
+// 恢复所有分区之间的连通
+func (n *SimNetwork) Heal() {
+	n.Partition()
+}
+
+// 返回地址为addr的节点使用的传输层
+func (n *SimNetwork) Transport(addr string) Transport {
+	return &simTransport{n, addr}
+}
+
+// 决定一条消息的命运：返回false表示丢弃，否则返回投递前的延迟
+func (n *SimNetwork) route(from, to string) (time.Duration, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.partitions[from] != n.partitions[to] {
+		return 0, false
+	}
+	if n.dropRate > 0 && n.rand.Float64() < n.dropRate {
+		return 0, false
+	}
+
+	delay := n.latency
+	if n.jitter > 0 {
+		delay += time.Duration(n.rand.Int63n(int64(n.jitter)))
+	}
+	return delay, true
+}
+
+type simTransport struct {
+	network *SimNetwork
+	addr    string
+}
+
+func (t *simTransport) Listen(addr string) (net.Listener, error) {
+	n := t.network
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if n.listeners[addr] != nil {
+		return nil, errors.New("address already in use: " + addr)
+	}
+	ln := &simListener{n, addr, make(chan net.Conn, 64), make(chan struct{}), sync.Once{}}
+	n.listeners[addr] = ln
+	return ln, nil
+}
+
+// 目标节点没有在监听时立即返回错误，就像连接被拒绝；分区与丢包则是静默丢弃
+func (t *simTransport) Dial(addr string) (net.Conn, error) {
+	n := t.network
+
+	n.mu.Lock()
+	ln := n.listeners[addr]
+	n.mu.Unlock()
+
+	if ln == nil {
+		return nil, errors.New("connection refused: " + addr)
+	}
+	return &simConn{local: t.addr, remote: addr, network: n}, nil
+}
+
+type simListener struct {
+	network  *SimNetwork
+	addr     string
+	incoming chan net.Conn
+	closed   chan struct{}
+	once     sync.Once
+}
+
+func (l *simListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.incoming:
+		return conn, nil
+	case <-l.closed:
+		return nil, errors.New("listener closed")
+	}
+}
+
+func (l *simListener) Close() error {
+	l.once.Do(func() {
+		n := l.network
+		n.mu.Lock()
+		delete(n.listeners, l.addr)
+		n.mu.Unlock()
+		close(l.closed)
+	})
+	return nil
+}
+
+func (l *simListener) Addr() net.Addr {
+	return simAddr(l.addr)
+}
+
+// 把消息交给接收方；接收方已经停止时消息丢失
+func (l *simListener) deliver(conn net.Conn) {
+	select {
+	case l.incoming <- conn:
+	case <-l.closed:
+	}
+}
+
+type simAddr string
+
+func (a simAddr) Network() string { return "sim" }
+func (a simAddr) String() string  { return string(a) }
+
+// 模拟连接。发送方的写入先缓存起来，关闭时整条消息按网络状况投递给接收方
+type simConn struct {
+	local   string
+	remote  string
+	network *SimNetwork
+	buf     bytes.Buffer
+	reader  *bytes.Reader // 接收方读取的内容，发送方为nil
+	once    sync.Once
+}
+
+func (c *simConn) Read(b []byte) (int, error) {
+	if c.reader == nil {
+		return 0, errors.New("read from sending side of sim connection")
+	}
+	return c.reader.Read(b)
+}
+
+func (c *simConn) Write(b []byte) (int, error) {
+	return c.buf.Write(b)
+}
+
+func (c *simConn) Close() error {
+	if c.reader != nil {
+		return nil
+	}
+	c.once.Do(func() {
+		n := c.network
+		delay, ok := n.route(c.local, c.remote)
+		if !ok {
+			return
+		}
+
+		received := &simConn{
+			local:   c.remote,
+			remote:  c.local,
+			network: n,
+			reader:  bytes.NewReader(c.buf.Bytes()),
+		}
+		time.AfterFunc(delay, func() {
+			n.mu.Lock()
+			ln := n.listeners[c.remote]
+			n.mu.Unlock()
+
+			if ln != nil {
+				ln.deliver(received)
+			}
+		})
+	})
+	return nil
+}
+
+func (c *simConn) LocalAddr() net.Addr                { return simAddr(c.local) }
+func (c *simConn) RemoteAddr() net.Addr               { return simAddr(c.remote) }
+func (c *simConn) SetDeadline(t time.Time) error      { return nil }
+func (c *simConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *simConn) SetWriteDeadline(t time.Time) error { return nil }
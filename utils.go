@@ -54,6 +54,13 @@ func ReverseBytes(data []byte) {
 		data[i], data[j] = data[j], data[i]
 	}
 }
+//区块哈希列表反转
+func ReverseHashes(hashes [][]byte) {
+	for i, j := 0, len(hashes)-1; i < j; i, j = i+1, j-1 {
+		hashes[i], hashes[j] = hashes[j], hashes[i]
+	}
+}
+
 func checkErr(err error) {
 	if err != nil {
 		log.Panic(err)
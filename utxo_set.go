@@ -1,6 +1,7 @@
 package main
 
 import (
+	"bytes"
 	"encoding/hex"
 	"github.com/boltdb/bolt"
 	"log"
@@ -44,8 +45,8 @@ func (u UTXOSet) Reindex() {
 	checkErr(err)
 }
 
-// 根据pubkeyhash查找属于其所有的utxo
-func (u *UTXOSet) FindUTXObyPubkeyHash(pubkeyhash []byte) []TXOutput {
+// 根据锁定脚本查找属于其所有的utxo
+func (u *UTXOSet) FindUTXOByScript(script []byte) []TXOutput {
 	var UTXOs []TXOutput
 
 	db := u.bchain.db
@@ -59,7 +60,7 @@ func (u *UTXOSet) FindUTXObyPubkeyHash(pubkeyhash []byte) []TXOutput {
 			outs := DeserializeTXOutputs(v)
 
 			for _, out := range outs.Outputs {
-				if out.CanBeUnlockedWith(pubkeyhash) {
+				if bytes.Equal(out.ScriptPubKey, script) {
 					UTXOs = append(UTXOs, out)
 				}
 			}
@@ -70,6 +71,26 @@ func (u *UTXOSet) FindUTXObyPubkeyHash(pubkeyhash []byte) []TXOutput {
 	return UTXOs
 }
 
+// 交易txid的第index个输出是否还没有被花费
+func (u UTXOSet) IsUnspent(txid []byte, index int) bool {
+	var unspent bool
+
+	err := u.bchain.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket([]byte(utxoBucket)).Get(txid)
+		if data == nil {
+			return nil
+		}
+		for _, out := range DeserializeTXOutputs(data).Outputs {
+			if out.index == index {
+				unspent = true
+			}
+		}
+		return nil
+	})
+	checkErr(err)
+	return unspent
+}
+
 func (u UTXOSet) update(block *Block) {
 
 	db := u.bchain.db
@@ -105,9 +126,17 @@ func (u UTXOSet) update(block *Block) {
 			}
 			newOutputs := TXOutputs{}
 
-			for _, out := range tx.Vout {
+			for outIdx, out := range tx.Vout {
+				// 数据输出永远不能花费，不放进UTXO集合
+				if isUnspendable(out.ScriptPubKey) {
+					continue
+				}
+				out.index = outIdx
 				newOutputs.Outputs = append(newOutputs.Outputs, out)
 			}
+			if len(newOutputs.Outputs) == 0 {
+				continue
+			}
 			err := b.Put(tx.ID, newOutputs.SerializeTXOutputs())
 			checkErr(err)
 		}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+)
+
+// 某个区块之后的UTXO视图，检查区块中的交易时使用。
+// 视图从创世区块开始沿着区块自己的祖先计算，所以分叉上的区块可以花费只存在于分叉上的输出；
+// UTXO集合只跟随主链，用于交易池与钱包
+
+type utxoEntry struct {
+	txID     []byte
+	out      TXOutput
+	coinbase bool
+	height   int32  // 输出所在区块的高度
+	prevHash []byte // 输出所在区块的前一个区块，相对时间锁从它的时间中位数开始计算
+	time     int32  // 输出所在区块的时间，只在创世区块中使用
+}
+
+type utxoView struct {
+	entries map[string]*utxoEntry // 键-outpointKey
+}
+
+// 区块blockHash之后的UTXO视图，blockHash为空时是空的视图
+func (bc *Blockchain) utxoViewAt(blockHash []byte) (*utxoView, error) {
+	view := &utxoView{make(map[string]*utxoEntry)}
+	if len(blockHash) == 0 {
+		return view, nil
+	}
+	hashes := bc.getblockhashFrom(blockHash)
+	if len(hashes) == 0 {
+		return nil, fmt.Errorf("block %x not found", blockHash)
+	}
+	for i := len(hashes) - 1; i >= 0; i-- {
+		block, err := bc.GetBlock(hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		for _, tx := range block.Transations {
+			view.spend(tx)
+			view.add(tx, block.Height, block.PrevBlockHash, block.Time)
+		}
+	}
+	return view, nil
+}
+
+// 加入交易的输出，数据输出永远不能花费，不加入
+func (v *utxoView) add(tx *Transation, height int32, prevHash []byte, time int32) {
+	for i, out := range tx.Vout {
+		if isUnspendable(out.ScriptPubKey) {
+			continue
+		}
+		out.index = i
+		v.entries[outpointKey(tx.ID, i)] = &utxoEntry{tx.ID, out, tx.IsCoinBase(), height, prevHash, time}
+	}
+}
+
+// 删除交易花费的输出
+func (v *utxoView) spend(tx *Transation) {
+	if tx.IsCoinBase() {
+		return
+	}
+	for _, vin := range tx.Vin {
+		delete(v.entries, outpointKey(vin.TXid, vin.Voutindex))
+	}
+}
+
+// 输入花费的输出，不存在或者已经被花费时返回nil
+func (v *utxoView) lookup(vin TXInput) *utxoEntry {
+	return v.entries[outpointKey(vin.TXid, vin.Voutindex)]
+}
+
+// 交易的所有输入花费的输出，有一个不在视图中时返回错误
+func (v *utxoView) prevOuts(tx *Transation) ([]TXOutput, error) {
+	var prevOuts []TXOutput
+	for i, vin := range tx.Vin {
+		entry := v.lookup(vin)
+		if entry == nil {
+			return nil, fmt.Errorf("input %d: output %x:%d is missing or already spent", i, vin.TXid, vin.Voutindex)
+		}
+		prevOuts = append(prevOuts, entry.out)
+	}
+	return prevOuts, nil
+}
+
+// 检查交易的脚本与金额，引用的输出必须在视图中，返回手续费
+func (v *utxoView) verifyTransation(tx *Transation) (int, error) {
+	if tx.IsCoinBase() {
+		return 0, nil
+	}
+	prevOuts, err := v.prevOuts(tx)
+	if err != nil {
+		return 0, err
+	}
+	if !tx.verifyInputs(prevOuts) {
+		return 0, errors.New("invalid script or amount")
+	}
+	fee := 0
+	for _, out := range prevOuts {
+		fee += out.Value
+	}
+	for _, out := range tx.Vout {
+		fee -= out.Value
+	}
+	return fee, nil
+}
@@ -6,33 +6,37 @@ import (
 	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/sha256"
+	"errors"
+	"fmt"
+	"math/big"
 	"golang.org/x/crypto/ripemd160"
 )
 
 const version = byte(0x00)
 
+const wifVersion = byte(0x80) // WIF格式私钥的版本号
+
+const scriptHashVersion = byte(0x05) // 脚本哈希地址的版本号，地址中是赎回脚本的哈希
+
 //用于存储私钥和公钥
 
 type Wallet struct {
 	PrivateKey ecdsa.PrivateKey
 
 	PublicKey []byte
+
+	Path string // HD钱包中的派生路径，随机生成的私钥为空
 }
 
 func NewWallet() *Wallet {
 	privateKey, publicKey := newKeyPair()
 
-	return &Wallet{privateKey, publicKey}
+	return &Wallet{privateKey, publicKey, ""}
 
 }
 
 func (w *Wallet) GetAddress() []byte {
-	pubkeyHash := HashPubKey(w.PublicKey)
-	versionPayload := append([]byte{version}, pubkeyHash...)
-	checksum := checkSum(versionPayload)
-	fullPayLoad := append(versionPayload, checksum...)
-	address := base58Encode(fullPayLoad)
-	return address
+	return []byte(pubkeyHashToAddress(HashPubKey(w.PublicKey)))
 }
 
 func HashPubKey(pubkey []byte) []byte {
@@ -56,15 +60,62 @@ func checkSum(payloac []byte) []byte {
 	return checksum
 }
 
+// 地址是否是公钥哈希或脚本哈希地址
 func ValidateAddress(address []byte) bool {
-	publicHash := base58Decode(address)
-	actualCheckSum := publicHash[len(publicHash)-4:]
+	_, _, err := decodeAddress(string(address))
+	return err == nil
+}
+
+// 地址：版本号、20字节哈希与4字节校验和的base58编码
+func encodeAddress(addressVersion byte, hash []byte) string {
+	versionPayload := append([]byte{addressVersion}, hash...)
+	return string(base58Encode(append(versionPayload, checkSum(versionPayload)...)))
+}
 
-	pubHash := publicHash[1 : len(publicHash)-4]
+// 校验地址，返回版本号与其中的哈希
+func decodeAddress(address string) (byte, []byte, error) {
+	decoded := base58Decode([]byte(address))
+	if len(decoded) != 25 || !bytes.Equal(checkSum(decoded[:21]), decoded[21:]) {
+		return 0, nil, fmt.Errorf("invalid address %q", address)
+	}
+	if decoded[0] != version && decoded[0] != scriptHashVersion {
+		return 0, nil, fmt.Errorf("unknown address version %d in %q", decoded[0], address)
+	}
+	return decoded[0], decoded[1:21], nil
+}
+
+// 校验地址并取出其中的公钥哈希
+func addressToPubkeyHash(address string) ([]byte, error) {
+	addressVersion, pubkeyHash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if addressVersion != version {
+		return nil, fmt.Errorf("%s is a script hash address, not a public key hash address", address)
+	}
+	return pubkeyHash, nil
+}
 
-	targetCheckSum := checkSum(append([]byte{0x00}, pubHash...))
+// 由公钥哈希得到地址
+func pubkeyHashToAddress(pubkeyHash []byte) string {
+	return encodeAddress(version, pubkeyHash)
+}
+
+// 由赎回脚本的哈希得到地址
+func scriptHashToAddress(scriptHash []byte) string {
+	return encodeAddress(scriptHashVersion, scriptHash)
+}
 
-	return bytes.Compare(targetCheckSum, actualCheckSum) == 0
+// 付款到地址时使用的锁定脚本，公钥哈希地址为P2PKH，脚本哈希地址为P2SH
+func addressToScript(address string) ([]byte, error) {
+	addressVersion, hash, err := decodeAddress(address)
+	if err != nil {
+		return nil, err
+	}
+	if addressVersion == scriptHashVersion {
+		return payToScriptHashScript(hash), nil
+	}
+	return payToPubkeyHashScript(hash), nil
 }
 
 //生成私钥和公钥，生成的私钥为结构体ecdsa.PrivateKey的指针
@@ -79,3 +130,41 @@ func newKeyPair() (ecdsa.PrivateKey, []byte) {
 
 	return *private, pubKey
 }
+
+var errInvalidWIF = errors.New("invalid WIF private key")
+
+// WIF格式的私钥：版本号、32字节私钥与4字节校验和的base58编码
+func encodeWIF(d []byte) string {
+	payload := append([]byte{wifVersion}, d...)
+	return string(base58Encode(append(payload, checkSum(payload)...)))
+}
+
+func decodeWIF(wif string) ([]byte, error) {
+	decoded := base58Decode([]byte(wif))
+	if len(decoded) != 37 || decoded[0] != wifVersion {
+		return nil, errInvalidWIF
+	}
+	payload := decoded[:33]
+	if !bytes.Equal(checkSum(payload), decoded[33:]) {
+		return nil, fmt.Errorf("%w: checksum does not match", errInvalidWIF)
+	}
+
+	d := payload[1:]
+	n := elliptic.P256().Params().N
+	if k := new(big.Int).SetBytes(d); k.Sign() == 0 || k.Cmp(n) >= 0 {
+		return nil, fmt.Errorf("%w: key out of range", errInvalidWIF)
+	}
+	return d, nil
+}
+
+// 由私钥的数值得到钱包
+func walletFromPrivateKey(d []byte) *Wallet {
+	curve := elliptic.P256()
+
+	private := ecdsa.PrivateKey{D: new(big.Int).SetBytes(d)}
+	private.PublicKey.Curve = curve
+	private.PublicKey.X, private.PublicKey.Y = curve.ScalarBaseMult(d)
+
+	pubKey := append(private.PublicKey.X.Bytes(), private.PublicKey.Y.Bytes()...)
+	return &Wallet{private, pubKey, ""}
+}
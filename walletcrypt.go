@@ -0,0 +1,222 @@
+package main
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/gob"
+	"errors"
+	"math/big"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// 钱包加密：私钥与HD种子用口令派生的密钥加密（scrypt + AES-256-GCM），
+// 地址与公钥仍然是明文，锁定时也能列出地址、运行轻节点，只是不能签名。
+// 解密密钥只保存在内存中：运行中的节点用walletpassphrase解锁一段时间，
+// 单独运行的命令从环境变量WALLET_PASSPHRASE读取口令，命令结束后密钥随进程消失
+
+const walletPassphraseEnv = "WALLET_PASSPHRASE"
+
+// scrypt参数
+const (
+	scryptN = 1 << 15
+	scryptR = 8
+	scryptP = 1
+)
+
+var errWalletLocked = errors.New("wallet is locked, unlock it with walletpassphrase")
+
+var errWrongPassphrase = errors.New("wrong wallet passphrase")
+
+// 加密参数，保存在钱包文件中
+type walletCrypt struct {
+	Salt  []byte
+	N     int
+	R     int
+	P     int
+	Nonce []byte
+
+	key []byte // 解锁后的密钥，锁定时为nil
+}
+
+// 钱包文件中加密的部分，键-地址 值-私钥
+type walletSecrets struct {
+	Keys map[string][]byte
+	Seed []byte
+}
+
+func newWalletCrypt(passphrase string) (*walletCrypt, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &walletCrypt{Salt: salt, N: scryptN, R: scryptR, P: scryptP}
+	c.key, err = c.deriveKey(passphrase)
+	return c, err
+}
+
+func (c *walletCrypt) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), c.Salt, c.N, c.R, c.P, 32)
+}
+
+func (c *walletCrypt) aead(key []byte) cipher.AEAD {
+	block, err := aes.NewCipher(key)
+	checkErr(err)
+	gcm, err := cipher.NewGCM(block)
+	checkErr(err)
+	return gcm
+}
+
+// 每次加密都使用新的nonce
+func (c *walletCrypt) seal(plaintext []byte) []byte {
+	gcm := c.aead(c.key)
+	c.Nonce = make([]byte, gcm.NonceSize())
+	_, err := rand.Read(c.Nonce)
+	checkErr(err)
+	return gcm.Seal(nil, c.Nonce, plaintext, nil)
+}
+
+func (c *walletCrypt) open(key, ciphertext []byte) ([]byte, error) {
+	plaintext, err := c.aead(key).Open(nil, c.Nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errWrongPassphrase
+	}
+	return plaintext, nil
+}
+
+func (ws *Wallets) IsEncrypted() bool {
+	return ws.crypt != nil
+}
+
+func (ws *Wallets) IsLocked() bool {
+	return ws.crypt != nil && ws.crypt.key == nil
+}
+
+// 取出私钥与种子
+func (ws *Wallets) secrets() walletSecrets {
+	secrets := walletSecrets{Keys: make(map[string][]byte), Seed: ws.Seed}
+	for address, wallet := range ws.WalletsStore {
+		if wallet.PrivateKey.D != nil {
+			secrets.Keys[address] = wallet.PrivateKey.D.Bytes()
+		}
+	}
+	return secrets
+}
+
+// 把解密得到的私钥与种子放回钱包，并确认私钥与文件中明文保存的公钥一致，
+// 防止有人替换了文件中的地址
+func (ws *Wallets) restoreSecrets(data []byte) error {
+	var secrets walletSecrets
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&secrets)
+	if err != nil {
+		return err
+	}
+
+	curve := elliptic.P256()
+	for address, d := range secrets.Keys {
+		wallet := ws.WalletsStore[address]
+		if wallet == nil {
+			return errors.New("wallet file has a private key for unknown address " + address)
+		}
+		wallet.PrivateKey.Curve = curve
+		wallet.PrivateKey.D = new(big.Int).SetBytes(d)
+		wallet.PrivateKey.X, wallet.PrivateKey.Y = curve.ScalarBaseMult(d)
+
+		pubKey := append(wallet.PrivateKey.X.Bytes(), wallet.PrivateKey.Y.Bytes()...)
+		if !bytes.Equal(pubKey, wallet.PublicKey) {
+			return errors.New("public key of " + address + " does not match its private key")
+		}
+	}
+	ws.Seed = secrets.Seed
+	return nil
+}
+
+// 用key解密钱包中的私钥
+func (ws *Wallets) unlockWith(key []byte) error {
+	data, err := ws.crypt.open(key, ws.sealed)
+	if err != nil {
+		return err
+	}
+	err = ws.restoreSecrets(data)
+	if err != nil {
+		return err
+	}
+	ws.crypt.key = key
+	return nil
+}
+
+// 加密一个未加密的钱包
+func (ws *Wallets) EncryptWallet(passphrase string) error {
+	if ws.IsEncrypted() {
+		return errors.New("wallet is already encrypted, use walletpassphrasechange")
+	}
+	if passphrase == "" {
+		return errors.New("passphrase must not be empty")
+	}
+
+	crypt, err := newWalletCrypt(passphrase)
+	if err != nil {
+		return err
+	}
+	ws.crypt = crypt
+	ws.SaveToFile()
+	return nil
+}
+
+// 用口令解锁钱包，解密后的私钥只保存在内存中
+func (ws *Wallets) Unlock(passphrase string) error {
+	if !ws.IsEncrypted() {
+		return errors.New("wallet is not encrypted")
+	}
+
+	key, err := ws.crypt.deriveKey(passphrase)
+	if err != nil {
+		return err
+	}
+	return ws.unlockWith(key)
+}
+
+// 锁定钱包，清除内存中的密钥、私钥与种子
+func (ws *Wallets) Lock() {
+	if !ws.IsEncrypted() {
+		return
+	}
+	for _, wallet := range ws.WalletsStore {
+		wallet.PrivateKey.D = nil
+	}
+	ws.Seed = nil
+	ws.crypt.key = nil
+}
+
+// 修改口令，旧口令错误时返回错误，修改后钱包处于锁定状态
+func (ws *Wallets) ChangePassphrase(oldPassphrase, newPassphrase string) error {
+	if !ws.IsEncrypted() {
+		return errors.New("wallet is not encrypted, use encryptwallet")
+	}
+	if newPassphrase == "" {
+		return errors.New("passphrase must not be empty")
+	}
+
+	key, err := ws.crypt.deriveKey(oldPassphrase)
+	if err != nil {
+		return err
+	}
+	err = ws.unlockWith(key)
+	if err != nil {
+		return err
+	}
+
+	crypt, err := newWalletCrypt(newPassphrase)
+	if err != nil {
+		return err
+	}
+	ws.crypt = crypt
+	ws.SaveToFile()
+	ws.Lock()
+	return nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// 运行中的节点管理钱包的指令。解锁后的密钥只保存在节点的内存中，到期后由节点自己锁定；
+// 这些指令只从control.go中的控制端口接受
+
+type walletunlock struct {
+	Passphrase string
+	Timeout    time.Duration
+}
+
+type walletsend struct {
+	From       string
+	Payments   []Payment
+	CoinSelect string
+	FeeRate    int
+}
+
+func (s *Server) handleWalletCommand(command string, payload []byte) error {
+	if s.wallet == nil {
+		return errors.New("node has no wallet")
+	}
+
+	dec := gob.NewDecoder(bytes.NewReader(payload))
+	switch command {
+	case "walletunlock":
+		var payload walletunlock
+		if err := dec.Decode(&payload); err != nil {
+			return err
+		}
+		return s.unlockWallet(payload.Passphrase, payload.Timeout)
+	case "walletlock":
+		s.lockWallet()
+		fmt.Println("wallet locked")
+		return nil
+	case "walletsend":
+		var payload walletsend
+		if err := dec.Decode(&payload); err != nil {
+			return err
+		}
+		return s.walletSend(payload)
+	}
+	return fmt.Errorf("unknown command %q", command)
+}
+
+// 解锁节点的钱包timeout时间，到期后自动锁定
+func (s *Server) unlockWallet(passphrase string, timeout time.Duration) error {
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	if err := s.wallet.Unlock(passphrase); err != nil {
+		return err
+	}
+	if s.walletLock != nil {
+		s.walletLock.Stop()
+	}
+	s.walletLock = time.AfterFunc(timeout, s.lockWallet)
+	fmt.Printf("wallet unlocked for %s\n", timeout)
+	return nil
+}
+
+func (s *Server) lockWallet() {
+	s.walletMu.Lock()
+	defer s.walletMu.Unlock()
+
+	if s.walletLock != nil {
+		s.walletLock.Stop()
+		s.walletLock = nil
+	}
+	s.wallet.Lock()
+}
+
+// 用节点中解锁的钱包签名付款交易，像收到的交易一样放入交易池并广播
+func (s *Server) walletSend(payload walletsend) error {
+	selector, err := coinSelectorByName(payload.CoinSelect)
+	if err != nil {
+		return err
+	}
+
+	s.walletMu.Lock()
+	locked := s.wallet.IsLocked()
+	wallet := s.wallet.WalletsStore[payload.From]
+	var privKey ecdsa.PrivateKey
+	if wallet != nil {
+		privKey = wallet.PrivateKey
+	}
+	s.walletMu.Unlock()
+	if locked {
+		return errWalletLocked
+	}
+	if privKey.D == nil {
+		return fmt.Errorf("no private key for %s in the wallet", payload.From)
+	}
+
+	tx, fee, err := NewPaymentTransation(payload.From, payload.Payments, s.bc, selector, FeePolicy{payload.FeeRate})
+	if err != nil {
+		return err
+	}
+	s.bc.SignTransation(tx, privKey)
+	fmt.Printf("wallet sends %x with fee %d\n", tx.ID, fee)
+
+	return s.handleTx(append(commandToBytes("tx"), gobEncode(txsend{s.address, tx.Serialize()})...))
+}
@@ -4,29 +4,93 @@ import (
 	"bytes"
 	"crypto/elliptic"
 	"encoding/gob"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"log"
 	"os"
 )
 
 const walletFile = "wallet.dat"
 
+const walletFileFormat = 1
+
 type Wallets struct {
 	WalletsStore map[string]*Wallet
+
+	Seed      []byte    // HD钱包的种子，为nil时钱包中只有随机生成的私钥
+	Account   uint32    // BIP44账户
+	NextIndex [2]uint32 // 收款链与找零链上下一个未分配地址的索引
+
+	WatchOnly map[string][]byte // 观察地址，键-地址 值-公钥（只导入了地址时为nil），节点上永远没有它们的私钥
+
+	Labels map[string]string // 地址的备注
+
+	Scripts map[string][]byte // 脚本哈希地址，键-地址 值-赎回脚本
+
+	hd     bool         // 是否是HD钱包，锁定时Seed为nil
+	crypt  *walletCrypt // 加密参数，未加密时为nil
+	sealed []byte       // 文件中加密的私钥，锁定时保存文件需要原样写回
+}
+
+// 钱包文件。私钥不再直接gob编码ecdsa.PrivateKey，而是只保存私钥的数值
+type walletFileData struct {
+	Format    int // 旧格式的文件中没有这个字段
+	Keys      []walletKey
+	HD        bool
+	Account   uint32
+	NextIndex [2]uint32
+	WatchOnly []walletKey
+	Scripts   []walletScript
+	Crypt     *walletCrypt
+	Secrets   []byte // gob编码的walletSecrets，加密的钱包中是密文
+}
+
+type walletKey struct {
+	Address   string
+	PublicKey []byte
+	Path      string
+	Label     string
+}
+
+type walletScript struct {
+	Address string
+	Script  []byte
+	Label   string
+}
+
+// 旧格式的钱包文件，直接gob编码的Wallets
+type legacyWallets struct {
+	WalletsStore map[string]*Wallet
+	Seed         []byte
+	Account      uint32
+	NextIndex    [2]uint32
 }
 
 func NewWallets() (*Wallets, error) {
 	wallets := Wallets{}
 
 	wallets.WalletsStore = make(map[string]*Wallet)
+	wallets.WatchOnly = make(map[string][]byte)
+	wallets.Labels = make(map[string]string)
+	wallets.Scripts = make(map[string][]byte)
 
 	err := wallets.LoadFromFile()
 	return &wallets, err
 
 }
 
+// HD钱包按顺序派生下一个收款地址，否则随机生成私钥
 func (ws *Wallets) CreateWallet() string {
+	if ws.IsLocked() {
+		log.Panic(errWalletLocked)
+	}
+
 	wallet := NewWallet()
+	if ws.hd {
+		wallet = ws.deriveWallet(externalChain, ws.NextIndex[externalChain])
+		ws.NextIndex[externalChain]++
+	}
 
 	address := fmt.Sprintf("%s", wallet.GetAddress())
 	ws.WalletsStore[address] = wallet
@@ -34,6 +98,197 @@ func (ws *Wallets) CreateWallet() string {
 	return address
 }
 
+// 用助记词初始化HD种子，已经有种子的钱包不能再初始化
+func (ws *Wallets) InitHD(mnemonic, passphrase string) error {
+	if ws.hd {
+		return errors.New("wallet already has an HD seed")
+	}
+	if ws.IsLocked() {
+		return errWalletLocked
+	}
+	seed, err := MnemonicToSeed(mnemonic, passphrase)
+	if err != nil {
+		return err
+	}
+	ws.Seed = seed
+	ws.hd = true
+	return nil
+}
+
+func (ws *Wallets) deriveWallet(chain, index uint32) *Wallet {
+	path := hdPath(ws.Account, chain, index)
+	indexes, err := ParseDerivationPath(path)
+	checkErr(err)
+
+	privateKey, publicKey := NewMasterKey(ws.Seed).Derive(indexes).keyPair()
+	return &Wallet{privateKey, publicKey, path}
+}
+
+// 恢复钱包时在收款链与找零链上查找用过的地址，直到连续hdGapLimit个地址都没有用过，
+// used判断一个公钥哈希是否在链上出现过。返回找到的地址个数
+func (ws *Wallets) Discover(used func(pubkeyHash []byte) bool) int {
+	found := 0
+	for _, chain := range []uint32{externalChain, changeChain} {
+		gap := 0
+		for index := uint32(0); gap < hdGapLimit; index++ {
+			wallet := ws.deriveWallet(chain, index)
+			if !used(HashPubKey(wallet.PublicKey)) {
+				gap++
+				continue
+			}
+
+			ws.WalletsStore[string(wallet.GetAddress())] = wallet
+			if index >= ws.NextIndex[chain] {
+				ws.NextIndex[chain] = index + 1
+			}
+			gap = 0
+			found++
+		}
+	}
+	return found
+}
+
+// 导入观察地址
+func (ws *Wallets) ImportAddress(address string) error {
+	if _, err := addressToPubkeyHash(address); err != nil {
+		return err
+	}
+	if ws.WalletsStore[address] != nil {
+		return fmt.Errorf("%s is already in the wallet with its private key", address)
+	}
+	if _, ok := ws.WatchOnly[address]; !ok {
+		ws.WatchOnly[address] = nil
+	}
+	return nil
+}
+
+// 导入观察公钥，返回对应的地址
+func (ws *Wallets) ImportPubKey(pubkey []byte) (string, error) {
+	if len(pubkey) == 0 || len(pubkey) > 64 {
+		return "", fmt.Errorf("invalid public key %x", pubkey)
+	}
+	address := string((&Wallet{PublicKey: pubkey}).GetAddress())
+	if ws.WalletsStore[address] != nil {
+		return "", fmt.Errorf("%s is already in the wallet with its private key", address)
+	}
+	ws.WatchOnly[address] = pubkey
+	return address, nil
+}
+
+// 导入WIF格式的私钥，原来是观察地址的变为有私钥的地址。返回对应的地址
+func (ws *Wallets) ImportPrivateKey(wif string) (string, error) {
+	if ws.IsLocked() {
+		return "", errWalletLocked
+	}
+	d, err := decodeWIF(wif)
+	if err != nil {
+		return "", err
+	}
+
+	wallet := walletFromPrivateKey(d)
+	address := string(wallet.GetAddress())
+	if existing := ws.WalletsStore[address]; existing != nil {
+		return address, fmt.Errorf("%s is already in the wallet", address)
+	}
+	delete(ws.WatchOnly, address)
+	ws.WalletsStore[address] = wallet
+	return address, nil
+}
+
+// 导出地址的私钥，HD钱包中的地址也可以单独导出
+func (ws *Wallets) DumpPrivateKey(address string) (string, error) {
+	wallet := ws.WalletsStore[address]
+	if wallet == nil {
+		return "", fmt.Errorf("no private key for %s in the wallet", address)
+	}
+	if wallet.PrivateKey.D == nil {
+		return "", errWalletLocked
+	}
+	return encodeWIF(wallet.PrivateKey.D.FillBytes(make([]byte, 32))), nil
+}
+
+// 添加m-of-n多重签名地址，返回地址与赎回脚本。只保存赎回脚本，签名需要各公钥所在的钱包
+func (ws *Wallets) AddMultiSigAddress(m int, pubKeys [][]byte) (string, []byte, error) {
+	script, err := multiSigScript(m, pubKeys)
+	if err != nil {
+		return "", nil, err
+	}
+	address, err := ws.AddScript(script)
+	return address, script, err
+}
+
+// 添加锁定到address的时间锁地址，relative为假时lock为区块高度或时间，否则为相对锁定的序号
+func (ws *Wallets) AddTimeLockAddress(address string, lock uint32, relative bool) (string, []byte, error) {
+	pubkeyHash, err := addressToPubkeyHash(address)
+	if err != nil {
+		return "", nil, err
+	}
+	if lock == 0 {
+		return "", nil, errors.New("lock time must not be zero")
+	}
+	script := timeLockScript(lock, relative, pubkeyHash)
+	scriptAddress, err := ws.AddScript(script)
+	return scriptAddress, script, err
+}
+
+// 添加赎回脚本，返回它的脚本哈希地址。花费时赎回脚本作为一个元素压栈，长度受元素大小限制
+func (ws *Wallets) AddScript(redeemScript []byte) (string, error) {
+	if len(redeemScript) == 0 || len(redeemScript) > maxScriptElementSize {
+		return "", fmt.Errorf("redeem script is %d bytes, need 1 to %d", len(redeemScript), maxScriptElementSize)
+	}
+	if _, err := parseScript(redeemScript); err != nil {
+		return "", err
+	}
+	if extractScriptHash(redeemScript) != nil {
+		return "", errors.New("redeem script can not be a script hash script")
+	}
+	address := scriptHashToAddress(HashPubKey(redeemScript))
+	ws.Scripts[address] = redeemScript
+	return address, nil
+}
+
+// 设置地址的备注，备注为空时删除
+func (ws *Wallets) SetLabel(address, label string) error {
+	if ws.WalletsStore[address] == nil && ws.Scripts[address] == nil {
+		if _, ok := ws.WatchOnly[address]; !ok {
+			return fmt.Errorf("%s is not in the wallet", address)
+		}
+	}
+	if label == "" {
+		delete(ws.Labels, address)
+	} else {
+		ws.Labels[address] = label
+	}
+	return nil
+}
+
+// 地址的公钥，观察地址只导入了地址时返回nil
+func (ws *Wallets) PublicKey(address string) []byte {
+	if wallet := ws.WalletsStore[address]; wallet != nil {
+		return wallet.PublicKey
+	}
+	return ws.WatchOnly[address]
+}
+
+// 钱包中有私钥的地址与观察地址的公钥哈希
+func (ws *Wallets) PubkeyHashes() (mine, watchOnly [][]byte) {
+	for _, wallet := range ws.WalletsStore {
+		mine = append(mine, HashPubKey(wallet.PublicKey))
+	}
+	for address := range ws.WatchOnly {
+		pubkeyHash, err := addressToPubkeyHash(address)
+		checkErr(err)
+		watchOnly = append(watchOnly, pubkeyHash)
+	}
+	return mine, watchOnly
+}
+
+// 跟踪钱包中所有地址的交易集合
+func (ws *Wallets) TxSet(bc *Blockchain) WalletTxSet {
+	mine, watchOnly := ws.PubkeyHashes()
+	return WalletTxSet{bc, append(mine, watchOnly...)}
+}
+
 func (ws *Wallets) GetWallet(address string) Wallet {
 
 	return *ws.WalletsStore[address]
@@ -47,33 +302,124 @@ func (ws *Wallets) getAddress() []string {
 	return addresses
 }
 
+// 写入钱包文件，加密的钱包在锁定时原样写回之前的密文
 func (ws *Wallets) SaveToFile() {
-	var content bytes.Buffer
+	data := walletFileData{
+		Format:    walletFileFormat,
+		HD:        ws.hd,
+		Account:   ws.Account,
+		NextIndex: ws.NextIndex,
+		Crypt:     ws.crypt,
+	}
+	for address, wallet := range ws.WalletsStore {
+		data.Keys = append(data.Keys, walletKey{address, wallet.PublicKey, wallet.Path, ws.Labels[address]})
+	}
+	for address, pubkey := range ws.WatchOnly {
+		data.WatchOnly = append(data.WatchOnly, walletKey{address, pubkey, "", ws.Labels[address]})
+	}
+	for address, script := range ws.Scripts {
+		data.Scripts = append(data.Scripts, walletScript{address, script, ws.Labels[address]})
+	}
 
-	gob.Register(elliptic.P256())
+	if ws.IsLocked() {
+		data.Secrets = ws.sealed
+	} else {
+		var secrets bytes.Buffer
+		err := gob.NewEncoder(&secrets).Encode(ws.secrets())
+		checkErr(err)
+
+		data.Secrets = secrets.Bytes()
+		if ws.crypt != nil {
+			data.Secrets = ws.crypt.seal(data.Secrets)
+			ws.sealed = data.Secrets
+		}
+	}
+
+	var content bytes.Buffer
 	encoder := gob.NewEncoder(&content)
 
-	err := encoder.Encode(ws)
+	err := encoder.Encode(data)
 
 	checkErr(err)
 
-	err = ioutil.WriteFile(walletFile, content.Bytes(), 0777)
+	err = ioutil.WriteFile(walletFile, content.Bytes(), 0600)
 
 	checkErr(err)
 
 }
 
+// 读取钱包文件，加密的钱包处于锁定状态，设置了环境变量WALLET_PASSPHRASE时用它解锁
 func (ws *Wallets) LoadFromFile() error {
 	if _, err := os.Stat(walletFile); os.IsNotExist(err) {
 		return err
 	}
 	fileContent, err := ioutil.ReadFile(walletFile)
 	checkErr(err)
-	var wallets Wallets
+
+	var data walletFileData
+	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
+	err = decoder.Decode(&data)
+	if err != nil || data.Format == 0 {
+		ws.loadLegacy(fileContent)
+		return nil
+	}
+
+	ws.WalletsStore = make(map[string]*Wallet)
+	ws.Labels = make(map[string]string)
+	for _, key := range data.Keys {
+		ws.WalletsStore[key.Address] = &Wallet{PublicKey: key.PublicKey, Path: key.Path}
+		if key.Label != "" {
+			ws.Labels[key.Address] = key.Label
+		}
+	}
+	ws.WatchOnly = make(map[string][]byte)
+	for _, key := range data.WatchOnly {
+		ws.WatchOnly[key.Address] = key.PublicKey
+		if key.Label != "" {
+			ws.Labels[key.Address] = key.Label
+		}
+	}
+	ws.Scripts = make(map[string][]byte)
+	for _, script := range data.Scripts {
+		ws.Scripts[script.Address] = script.Script
+		if script.Label != "" {
+			ws.Labels[script.Address] = script.Label
+		}
+	}
+	ws.hd = data.HD
+	ws.Account = data.Account
+	ws.NextIndex = data.NextIndex
+	ws.crypt = data.Crypt
+	ws.sealed = data.Secrets
+
+	if ws.crypt == nil {
+		err = ws.restoreSecrets(data.Secrets)
+		checkErr(err)
+		return nil
+	}
+	if passphrase := os.Getenv(walletPassphraseEnv); passphrase != "" {
+		return ws.Unlock(passphrase)
+	}
+	return nil
+}
+
+// 旧格式的钱包文件，私钥是明文，下次保存时转换为新格式
+func (ws *Wallets) loadLegacy(fileContent []byte) {
+	var wallets legacyWallets
 	gob.Register(elliptic.P256())
 	decoder := gob.NewDecoder(bytes.NewReader(fileContent))
-	err = decoder.Decode(&wallets)
+	err := decoder.Decode(&wallets)
 	checkErr(err)
+
 	ws.WalletsStore = wallets.WalletsStore
-	return nil
+	if ws.WalletsStore == nil {
+		ws.WalletsStore = make(map[string]*Wallet)
+	}
+	ws.WatchOnly = make(map[string][]byte)
+	ws.Labels = make(map[string]string)
+	ws.Scripts = make(map[string][]byte)
+	ws.Seed = wallets.Seed
+	ws.hd = wallets.Seed != nil
+	ws.Account = wallets.Account
+	ws.NextIndex = wallets.NextIndex
 }
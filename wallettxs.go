@@ -0,0 +1,321 @@
+package main
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/boltdb/bolt"
+)
+
+// 钱包交易集合：与UTXOSet一样保存在区块链数据库中，只记录与钱包地址（包括观察地址）有关的交易。
+// 区块连接到链上时记录其中的交易，区块因为分叉被断开时撤销，交易池中的交易记为未确认
+
+const walletTxBucket = "wallettxs"
+
+const coinbaseMaturity = 100 // 确认数不足的coinbase输出计为未成熟余额，钱包不用它们选币
+
+var walletSyncedKey = []byte("l") // 钱包交易集合已经同步到的区块
+
+type WalletTxSet struct {
+	bchain       *Blockchain
+	pubkeyHashes [][]byte
+}
+
+// 钱包余额，单位与交易输出相同
+type WalletBalance struct {
+	Confirmed   int
+	Unconfirmed int // 交易池中的交易带来的输出
+	Immature    int // 尚未成熟的coinbase输出
+}
+
+func (w WalletTxSet) put(tx *Transation, blockHash []byte, height int32) {
+	err := w.bchain.db.Update(func(btx *bolt.Tx) error {
+		b, err := btx.CreateBucketIfNotExists([]byte(walletTxBucket))
+		checkErr(err)
+
+		var buff bytes.Buffer
+		err = gob.NewEncoder(&buff).Encode(walletTx{blockHash, height, tx.Serialize()})
+		checkErr(err)
+		return b.Put(tx.ID, buff.Bytes())
+	})
+	checkErr(err)
+}
+
+func (w WalletTxSet) setSynced(hash []byte) {
+	err := w.bchain.db.Update(func(btx *bolt.Tx) error {
+		b, err := btx.CreateBucketIfNotExists([]byte(walletTxBucket))
+		checkErr(err)
+		return b.Put(walletSyncedKey, hash)
+	})
+	checkErr(err)
+}
+
+func (w WalletTxSet) synced() []byte {
+	var hash []byte
+
+	err := w.bchain.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(walletTxBucket))
+		if b != nil {
+			hash = append([]byte{}, b.Get(walletSyncedKey)...)
+		}
+		return nil
+	})
+	checkErr(err)
+
+	if len(hash) == 0 {
+		return nil
+	}
+	return hash
+}
+
+// 记录区块中与钱包有关的交易
+func (w WalletTxSet) ConnectBlock(block *Block) {
+	for _, tx := range block.Transations {
+		if txMatches(tx, w.pubkeyHashes) {
+			w.put(tx, block.Hash, block.Height)
+		}
+	}
+	w.setSynced(block.Hash)
+}
+
+// 撤销区块中的交易：普通交易回到未确认状态，coinbase交易直接删除
+func (w WalletTxSet) DisconnectBlock(block *Block) {
+	for _, tx := range block.Transations {
+		if !txMatches(tx, w.pubkeyHashes) {
+			continue
+		}
+		if tx.IsCoinBase() {
+			err := w.bchain.db.Update(func(btx *bolt.Tx) error {
+				return btx.Bucket([]byte(walletTxBucket)).Delete(tx.ID)
+			})
+			checkErr(err)
+			continue
+		}
+		w.put(tx, nil, -1)
+	}
+	w.setSynced(block.PrevBlockHash)
+}
+
+// 高度为height的coinbase输出在最新区块高度为tipHeight时是否还没有成熟。
+// 创世区块的输出是整条链最初的资金，不需要等待
+func isImmature(coinbase bool, height, tipHeight int32) bool {
+	return coinbase && height > 0 && tipHeight-height+1 < coinbaseMaturity
+}
+
+// 记录交易池中与钱包有关的交易，已经打包的交易不受影响
+func (w WalletTxSet) AddUnconfirmed(tx *Transation) {
+	if !txMatches(tx, w.pubkeyHashes) {
+		return
+	}
+	for _, wtx := range w.Transations() {
+		if bytes.Equal(wtx.tx.ID, tx.ID) {
+			return
+		}
+	}
+	w.put(tx, nil, -1)
+}
+
+// 删除未确认的交易，已经打包的交易不受影响。交易被挤出交易池或者与其他交易冲突时调用
+func (w WalletTxSet) RemoveUnconfirmed(txID []byte) {
+	err := w.bchain.db.Update(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(walletTxBucket))
+		if b == nil {
+			return nil
+		}
+		var wtx walletTx
+		if data := b.Get(txID); data == nil || gob.NewDecoder(bytes.NewReader(data)).Decode(&wtx) != nil || wtx.BlockHash != nil {
+			return nil
+		}
+		return b.Delete(txID)
+	})
+	checkErr(err)
+}
+
+// 删除引用的输出已经不在UTXO集合中的未确认交易：它们与链上的交易冲突，永远不会被打包。
+// 输出也可以来自仍然保留的其他未确认交易
+func (w WalletTxSet) dropConflicts() {
+	set := UTXOSet{w.bchain}
+
+	unconfirmed := make(map[string]*Transation)
+	for _, wtx := range w.Transations() {
+		if wtx.BlockHash == nil {
+			unconfirmed[hex.EncodeToString(wtx.tx.ID)] = wtx.tx
+		}
+	}
+	for changed := true; changed; {
+		changed = false
+		for id, tx := range unconfirmed {
+			for _, in := range tx.Vin {
+				if unconfirmed[hex.EncodeToString(in.TXid)] == nil && !set.IsUnspent(in.TXid, in.Voutindex) {
+					fmt.Printf("dropping unconfirmed wallet transation %s, it conflicts with the chain\n", id)
+					w.RemoveUnconfirmed(tx.ID)
+					delete(unconfirmed, id)
+					changed = true
+					break
+				}
+			}
+		}
+	}
+}
+
+// 从上次同步到的区块出发，断开不再位于主链上的区块，再连接主链上的新区块，
+// 最后删除与链冲突的未确认交易。节点启动读取钱包时也经过这里
+func (w WalletTxSet) Sync() {
+	defer w.dropConflicts()
+
+	bc := w.bchain
+
+	synced := w.synced()
+	if synced == nil || !bc.HasBlock(synced) {
+		w.Rescan()
+		return
+	}
+
+	old, err := bc.GetBlock(synced)
+	checkErr(err)
+	cur, err := bc.GetBlock(bc.Tip())
+	checkErr(err)
+
+	var connect []Block
+	for old.Height > cur.Height {
+		w.DisconnectBlock(&old)
+		old, err = bc.GetBlock(old.PrevBlockHash)
+		checkErr(err)
+	}
+	for cur.Height > old.Height {
+		connect = append(connect, cur)
+		cur, err = bc.GetBlock(cur.PrevBlockHash)
+		checkErr(err)
+	}
+	for !bytes.Equal(old.Hash, cur.Hash) {
+		w.DisconnectBlock(&old)
+		connect = append(connect, cur)
+
+		old, err = bc.GetBlock(old.PrevBlockHash)
+		checkErr(err)
+		cur, err = bc.GetBlock(cur.PrevBlockHash)
+		checkErr(err)
+	}
+
+	for i := len(connect) - 1; i >= 0; i-- {
+		w.ConnectBlock(&connect[i])
+	}
+}
+
+// 重新扫描整条主链，钱包导入新地址之后使用。未确认的交易保留
+func (w WalletTxSet) Rescan() {
+	var unconfirmed []*Transation
+	for _, wtx := range w.Transations() {
+		if wtx.BlockHash == nil && !wtx.tx.IsCoinBase() {
+			unconfirmed = append(unconfirmed, wtx.tx)
+		}
+	}
+
+	err := w.bchain.db.Update(func(btx *bolt.Tx) error {
+		err := btx.DeleteBucket([]byte(walletTxBucket))
+		if err != nil && err != bolt.ErrBucketNotFound {
+			return err
+		}
+		_, err = btx.CreateBucket([]byte(walletTxBucket))
+		return err
+	})
+	checkErr(err)
+
+	var blocks []*Block
+	bci := w.bchain.iterator()
+	for {
+		block := bci.Next()
+		blocks = append(blocks, block)
+		if len(block.PrevBlockHash) == 0 {
+			break
+		}
+	}
+
+	for _, tx := range unconfirmed {
+		w.put(tx, nil, -1)
+	}
+	for i := len(blocks) - 1; i >= 0; i-- {
+		w.ConnectBlock(blocks[i])
+	}
+	fmt.Printf("rescanned %d blocks for %d wallet addresses\n", len(blocks), len(w.pubkeyHashes))
+}
+
+type trackedTx struct {
+	walletTx
+	tx *Transation
+}
+
+// 钱包中所有记录的交易
+func (w WalletTxSet) Transations() []trackedTx {
+	var txs []trackedTx
+
+	err := w.bchain.db.View(func(btx *bolt.Tx) error {
+		b := btx.Bucket([]byte(walletTxBucket))
+		if b == nil {
+			return nil
+		}
+		return b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(k, walletSyncedKey) {
+				return nil
+			}
+
+			var wtx walletTx
+			err := gob.NewDecoder(bytes.NewReader(v)).Decode(&wtx)
+			checkErr(err)
+
+			tx, err := ParseTransation(wtx.Transation)
+			checkErr(err)
+			txs = append(txs, trackedTx{wtx, tx})
+			return nil
+		})
+	})
+	checkErr(err)
+	return txs
+}
+
+// 计算pubkeyHashes中地址的余额。被钱包中任何交易（包括未确认的）花费掉的输出不再计入
+func (w WalletTxSet) Balance(pubkeyHashes [][]byte) WalletBalance {
+	txs := w.Transations()
+	tipHeight := w.bchain.GetBestHeight()
+
+	spent := make(map[string]bool) // 键-交易id:输出索引
+	for _, wtx := range txs {
+		if wtx.tx.IsCoinBase() {
+			continue
+		}
+		for _, in := range wtx.tx.Vin {
+			spent[fmt.Sprintf("%s:%d", hex.EncodeToString(in.TXid), in.Voutindex)] = true
+		}
+	}
+
+	var balance WalletBalance
+	for _, wtx := range txs {
+		for i, out := range wtx.tx.Vout {
+			if spent[fmt.Sprintf("%s:%d", hex.EncodeToString(wtx.tx.ID), i)] {
+				continue
+			}
+			mine := false
+			for _, pkh := range pubkeyHashes {
+				if out.CanBeUnlockedWith(pkh) {
+					mine = true
+					break
+				}
+			}
+			if !mine {
+				continue
+			}
+
+			switch {
+			case wtx.BlockHash == nil:
+				balance.Unconfirmed += out.Value
+			case isImmature(wtx.tx.IsCoinBase(), wtx.Height, tipHeight):
+				balance.Immature += out.Value
+			default:
+				balance.Confirmed += out.Value
+			}
+		}
+	}
+	return balance
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"path/filepath"
+	"testing"
+)
+
+func TestFindCoinsSkipsImmatureCoinbase(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	genesisTx := NewCoinbaseTX(addr, genesisData)
+	genesis := NewGensisBlock([]*Transation{genesisTx})
+	bc := OpenBlockchain(filepath.Join(t.TempDir(), "chain.db"), func() *Block { return genesis })
+	defer bc.Close()
+
+	reward := testCoinbase(addr, "reward", subsidy)
+	prev := NewBlock([]*Transation{reward}, genesis.Hash, 1)
+	if err := bc.AddBlock(prev); err != nil {
+		t.Fatal(err)
+	}
+	script := genesisTx.Vout[0].ScriptPubKey
+	other := string(NewWallet().GetAddress())
+
+	hasReward := func() bool {
+		for _, coin := range bc.FindCoins(script) {
+			if bytes.Equal(coin.TxID, reward.ID) {
+				return true
+			}
+		}
+		return false
+	}
+
+	tests := []struct {
+		height int32 // 最新区块的高度
+		mature bool
+	}{
+		{1, false},
+		{coinbaseMaturity - 1, false},
+		{coinbaseMaturity, true},
+	}
+	for _, test := range tests {
+		for prev.Height < test.height {
+			filler := testCoinbase(other, fmt.Sprint(prev.Height+1), subsidy)
+			block := NewBlock([]*Transation{filler}, prev.Hash, prev.Height+1)
+			if err := bc.AddBlock(block); err != nil {
+				t.Fatal(err)
+			}
+			prev = block
+		}
+		if got := hasReward(); got != test.mature {
+			t.Errorf("tip height %d: coinbase spendable %v, want %v", test.height, got, test.mature)
+		}
+		if len(bc.FindCoins(script)) == 0 {
+			t.Errorf("tip height %d: genesis output is not spendable", test.height)
+		}
+	}
+}
+
+func TestWalletDropsUnconfirmedConflicts(t *testing.T) {
+	w := NewWallet()
+	addr := string(w.GetAddress())
+	genesisTx := NewCoinbaseTX(addr, genesisData)
+	genesis := NewGensisBlock([]*Transation{genesisTx})
+	bc := OpenBlockchain(filepath.Join(t.TempDir(), "chain.db"), func() *Block { return genesis })
+	defer bc.Close()
+	UTXOSet{bc}.Reindex()
+
+	wtxs := WalletTxSet{bc, [][]byte{HashPubKey(w.PublicKey)}}
+	wtxs.Sync()
+
+	evicted := testSpend(w, genesisTx, 0, addr, 95)
+	conflict := testSpend(w, genesisTx, 0, addr, 90)
+	child := testSpend(w, conflict, 0, addr, 80)
+	wtxs.AddUnconfirmed(evicted)
+	wtxs.AddUnconfirmed(conflict)
+	wtxs.AddUnconfirmed(child)
+
+	// 交易池挤出的交易从钱包中删除
+	wtxs.RemoveUnconfirmed(evicted.ID)
+	// 已经打包的交易不会被删除
+	wtxs.RemoveUnconfirmed(genesisTx.ID)
+
+	// 链上花费了conflict引用的输出，conflict以及花费它的child在同步时删除
+	mined := testSpend(w, genesisTx, 0, addr, 85)
+	block := NewBlock([]*Transation{mined}, genesis.Hash, 1)
+	if err := bc.AddBlock(block); err != nil {
+		t.Fatal(err)
+	}
+	UTXOSet{bc}.update(block)
+	wtxs.Sync()
+
+	want := map[string]bool{string(genesisTx.ID): true, string(mined.ID): true}
+	for _, wtx := range wtxs.Transations() {
+		if !want[string(wtx.tx.ID)] {
+			t.Errorf("wallet still tracks %x", wtx.tx.ID)
+		}
+		delete(want, string(wtx.tx.ID))
+	}
+	for id := range want {
+		t.Errorf("wallet lost %x", id)
+	}
+	if balance := wtxs.Balance(wtxs.pubkeyHashes); balance != (WalletBalance{Confirmed: 85}) {
+		t.Errorf("balance %+v, want 85 confirmed", balance)
+	}
+}